@@ -7,13 +7,20 @@ import (
 	"go.uber.org/zap"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/shadyziedan/metrica/internal/agent/agent"
 	"github.com/shadyziedan/metrica/internal/agent/config"
 	"github.com/shadyziedan/metrica/internal/agent/logger"
 	"github.com/shadyziedan/metrica/internal/agent/services"
+	"github.com/shadyziedan/metrica/internal/codec"
+	"github.com/shadyziedan/metrica/internal/compression"
+	"github.com/shadyziedan/metrica/internal/retry"
 )
 
+// keyReloadInterval is how often the key files are checked for changes.
+const keyReloadInterval = 10 * time.Second
+
 var (
 	BuildVersion string
 	BuildDate    string
@@ -28,15 +35,87 @@ func main() {
 	}
 
 	cnf := config.ParseConfig()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if _, err = agent.ParseStrategy(cnf.EndpointStrategy); err != nil {
+		logger.Log.Fatal("invalid endpoint strategy", zap.Error(err))
+	}
+
+	if cnf.Compression != "" && !compression.IsSupported(cnf.Compression) {
+		logger.Log.Fatal("unsupported compression", zap.String("compression", cnf.Compression))
+	}
+	compressionLevel, err := compression.ParseLevel(cnf.CompressionLevel)
+	if err != nil {
+		logger.Log.Fatal("invalid compression level", zap.Error(err))
+	}
 
-	var options []agent.Option
+	format, err := codec.ParseFormat(cnf.Format)
+	if err != nil {
+		logger.Log.Fatal("invalid format", zap.Error(err))
+	}
+
+	options := []agent.Option{
+		agent.WithCompression(cnf.Compression, compressionLevel),
+		agent.WithCodec(format),
+	}
 	if cnf.CryptoKey != "" {
-		encryptor, err := security.NewDefaultEncryptorFromFile(cnf.CryptoKey)
+		encryptor, err := security.NewDefaultEncryptorFromFile(cnf.CryptoKey, cnf.EncryptionScheme,
+			security.WithSessionKeyTTL(cnf.SessionKeyTTL.Duration))
 		if err != nil {
 			logger.Log.Error("encryption key is not loaded", zap.Error(err))
 		} else {
 			options = append(options, agent.WithEncryptor(encryptor))
+			if cnf.EncryptResponses {
+				options = append(options, agent.WithResponseEncryption())
+			}
+			go security.WatchFiles(ctx, keyReloadInterval, func() {
+				if err := encryptor.Reload(); err != nil {
+					logger.Log.Error("encryption key is not reloaded", zap.Error(err))
+					return
+				}
+				logger.Log.Info("encryption key reloaded")
+			}, cnf.CryptoKey)
+		}
+	}
+
+	if cnf.TLSCA != "" || cnf.TLSCert != "" {
+		tlsConfig, err := security.NewClientTLSConfig(cnf.TLSCA, cnf.TLSCert, cnf.TLSKey)
+		if err != nil {
+			logger.Log.Fatal("failed to load tls configuration", zap.Error(err))
 		}
+		options = append(options, agent.WithTLSConfig(tlsConfig))
+	}
+
+	if cnf.Token != "" {
+		options = append(options, agent.WithToken(cnf.Token))
+	}
+
+	options = append(options, agent.WithRetryPolicy(retry.Policy{
+		MaxRetries:      cnf.RetryMaxRetries,
+		InitialInterval: cnf.RetryInitialInterval.Duration,
+		Multiplier:      2,
+		MaxInterval:     cnf.RetryMaxInterval.Duration,
+		MaxElapsedTime:  cnf.RetryMaxElapsedTime.Duration,
+		Breaker:         retry.NewBreaker(cnf.BreakerThreshold, cnf.BreakerCooldown.Duration),
+	}))
+
+	if cnf.Stream {
+		options = append(options, agent.WithStreaming())
+	}
+
+	if cnf.PartialSuccess {
+		options = append(options, agent.WithPartialSuccess())
+	}
+
+	if cnf.Aggregate || cnf.SkipUnchanged || cnf.ChangeThreshold > 0 {
+		options = append(options, agent.WithAggregator(services.NewAggregator(services.AggregatorConfig{
+			Derived:          cnf.Aggregate,
+			SkipUnchanged:    cnf.SkipUnchanged,
+			ChangeThreshold:  cnf.ChangeThreshold,
+			MinEarlyInterval: cnf.EarlyReportInterval.Duration,
+			ChangeIgnore:     cnf.ChangeIgnore,
+		})))
 	}
 
 	if cnf.Key != "" {
@@ -44,8 +123,6 @@ func main() {
 		options = append(options, agent.WithHasher(hasher))
 	}
 	newAgent := agent.NewAgent(cnf, services.NewMetricsCollector(), options...)
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
 	newAgent.Run(ctx)
 }
 
@@ -2,27 +2,40 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 
+	"github.com/shadyziedan/metrica/internal/agent/agent"
+	agentconfig "github.com/shadyziedan/metrica/internal/agent/config"
+	"github.com/shadyziedan/metrica/internal/compression"
 	"github.com/shadyziedan/metrica/internal/models"
 	"github.com/shadyziedan/metrica/internal/security"
+	"github.com/shadyziedan/metrica/internal/server/auth"
 	"github.com/shadyziedan/metrica/internal/server/config"
+	"github.com/shadyziedan/metrica/internal/server/exporter"
+	"github.com/shadyziedan/metrica/internal/server/federation"
 	"github.com/shadyziedan/metrica/internal/server/handlers"
 	"github.com/shadyziedan/metrica/internal/server/logger"
 	"github.com/shadyziedan/metrica/internal/server/middleware"
+	"github.com/shadyziedan/metrica/internal/server/quota"
 	"github.com/shadyziedan/metrica/internal/server/server"
 	"github.com/shadyziedan/metrica/internal/server/services"
 	"github.com/shadyziedan/metrica/internal/server/storage"
+	"github.com/shadyziedan/metrica/internal/server/storage/boltdb"
 	"github.com/shadyziedan/metrica/internal/server/storage/postgres"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
 type metricsRepository interface {
@@ -31,6 +44,7 @@ type metricsRepository interface {
 	FindOrCreate(ctx context.Context, name string, mType string) (*models.Metric, error)
 	FindAll(ctx context.Context) ([]*models.Metric, error)
 	FindAllByName(ctx context.Context, names []string) ([]*models.Metric, error)
+	Count(ctx context.Context) (int, error)
 	UpdateCounter(ctx context.Context, name string, delta int64) error
 	UpdateGauge(ctx context.Context, name string, value float64) error
 	Attach(observer storage.MetricsObserver)
@@ -41,6 +55,9 @@ type hasher interface {
 	Hash([]byte) (string, error)
 }
 
+// keyReloadInterval is how often the key files are checked for changes.
+const keyReloadInterval = 10 * time.Second
+
 var (
 	BuildVersion string
 	BuildDate    string
@@ -54,43 +71,114 @@ func main() {
 		panic(err)
 	}
 
+	// subcommands are given before the flags: metrica-server migrate -d <dsn> up
+	var subcommand string
+	if len(os.Args) > 1 && (os.Args[1] == "migrate" || os.Args[1] == "token") {
+		subcommand = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	cnf := config.ParseConfig()
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer stop()
 
+	switch subcommand {
+	case "migrate":
+		if err = runMigrate(ctx, cnf, flag.Args()); err != nil {
+			logger.Log.Fatal("migration failed", zap.Error(err))
+		}
+		return
+	case "token":
+		if err = runToken(ctx, cnf, flag.Args()); err != nil {
+			logger.Log.Fatal("token command failed", zap.Error(err))
+		}
+		return
+	}
+
+	if cnf.TLSClientCA != "" && cnf.TLSCert == "" {
+		// the client certificates can only be verified over TLS, serving plain HTTP would silently skip the check
+		logger.Log.Fatal("tls client ca is set without the server certificate, set -tls-cert and -tls-key")
+	}
+	if cnf.ReplayWindow.Duration > 0 && cnf.Key == "" {
+		// only the signature covers the request timestamp and nonce
+		logger.Log.Fatal("replay window is set without the signing key, set -k")
+	}
+
 	conn, err := pgxpool.New(ctx, cnf.DatabaseDsn)
 	if err != nil {
 		logger.Log.Error("Unable to create connection pool", zap.Error(err))
 	} else {
 		defer conn.Close()
 	}
-	var appStorage metricsRepository
-
-	if conn != nil {
-		appStorage, err = postgres.NewDBStorage(conn)
-		if err != nil {
-			logger.Log.Error("unable to initialize db", zap.Error(err))
-			appStorage = storage.NewMemStorage()
-		}
-	} else {
-		appStorage = storage.NewMemStorage()
-	}
+	appStorage, closeStorage := newStorage(ctx, cnf, conn)
+	defer closeStorage()
 
 	fileStorageServiceConfig := services.FileStorageServiceConfig{
 		FileStoragePath: cnf.FileStoragePath,
 		StoreInterval:   cnf.StoreInterval.Duration,
 		Restore:         cnf.Restore,
+		CompactInterval: cnf.CompactInterval.Duration,
 	}
 
-	fileStorageService := services.NewFileStorageService(appStorage, fileStorageServiceConfig)
-
 	wg := &sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(1)
 
-	go func() {
-		defer wg.Done()
-		fileStorageService.Run(ctx)
-	}()
+	// The services are started one by one before the server accepts requests: the repository is restored first,
+	// then the observers are attached, so that the restored metrics aren't taken for updates.
+	// postgres and bolt persist the metrics by themselves: a file snapshot would only duplicate them,
+	// and restoring a stale local file would roll back the metrics shared by every server
+	if _, ok := appStorage.(*storage.MemStorage); !ok {
+		logger.Log.Info("metrics are persisted by the storage, file storage is disabled")
+	} else {
+		fileStorageService := services.NewFileStorageService(appStorage, fileStorageServiceConfig)
+		fileStorageService.Start(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fileStorageService.Run(ctx)
+		}()
+	}
+
+	if cnf.OTLPEndpoint != "" {
+		otlpExporter := newExporter(cnf, appStorage)
+		otlpExporter.Start()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			otlpExporter.Run(ctx)
+		}()
+	}
+
+	if cnf.ForwardAddress != "" {
+		forwarder := newForwarder(cnf, appStorage)
+		forwarder.Start(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwarder.Run(ctx)
+		}()
+	}
+
+	if dbStorage, ok := appStorage.(*postgres.DBStorage); ok {
+		partitionManager := postgres.NewPartitionManager(conn, cnf.SampleRetention.Duration)
+		if err = partitionManager.EnsurePartitions(ctx); err != nil {
+			logger.Log.Error("unable to create metric samples partitions", zap.Error(err))
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			partitionManager.Run(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			dbStorage.RunHealthChecks(ctx)
+		}()
+	}
+
+	compressionLevel, err := compression.ParseLevel(cnf.CompressionLevel)
+	if err != nil {
+		logger.Log.Fatal("invalid compression level", zap.Error(err))
+	}
 
 	var hasherimpl hasher
 	if cnf.Key != "" {
@@ -98,15 +186,29 @@ func main() {
 	}
 	middlewares := []func(http.Handler) http.Handler{
 		middleware.RequestLogger,
+		middleware.ClientIdentity,
+		newAuthorization(cnf, appStorage, conn),
+		newRateLimit(cnf),
+		middleware.Validation(newValidator(cnf, appStorage)),
 		middleware.HashChecker(hasherimpl),
-		middleware.Compress,
+		middleware.ReplayProtection(cnf.ReplayWindow.Duration),
+		middleware.CompressLevel(compressionLevel),
 	}
 	if cnf.CryptoKey != "" {
-		encryptionMiddleWare, encryptionErr := middleware.NewEncryptionFromFile(cnf.CryptoKey)
+		keyPaths := append([]string{cnf.CryptoKey}, cnf.ExtraCryptoKeys...)
+		encryptionMiddleWare, encryptionErr := middleware.NewEncryptionFromFile(keyPaths...)
 		if encryptionErr != nil {
-			logger.Log.Error("failed to create encryption middleware", zap.Error(err))
+			logger.Log.Fatal("failed to create encryption middleware", zap.Error(encryptionErr))
 		}
+		logger.Log.Info("encryption keys loaded", zap.Strings("key_ids", encryptionMiddleWare.KeyIDs()))
 		middlewares = append(middlewares, encryptionMiddleWare.MiddleWare)
+		go security.WatchFiles(ctx, keyReloadInterval, func() {
+			if reloadErr := encryptionMiddleWare.Reload(); reloadErr != nil {
+				logger.Log.Error("encryption keys are not reloaded", zap.Error(reloadErr))
+				return
+			}
+			logger.Log.Info("encryption keys reloaded", zap.Strings("key_ids", encryptionMiddleWare.KeyIDs()))
+		}, keyPaths...)
 	}
 
 	router := handlers.NewRouter(
@@ -117,9 +219,19 @@ func main() {
 
 	router.Handle(`/debug/pprof/*`, http.DefaultServeMux)
 
+	var serverOptions []server.Option
+	if cnf.TLSCert != "" {
+		tlsConfig, tlsErr := security.NewServerTLSConfig(cnf.TLSCert, cnf.TLSKey, cnf.TLSClientCA)
+		if tlsErr != nil {
+			logger.Log.Fatal("failed to load tls configuration", zap.Error(tlsErr))
+		}
+		serverOptions = append(serverOptions, server.WithTLSConfig(tlsConfig))
+	}
+
 	srv := server.NewWebServer(
 		cnf.Address,
 		router,
+		serverOptions...,
 	)
 
 	go func() {
@@ -131,6 +243,171 @@ func main() {
 	wg.Wait()
 }
 
+// newStorage picks the metrics repository: postgres when a connection is available,
+// then the embedded bolt database when a path is configured, and the in-memory storage otherwise.
+// The returned function releases the resources held by the repository.
+func newStorage(ctx context.Context, cnf config.Config, conn *pgxpool.Pool) (metricsRepository, func()) {
+	if conn != nil {
+		var replicas []*pgxpool.Pool
+		closeReplicas := func() {
+			for _, replica := range replicas {
+				replica.Close()
+			}
+		}
+		var options []postgres.Option
+		for _, dsn := range cnf.DatabaseReplicaDsns {
+			replica, err := pgxpool.New(ctx, dsn)
+			if err != nil {
+				logger.Log.Error("Unable to create replica connection pool", zap.Error(err))
+				continue
+			}
+			replicas = append(replicas, replica)
+			options = append(options, postgres.WithReplicas(replica))
+		}
+		dbStorage, err := postgres.NewDBStorage(conn, options...)
+		if err == nil {
+			return dbStorage, closeReplicas
+		}
+		closeReplicas()
+		logger.Log.Error("unable to initialize db", zap.Error(err))
+	}
+	if cnf.BoltPath != "" {
+		boltStorage, err := boltdb.NewBoltStorage(cnf.BoltPath)
+		if err == nil {
+			return boltStorage, func() {
+				if err := boltStorage.Close(); err != nil {
+					logger.Log.Error("failed to close bolt storage", zap.Error(err))
+				}
+			}
+		}
+		logger.Log.Error("unable to initialize bolt storage", zap.Error(err))
+	}
+	return storage.NewMemStorage(), func() {}
+}
+
+// newAuthorization creates the bearer token authorization middleware. The tokens are taken from the configuration
+// and, when the metrics are stored in postgres, from the database. Authorization is enabled when it is required
+// by the configuration or when static tokens are configured.
+func newAuthorization(cnf config.Config, appStorage metricsRepository, conn *pgxpool.Pool) func(http.Handler) http.Handler {
+	if !cnf.RequireAuth && len(cnf.APITokens) == 0 {
+		return middleware.Authorization(nil)
+	}
+	var static []auth.Token
+	for _, value := range cnf.APITokens {
+		token, err := auth.ParseStaticToken(value)
+		if err != nil {
+			logger.Log.Fatal("invalid api token", zap.Error(err))
+		}
+		static = append(static, token)
+	}
+	if _, ok := appStorage.(*postgres.DBStorage); ok {
+		return middleware.Authorization(auth.NewAuthenticator(static, postgres.NewTokenStorage(conn)))
+	}
+	return middleware.Authorization(auth.NewAuthenticator(static))
+}
+
+// newRateLimit creates the per-client rate limiting middleware, it is disabled when no limits are configured.
+func newRateLimit(cnf config.Config) func(http.Handler) http.Handler {
+	limits := quota.Limits{
+		RequestsPerSecond: cnf.RequestsPerSecond,
+		RequestBurst:      cnf.RequestBurst,
+		MetricsPerSecond:  cnf.MetricsPerSecond,
+		MetricsBurst:      cnf.MetricsBurst,
+		MaxMetricNames:    cnf.MaxMetricNames,
+		IdleTimeout:       cnf.ClientIdleTimeout.Duration,
+	}
+	if limits.RequestsPerSecond <= 0 && limits.MetricsPerSecond <= 0 && limits.MaxMetricNames <= 0 {
+		return middleware.RateLimit(nil)
+	}
+	return middleware.RateLimit(quota.NewLimiter(limits))
+}
+
+// newExporter creates the exporter of the metrics to the OpenTelemetry collector.
+func newExporter(cnf config.Config, appStorage metricsRepository) *exporter.Exporter {
+	mode, err := exporter.ParseMode(cnf.OTLPMode)
+	if err != nil {
+		logger.Log.Fatal("invalid otlp export mode", zap.Error(err))
+	}
+	headers := make(map[string]string, len(cnf.OTLPHeaders))
+	for _, header := range cnf.OTLPHeaders {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok {
+			logger.Log.Fatal("invalid otlp header", zap.String("header", header))
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return exporter.NewExporter(appStorage, exporter.Config{
+		Endpoint:    cnf.OTLPEndpoint,
+		Mode:        mode,
+		Interval:    cnf.OTLPInterval.Duration,
+		BatchSize:   cnf.OTLPBatchSize,
+		QueueSize:   cnf.OTLPQueueSize,
+		Timeout:     cnf.OTLPTimeout.Duration,
+		Headers:     headers,
+		ServiceName: cnf.OTLPServiceName,
+	})
+}
+
+// newForwarder creates the forwarder of the updates to the upstream server. The updates are sent by an agent,
+// so they are signed and encrypted like the agents' metrics.
+func newForwarder(cnf config.Config, appStorage metricsRepository) *federation.Forwarder {
+	mode, err := federation.ParseMode(cnf.ForwardMode)
+	if err != nil {
+		logger.Log.Fatal("invalid forward mode", zap.Error(err))
+	}
+	naming, err := federation.ParseNaming(cnf.EdgeNaming)
+	if err != nil {
+		logger.Log.Fatal("invalid edge naming", zap.Error(err))
+	}
+	var options []agent.Option
+	if cnf.ForwardKey != "" {
+		options = append(options, agent.WithHasher(security.NewDefaultHasher(cnf.ForwardKey)))
+	}
+	if cnf.ForwardCryptoKey != "" {
+		encryptor, encryptorErr := security.NewDefaultEncryptorFromFile(cnf.ForwardCryptoKey, "")
+		if encryptorErr != nil {
+			logger.Log.Fatal("failed to load forward encryption key", zap.Error(encryptorErr))
+		}
+		options = append(options, agent.WithEncryptor(encryptor))
+	}
+	if cnf.ForwardToken != "" {
+		options = append(options, agent.WithToken(cnf.ForwardToken))
+	}
+	upstream := agent.NewAgent(agentconfig.Config{Address: cnf.ForwardAddress}, nil, options...)
+	forwarder, err := federation.NewForwarder(appStorage, upstream, federation.Config{
+		Mode:           mode,
+		Interval:       cnf.ForwardInterval.Duration,
+		BatchSize:      cnf.ForwardBatchSize,
+		BufferDir:      cnf.ForwardBufferDir,
+		MaxBufferBytes: cnf.ForwardMaxBufferBytes,
+		EdgeName:       cnf.EdgeName,
+		Naming:         naming,
+	})
+	if err != nil {
+		logger.Log.Fatal("failed to create forwarder", zap.Error(err))
+	}
+	return forwarder
+}
+
+// newValidator creates the input validator from the configured limits.
+func newValidator(cnf config.Config, repository metricsRepository) *validation.Validator {
+	limits := validation.Limits{
+		MaxNameLength:  cnf.MaxNameLength,
+		MaxBatchSize:   cnf.MaxBatchSize,
+		MaxBodyBytes:   cnf.MaxBodyBytes,
+		MaxStreamBytes: cnf.MaxStreamBytes,
+		MaxSeries:      cnf.MaxSeries,
+	}
+	if cnf.NamePattern != "" {
+		pattern, err := regexp.Compile(cnf.NamePattern)
+		if err != nil {
+			logger.Log.Fatal("invalid metric name pattern", zap.Error(err))
+		}
+		limits.NamePattern = pattern
+	}
+	return validation.NewValidator(limits, repository)
+}
+
 func showBuildInfo() {
 	if BuildVersion != "" {
 		fmt.Println("Build version: ", BuildVersion)
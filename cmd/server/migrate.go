@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/shadyziedan/metrica/internal/server/config"
+	"github.com/shadyziedan/metrica/internal/server/storage/postgres"
+)
+
+const migrateUsage = "usage: metrica-server migrate [flags] [up | down [steps] | status]"
+
+// runMigrate handles the migrate subcommand: it applies, rolls back or lists the schema migrations.
+func runMigrate(ctx context.Context, cnf config.Config, args []string) error {
+	if cnf.DatabaseDsn == "" {
+		return errors.New("database dsn is required to run migrations")
+	}
+	conn, err := pgxpool.New(ctx, cnf.DatabaseDsn)
+	if err != nil {
+		return fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	defer conn.Close()
+
+	migrator, err := postgres.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q\n%s", args[1], migrateUsage)
+			}
+		}
+		return migrator.Down(ctx, steps)
+	case "status":
+		applied, err := migrator.Applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrator.Migrations() {
+			state := "pending"
+			if slices.Contains(applied, migration.Version) {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%s\t%s\n", migration.Version, migration.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", command, migrateUsage)
+	}
+}
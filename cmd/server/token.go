@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/shadyziedan/metrica/internal/server/auth"
+	"github.com/shadyziedan/metrica/internal/server/config"
+	"github.com/shadyziedan/metrica/internal/server/storage/postgres"
+)
+
+const tokenUsage = "usage: metrica-server token [flags] [create <name> <scopes> | list | revoke <name>]"
+
+// runToken handles the token subcommand: it creates, lists or revokes the API tokens stored in the database.
+func runToken(ctx context.Context, cnf config.Config, args []string) error {
+	if cnf.DatabaseDsn == "" {
+		return errors.New("database dsn is required to manage tokens")
+	}
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+	conn, err := pgxpool.New(ctx, cnf.DatabaseDsn)
+	if err != nil {
+		return fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	defer conn.Close()
+
+	migrator, err := postgres.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+	if err = migrator.Up(ctx); err != nil {
+		return err
+	}
+	tokens := postgres.NewTokenStorage(conn)
+
+	switch args[0] {
+	case "create":
+		if len(args) != 3 {
+			return errors.New(tokenUsage)
+		}
+		scopes, err := auth.ParseScopes(args[2])
+		if err != nil {
+			return err
+		}
+		secret, err := auth.GenerateToken()
+		if err != nil {
+			return err
+		}
+		token := auth.Token{Name: args[1], Hash: auth.HashToken(secret), Scopes: scopes}
+		if err = tokens.Create(ctx, token); err != nil {
+			return err
+		}
+		// the secret can't be recovered from the database, so it is shown only once
+		fmt.Println(secret)
+		return nil
+	case "list":
+		list, err := tokens.FindAll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, token := range list {
+			fmt.Printf("%s\t%s\n", token.Name, auth.FormatScopes(token.Scopes))
+		}
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(tokenUsage)
+		}
+		return tokens.Delete(ctx, args[1])
+	default:
+		return fmt.Errorf("unknown token command %q\n%s", args[0], tokenUsage)
+	}
+}
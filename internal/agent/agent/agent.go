@@ -4,14 +4,18 @@ package agent
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/shadyziedan/metrica/internal/agent/config"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,8 +23,12 @@ import (
 
 	"github.com/go-resty/resty/v2"
 	"github.com/shadyziedan/metrica/internal/agent/logger"
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/codec"
+	"github.com/shadyziedan/metrica/internal/compression"
 	"github.com/shadyziedan/metrica/internal/models"
 	"github.com/shadyziedan/metrica/internal/retry"
+	"github.com/shadyziedan/metrica/internal/security"
 
 	"github.com/shadyziedan/metrica/internal/agent/services"
 )
@@ -34,7 +42,17 @@ type Agent struct {
 	RateLimit        int
 	hasher           hasher
 	encryptor        encryptor
+	encryptResponses bool
+	partialSuccess   bool
+	retryPolicy      retry.Policy
+	secure           bool
+	compression      string
+	compressionLevel compression.Level
+	stream           bool
+	codec            codec.Codec
+	endpoints        *endpointSet
 	metricsCollector metricsCollector
+	aggregator       aggregator
 }
 
 type hasher interface {
@@ -42,8 +60,8 @@ type hasher interface {
 }
 
 type encryptor interface {
-	Encrypt(data []byte) ([]byte, error)
-	GetEncryptedKey() (string, error)
+	Encrypt(data []byte) ([]byte, security.EncryptedKey, error)
+	Decrypt(data []byte, key security.EncryptedKey) ([]byte, error)
 }
 
 type Option = func(agent *Agent)
@@ -53,7 +71,14 @@ type metricsCollector interface {
 	IncreasePollCount()
 }
 
+type aggregator interface {
+	Add(metrics *services.AgentMetrics) bool
+	Flush() *services.AgentMetrics
+}
+
 // NewAgent creates a new instance of the Agent struct.
+// The metrics are sent to cnf.Address, which is also the client base URL, and to cnf.ExtraAddresses
+// according to cnf.EndpointStrategy; an unknown strategy falls back to failover.
 func NewAgent(cnf config.Config, mc metricsCollector, options ...Option) *Agent {
 	client := resty.New()
 	client.BaseURL = cnf.Address
@@ -62,11 +87,33 @@ func NewAgent(cnf config.Config, mc metricsCollector, options ...Option) *Agent
 		PollInterval:     cnf.PollInterval.Duration,
 		ReportInterval:   cnf.ReportInterval.Duration,
 		RateLimit:        cnf.RateLimit,
+		retryPolicy:      retry.DefaultPolicy(),
+		compressionLevel: compression.LevelBest,
+		codec:            codec.JSON,
 		metricsCollector: mc,
 	}
 	for _, option := range options {
 		option(a)
 	}
+	if a.retryPolicy.IsRetryable == nil {
+		a.retryPolicy.IsRetryable = isRetryable
+	}
+	strategy, err := ParseStrategy(cnf.EndpointStrategy)
+	if err != nil {
+		logger.Log.Warn("Falling back to the failover strategy", zap.Error(err))
+		strategy = StrategyFailover
+	}
+	scheme := "http"
+	if a.secure {
+		scheme = "https"
+	}
+	a.endpoints = newEndpointSet(strategy, scheme, append([]string{a.Client.BaseURL}, cnf.ExtraAddresses...)...)
+	if strategy == StrategyMirror {
+		// a failing endpoint must not stop the sends to the others
+		for _, e := range a.endpoints.endpoints {
+			e.breaker = a.retryPolicy.Breaker.Clone()
+		}
+	}
 	return a
 }
 
@@ -82,6 +129,83 @@ func WithEncryptor(encryptor encryptor) Option {
 	}
 }
 
+// WithToken makes the agent authenticate to the server with the bearer token.
+func WithToken(token string) Option {
+	return func(a *Agent) {
+		a.Client.SetAuthToken(token)
+	}
+}
+
+// WithResponseEncryption asks the server to encrypt its responses with the session key of the request.
+// It has effect only along with an encryptor.
+func WithResponseEncryption() Option {
+	return func(a *Agent) {
+		a.encryptResponses = true
+	}
+}
+
+// WithPartialSuccess asks the server to apply the valid metrics of a batch even when some of them are rejected.
+// Only the rejected metrics the server marks as retryable are sent again, the others are dropped.
+func WithPartialSuccess() Option {
+	return func(a *Agent) {
+		a.partialSuccess = true
+	}
+}
+
+// WithRetryPolicy sets the policy of retrying the failed sends, retry.DefaultPolicy is used by default.
+// The policy's IsRetryable defaults to retrying the network errors and the errors the server marks as retryable.
+func WithRetryPolicy(policy retry.Policy) Option {
+	return func(a *Agent) {
+		a.retryPolicy = policy
+	}
+}
+
+// WithCompression sets the encoding and the level the metrics are compressed with.
+// The empty encoding, used by default, picks the most preferred encoding the server advertises, gzip until it does.
+// The best compression level is used by default.
+func WithCompression(encoding string, level compression.Level) Option {
+	return func(a *Agent) {
+		a.compression = encoding
+		a.compressionLevel = level
+	}
+}
+
+// WithCodec sets the format the metrics are sent in, JSON by default. The responses are asked for in the same format.
+// The streamed metrics are always sent as newline-delimited JSON.
+func WithCodec(c codec.Codec) Option {
+	return func(a *Agent) {
+		a.codec = c
+	}
+}
+
+// WithStreaming makes the agent send the metrics to the streaming endpoint, which the server applies incrementally.
+// The partial-success mode doesn't apply: the server skips the invalid metrics of a stream anyway.
+func WithStreaming() Option {
+	return func(a *Agent) {
+		a.stream = true
+	}
+}
+
+// WithTLSConfig makes the agent connect to the server over TLS using the given configuration.
+// The server address is given the https scheme unless it already has one.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(a *Agent) {
+		a.Client.SetTLSClientConfig(cfg)
+		a.secure = true
+		if !strings.Contains(a.Client.BaseURL, "://") {
+			a.Client.BaseURL = "https://" + a.Client.BaseURL
+		}
+	}
+}
+
+// WithAggregator makes the agent collect the metrics at every poll and report their aggregates over the report window.
+// A sharp change of a gauge reported by the aggregator triggers an early report.
+func WithAggregator(aggregator aggregator) Option {
+	return func(a *Agent) {
+		a.aggregator = aggregator
+	}
+}
+
 // Run starts the metric collection and reporting process for the agent.
 func (a *Agent) Run(ctx context.Context) {
 	pollChan := time.NewTicker(a.PollInterval)
@@ -106,9 +230,12 @@ func (a *Agent) Run(ctx context.Context) {
 		select {
 		case <-pollChan.C:
 			a.metricsCollector.IncreasePollCount()
+			if a.aggregator != nil && a.aggregator.Add(a.metricsCollector.Collect()) {
+				metricsSendCh <- a.aggregator.Flush()
+				reportChan.Reset(a.ReportInterval)
+			}
 		case <-reportChan.C:
-			metrics := a.metricsCollector.Collect()
-			metricsSendCh <- metrics
+			metricsSendCh <- a.report()
 		case <-ctx.Done():
 			wg.Wait()
 			return
@@ -116,6 +243,16 @@ func (a *Agent) Run(ctx context.Context) {
 	}
 }
 
+// report returns the metrics of the report window.
+func (a *Agent) report() *services.AgentMetrics {
+	metrics := a.metricsCollector.Collect()
+	if a.aggregator == nil {
+		return metrics
+	}
+	a.aggregator.Add(metrics)
+	return a.aggregator.Flush()
+}
+
 func (a *Agent) sendMetricsWorker(ctx context.Context, metricsCh <-chan *services.AgentMetrics) {
 	for {
 		select {
@@ -125,20 +262,69 @@ func (a *Agent) sendMetricsWorker(ctx context.Context, metricsCh <-chan *service
 			if !ok {
 				return
 			}
-			err := retry.WithBackoff(ctx, 3, func(err error) bool {
-				var e net.Error
-				return errors.As(err, &e)
-			}, func() error {
-				return a.sendMetricsToServer(ctx, metrics)
-			})
-			if err != nil {
+			if err := a.deliver(ctx, convertToRequestModels(metrics)); err != nil {
 				logger.Log.Error("Error sending metric", zap.Error(err))
 			}
 		}
 	}
 }
 
+// Send sends the metrics to the servers like a report of the agent: with retries, according to the endpoint strategy.
+// It lets the metrics collected elsewhere, e.g. by an edge server, be sent with the agent protocol.
+func (a *Agent) Send(ctx context.Context, metrics []*models.Metrics) error {
+	return a.deliver(ctx, metrics)
+}
+
+// deliver sends the metrics with retries. In the mirror mode every endpoint is retried on its own,
+// so that a failing endpoint doesn't make the others receive the metrics twice, and has a circuit breaker
+// of its own; an unhealthy endpoint gets a single attempt.
+func (a *Agent) deliver(ctx context.Context, metrics []*models.Metrics) error {
+	if a.endpoints.strategy != StrategyMirror {
+		return a.retry(ctx, a.retryPolicy, metrics, a.sendMetrics)
+	}
+	var wg sync.WaitGroup
+	now := a.endpoints.now()
+	errs := make([]error, len(a.endpoints.endpoints))
+	for i, e := range a.endpoints.endpoints {
+		policy := a.retryPolicy
+		policy.Breaker = e.breaker
+		if !e.healthy(now) {
+			policy.MaxRetries = 0
+		}
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			err := a.retry(ctx, policy, metrics, func(ctx context.Context, metrics []*models.Metrics) ([]*models.Metrics, error) {
+				failed, err := a.sendMetricsTo(ctx, e, metrics)
+				e.record(!isEndpointFailure(metrics, failed, err), a.endpoints.now())
+				return failed, err
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("endpoint %s: %w", e.url, err)
+			}
+		}(i, e)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// retry sends the metrics according to the policy, only the metrics that failed are sent again.
+func (a *Agent) retry(ctx context.Context, policy retry.Policy, metrics []*models.Metrics,
+	send func(ctx context.Context, metrics []*models.Metrics) ([]*models.Metrics, error)) error {
+	pending := metrics
+	return policy.Do(ctx, func() error {
+		var err error
+		pending, err = send(ctx, pending)
+		return err
+	})
+}
+
 func (a *Agent) sendMetricsToServer(ctx context.Context, metrics *services.AgentMetrics) error {
+	_, err := a.sendMetrics(ctx, convertToRequestModels(metrics))
+	return err
+}
+
+func convertToRequestModels(metrics *services.AgentMetrics) []*models.Metrics {
 	var requestModels []*models.Metrics
 	for _, metric := range metrics.Gauge.GetAll() {
 		requestModels = append(requestModels, &models.Metrics{
@@ -155,78 +341,344 @@ func (a *Agent) sendMetricsToServer(ctx context.Context, metrics *services.Agent
 			Delta: &delta,
 		})
 	}
-	return a.sendMetrics(ctx, requestModels)
+	return requestModels
 }
 
-func (a *Agent) sendMetrics(ctx context.Context, metrics []*models.Metrics) error {
-	body, err := convertMetricsToJSON(metrics)
-	if err != nil {
-		return fmt.Errorf("couldn't convert metrics to json string: %s", err)
+// sendMetrics sends the metrics to the endpoints in the strategy order until one of them is reachable,
+// and returns the metrics that should be sent again along with the error.
+func (a *Agent) sendMetrics(ctx context.Context, metrics []*models.Metrics) ([]*models.Metrics, error) {
+	endpoints := a.endpoints.order()
+	if len(endpoints) == 0 {
+		return nil, errors.New("no server endpoints configured")
+	}
+	var failed []*models.Metrics
+	var err error
+	for _, e := range endpoints {
+		failed, err = a.sendMetricsTo(ctx, e, metrics)
+		endpointFailure := isEndpointFailure(metrics, failed, err)
+		e.record(!endpointFailure, a.endpoints.now())
+		if !endpointFailure {
+			return failed, err
+		}
+		logger.Log.Warn("Error sending metrics to the endpoint", zap.String("endpoint", e.url), zap.Error(err))
 	}
+	return failed, err
+}
+
+// isEndpointFailure reports whether the send failed as a whole for a reason that another endpoint may not have.
+// A rejected request or a partially applied batch is not a failure of the endpoint.
+func isEndpointFailure(metrics, failed []*models.Metrics, err error) bool {
+	return err != nil && len(failed) == len(metrics) && isRetryable(err)
+}
 
-	req := a.Client.R().SetContext(ctx).
-		SetHeader("Content-Encoding", "gzip").
-		SetHeader("Content-Type", "application/json")
+// sendMetricsTo sends the metrics to the endpoint and returns the ones that should be sent again along with the error.
+// A request rejected for its content encoding is sent once more if the server advertised another encoding.
+func (a *Agent) sendMetricsTo(ctx context.Context, e *endpoint, metrics []*models.Metrics) ([]*models.Metrics, error) {
+	encoding := a.contentEncoding(e)
+	failed, err := a.postMetrics(ctx, e, encoding, metrics)
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) && apiErr.Code == apierror.CodeUnsupportedEncoding {
+		if negotiated := a.contentEncoding(e); negotiated != encoding {
+			return a.postMetrics(ctx, e, negotiated, metrics)
+		}
+	}
+	return failed, err
+}
+
+// contentEncoding returns the encoding of the requests to the endpoint: the configured one or the negotiated one.
+func (a *Agent) contentEncoding(e *endpoint) string {
+	if a.compression != "" {
+		return a.compression
+	}
+	return e.contentEncoding()
+}
+
+// postMetrics posts the metrics compressed with the encoding to the endpoint.
+func (a *Agent) postMetrics(ctx context.Context, e *endpoint, encoding string, metrics []*models.Metrics) ([]*models.Metrics, error) {
+	if a.stream {
+		return a.postStream(ctx, e, encoding, metrics)
+	}
+	var buf bytes.Buffer
+	if err := a.codec.Encode(&buf, metrics); err != nil {
+		return nil, fmt.Errorf("couldn't encode metrics: %w", err)
+	}
+	body := buf.Bytes()
+
+	req := a.newRequest(ctx, encoding, a.codec.ContentType())
+	req.SetHeader("Accept", a.codec.ContentType())
+	if a.partialSuccess {
+		req.SetHeader(`X-Partial-Success`, "true")
+	}
 
 	// Encrypt the json body
+	var encryptedKey *security.EncryptedKey
+	var err error
 	if a.encryptor != nil {
-		encryptedKey, encryptionError := a.encryptor.GetEncryptedKey()
-		if encryptionError != nil {
-			return fmt.Errorf("error encrypting metrics data: %s", encryptionError)
+		body, encryptedKey, err = a.encrypt(req, body)
+		if err != nil {
+			return nil, err
 		}
-		req.SetHeader(`X-Encrypted-Key`, encryptedKey)
+	}
 
-		bodyEncrypted, encryptionError := a.encryptor.Encrypt(body)
-		if encryptionError != nil {
-			return fmt.Errorf("error encrypting metrics data: %s", encryptionError)
-		}
+	// Compress the data
+	bodyCompressed, err := compression.Compress(encoding, a.compressionLevel, body)
+	if err != nil {
+		return nil, err
+	}
 
-		body = []byte(base64.StdEncoding.EncodeToString(bodyEncrypted))
+	if err = a.sign(req, bodyCompressed); err != nil {
+		return nil, err
 	}
 
-	// Compress the data
-	bodyCompressed, err := compressBody(body)
+	res, err := req.SetBody(bodyCompressed).Post(e.url + "/updates/")
 	if err != nil {
-		return err
+		return metrics, fmt.Errorf("couldn't send metrics: %w", err)
+	}
+	a.negotiate(e, res)
+	responseBody, err := a.readResponse(res, encryptedKey)
+	if err != nil {
+		return metrics, err
 	}
+	if !a.partialSuccess {
+		return nil, nil
+	}
+	return a.failedMetrics(metrics, responseBody)
+}
 
-	if a.hasher != nil {
-		hashHeader, hashErr := a.hasher.Hash(bodyCompressed)
-		if hashErr != nil {
-			return hashErr
+// postStream posts the metrics to the streaming endpoint in the newline-delimited JSON format.
+// The metrics are encoded and compressed while they are sent, so the encoded batch is never held in memory;
+// only the compressed stream is buffered when it must be signed, and the whole stream when it must be encrypted.
+// When the server stops the stream, the metrics it didn't process are returned to be sent again.
+func (a *Agent) postStream(ctx context.Context, e *endpoint, encoding string, metrics []*models.Metrics) ([]*models.Metrics, error) {
+	req := a.newRequest(ctx, encoding, models.StreamContentType)
+	var encryptedKey *security.EncryptedKey
+	switch {
+	case a.encryptor != nil:
+		var buf bytes.Buffer
+		if err := writeStream(&buf, metrics); err != nil {
+			return nil, fmt.Errorf("couldn't encode metrics: %w", err)
+		}
+		body, key, err := a.encrypt(req, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey = key
+		bodyCompressed, err := compression.Compress(encoding, a.compressionLevel, body)
+		if err != nil {
+			return nil, err
+		}
+		if err = a.sign(req, bodyCompressed); err != nil {
+			return nil, err
 		}
-		req.SetHeader("HashSHA256", hashHeader)
+		req.SetBody(bodyCompressed)
+	case a.hasher != nil:
+		var buf bytes.Buffer
+		if err := a.compressStream(&buf, encoding, metrics); err != nil {
+			return nil, err
+		}
+		if err := a.sign(req, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		req.SetBody(buf.Bytes())
+	default:
+		if err := a.sign(req, nil); err != nil {
+			return nil, err
+		}
+		pr, pw := io.Pipe()
+		// closing the reader stops the encoding if the request fails before the whole stream is sent
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(a.compressStream(pw, encoding, metrics))
+		}()
+		req.SetBody(pr)
 	}
 
-	res, err := req.SetBody(bodyCompressed).Post("/updates/")
+	res, err := req.Post(e.url + "/updates/stream")
 	if err != nil {
-		return fmt.Errorf("couldn't send metrics: %w", err)
+		return metrics, fmt.Errorf("couldn't send metrics: %w", err)
 	}
-	if res.IsError() {
-		return fmt.Errorf("request failed with status %d: %s", res.StatusCode(), res.String())
+	a.negotiate(e, res)
+	responseBody, err := a.readResponse(res, encryptedKey)
+	if err != nil {
+		processed, parseErr := strconv.Atoi(res.Header().Get(`X-Processed`))
+		if parseErr != nil || processed < 0 || processed > len(metrics) {
+			processed = 0
+		}
+		return metrics[processed:], err
 	}
-	return nil
+	var response models.StreamResponse
+	if err = json.Unmarshal(responseBody, &response); err != nil {
+		return nil, fmt.Errorf("couldn't parse stream response: %w", err)
+	}
+	for _, apiErr := range response.Errors {
+		logger.Log.Warn("Metric rejected by the server", zap.String("metric", apiErr.MetricID), zap.Error(apiErr))
+	}
+	return nil, nil
 }
 
-func convertMetricsToJSON(m []*models.Metrics) ([]byte, error) {
-	jsonEncoded, err := json.Marshal(m)
+// newRequest creates a request sending a body of the content type compressed with the encoding.
+func (a *Agent) newRequest(ctx context.Context, encoding string, contentType string) *resty.Request {
+	// the response body is read raw, so that its signature can be verified before it is decompressed
+	return a.Client.R().SetContext(ctx).
+		SetDoNotParseResponse(true).
+		SetHeader("Accept-Encoding", compression.Header(compression.Supported)).
+		SetHeader("Content-Encoding", encoding).
+		SetHeader("Content-Type", contentType)
+}
+
+// encrypt encrypts the body and sets the encryption headers of the request.
+// It returns the base64-encoded encrypted body along with the session key.
+func (a *Agent) encrypt(req *resty.Request, body []byte) ([]byte, *security.EncryptedKey, error) {
+	bodyEncrypted, sessionKey, err := a.encryptor.Encrypt(body)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("error encrypting metrics data: %s", err)
 	}
-	return jsonEncoded, nil
+	req.SetHeader(`X-Encrypted-Key`, sessionKey.Key)
+	req.SetHeader(`X-Key-ID`, sessionKey.KeyID)
+	req.SetHeader(`X-Encryption-Scheme`, sessionKey.Scheme)
+	if a.encryptResponses {
+		req.SetHeader(`X-Encrypt-Response`, "true")
+	}
+	return []byte(base64.StdEncoding.EncodeToString(bodyEncrypted)), &sessionKey, nil
 }
-func compressBody(body []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	gzWriter, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+
+// sign sets the signature of the request along with the timestamp and nonce headers it covers,
+// if the agent has a hasher.
+func (a *Agent) sign(req *resty.Request, body []byte) error {
+	if a.hasher == nil {
+		return nil
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce, err := security.NewNonce()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	_, err = gzWriter.Write(body)
+	req.SetHeader("X-Timestamp", timestamp)
+	req.SetHeader("X-Nonce", nonce)
+	// the timestamp and nonce are signed along with the body, so the server can reject replayed requests
+	hashHeader, err := a.hasher.Hash(security.SignedPayload(timestamp, nonce, body))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err = gzWriter.Close(); err != nil {
-		return nil, err
+	req.SetHeader("HashSHA256", hashHeader)
+	return nil
+}
+
+// negotiate updates the encoding of the endpoint from the encodings its server advertises.
+func (a *Agent) negotiate(e *endpoint, res *resty.Response) {
+	if e.negotiate(res.Header().Get("Accept-Encoding")) && a.compression == "" {
+		logger.Log.Debug("Content encoding negotiated", zap.String("endpoint", e.url),
+			zap.String("encoding", e.contentEncoding()))
 	}
-	return buf.Bytes(), nil
+}
+
+// compressStream writes the metrics stream compressed with the encoding.
+func (a *Agent) compressStream(w io.Writer, encoding string, metrics []*models.Metrics) error {
+	zw, err := compression.NewWriter(encoding, w, a.compressionLevel)
+	if err != nil {
+		return err
+	}
+	if err = writeStream(zw, metrics); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// writeStream writes the metrics one per line.
+func writeStream(w io.Writer, metrics []*models.Metrics) error {
+	encoder := json.NewEncoder(w)
+	for _, metric := range metrics {
+		if err := encoder.Encode(metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failedMetrics reads the partial-success response and returns the rejected metrics worth sending again.
+// The metrics rejected for good are logged and dropped.
+func (a *Agent) failedMetrics(metrics []*models.Metrics, responseBody []byte) ([]*models.Metrics, error) {
+	var response models.BatchResponse
+	if err := a.codec.Decode(bytes.NewReader(responseBody), &response); err != nil {
+		return nil, fmt.Errorf("couldn't parse batch response: %w", err)
+	}
+	var retryMetrics []*models.Metrics
+	var retryErr error
+	for _, result := range response.Results {
+		if result.Error == nil || result.Index < 0 || result.Index >= len(metrics) {
+			continue
+		}
+		if !result.Error.Retryable {
+			logger.Log.Warn("Metric rejected by the server", zap.String("metric", result.ID), zap.Error(result.Error))
+			continue
+		}
+		retryMetrics = append(retryMetrics, metrics[result.Index])
+		if retryErr == nil {
+			result.Error.Status = result.Status
+			retryErr = result.Error
+		}
+	}
+	if len(retryMetrics) > 0 {
+		return retryMetrics, fmt.Errorf("%d of %d metrics failed: %w", len(retryMetrics), len(metrics), retryErr)
+	}
+	return nil, nil
+}
+
+// readResponse reads the response body, verifies its signature and decrypts it when it is encrypted.
+// A response to a successful request must be signed when the agent has a hasher.
+func (a *Agent) readResponse(res *resty.Response, encryptedKey *security.EncryptedKey) ([]byte, error) {
+	rawBody := res.RawBody()
+	defer rawBody.Close()
+	body, err := io.ReadAll(rawBody)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read response: %w", err)
+	}
+
+	if a.hasher != nil && !res.IsError() {
+		signature, hashErr := a.hasher.Hash(body)
+		if hashErr != nil {
+			return nil, hashErr
+		}
+		if !hmac.Equal([]byte(signature), []byte(res.Header().Get("HashSHA256"))) {
+			return nil, errors.New("response signature mismatch")
+		}
+	}
+
+	if encoding := strings.TrimSpace(res.Header().Get("Content-Encoding")); encoding != "" && len(body) > 0 {
+		body, err = compression.Decompress(encoding, body)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress response: %w", err)
+		}
+	}
+
+	if res.Header().Get(`X-Encrypted-Response`) != "" {
+		if encryptedKey == nil {
+			return nil, errors.New("unexpected encrypted response")
+		}
+		encryptedBody, decodeErr := base64.StdEncoding.DecodeString(string(body))
+		if decodeErr != nil {
+			return nil, fmt.Errorf("couldn't decode response: %w", decodeErr)
+		}
+		body, err = a.encryptor.Decrypt(encryptedBody, *encryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decrypt response: %w", err)
+		}
+	}
+
+	if res.IsError() {
+		apiErr := apierror.Parse(res.StatusCode(), body)
+		if delay, ok := retry.ParseRetryAfter(res.Header().Get("Retry-After"), time.Now()); ok {
+			return nil, retry.WithRetryAfter(apiErr, delay)
+		}
+		return nil, apiErr
+	}
+	return body, nil
+}
+
+// isRetryable reports whether sending the metrics again may succeed:
+// on network errors and on the errors the server marks as retryable.
+func isRetryable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || apierror.IsRetryable(err)
 }
@@ -2,7 +2,10 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
+	"fmt"
 	"github.com/shadyziedan/metrica/internal/agent/config"
 	"io"
 	"net/http"
@@ -12,9 +15,14 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 
 	"github.com/shadyziedan/metrica/internal/agent/services"
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/codec"
+	"github.com/shadyziedan/metrica/internal/compression"
 	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/security"
 	"github.com/shadyziedan/metrica/internal/server/middleware"
 )
 
@@ -114,27 +122,299 @@ func TestRun(t *testing.T) {
 
 // TestSendMetricsFailure tests the error handling in sendMetricsToServer
 func TestSendMetricsFailure(t *testing.T) {
-	// Set up a mock server that returns an error
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantCode      string
+		wantMessage   string
+		wantRetryable bool
+	}{
+		{
+			name:          "plain server error",
+			status:        http.StatusInternalServerError,
+			body:          "Internal Server Error",
+			wantCode:      apierror.CodeUnknown,
+			wantMessage:   "Internal Server Error",
+			wantRetryable: true,
+		},
+		{
+			name:          "error envelope",
+			status:        http.StatusBadRequest,
+			body:          `{"code":"invalid_metric_name","message":"metric name doesn't match","metric_id":"bad name","index":0,"retryable":false}`,
+			wantCode:      apierror.CodeInvalidMetricName,
+			wantMessage:   "metric name doesn't match",
+			wantRetryable: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Set up a mock server that returns an error
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			mc := new(MockMetricsCollector)
+			cnf := config.Config{
+				Address:        server.URL,
+				ReportInterval: config.Duration{Duration: time.Second * 5},
+				PollInterval:   config.Duration{Duration: time.Second * 10},
+				RateLimit:      2,
+			}
+			a := NewAgent(cnf, mc)
+
+			metrics := services.NewAgentMetrics()
+			metrics.Gauge.UpdateMetric("test_gauge", 123.45)
+			metrics.Counter.UpdateMetric("test_counter", 1)
+
+			err := a.sendMetricsToServer(context.Background(), metrics)
+			var apiErr *apierror.Error
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, tt.status, apiErr.Status)
+			assert.Equal(t, tt.wantCode, apiErr.Code)
+			assert.Equal(t, tt.wantMessage, apiErr.Message)
+			assert.Equal(t, tt.wantRetryable, isRetryable(err))
+		})
+	}
+}
+
+// TestSendMetricsPartialSuccess tests that only the retryable rejected metrics are sent again
+func TestSendMetricsPartialSuccess(t *testing.T) {
+	var partialHeader string
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, "Internal Server Error")
+		partialHeader = r.Header.Get("X-Partial-Success")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `{"results":[
+			{"index":0,"id":"Alloc","status":200,"metric":{"id":"Alloc","type":"gauge","value":1.5}},
+			{"index":1,"id":"PollCount","status":500,"error":{"code":"internal","message":"db is down","index":1,"retryable":true}},
+			{"index":2,"id":"bad name","status":400,"error":{"code":"invalid_metric_name","message":"bad","index":2,"retryable":false}}
+		]}`)
 	}))
 	defer server.Close()
 
-	mc := new(MockMetricsCollector)
+	cnf := config.Config{Address: server.URL, RateLimit: 1}
+	a := NewAgent(cnf, new(MockMetricsCollector), WithPartialSuccess())
+
+	value, delta := 1.5, int64(1)
+	metrics := []*models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "bad name", MType: "gauge", Value: &value},
+	}
+	failed, err := a.sendMetrics(context.Background(), metrics)
+
+	assert.Equal(t, "true", partialHeader)
+	require.Error(t, err)
+	assert.True(t, isRetryable(err))
+	assert.Equal(t, []*models.Metrics{metrics[1]}, failed)
+}
+
+// TestSendMetricsSignedEncryptedResponse tests the verification and decryption of the server response
+func TestSendMetricsSignedEncryptedResponse(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hasher := security.NewDefaultHasher("secret")
+
+	var responseEncrypted bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var receivedMetrics []*models.Metrics
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&receivedMetrics))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(receivedMetrics)
+	})
+	serverHandler := middleware.HashChecker(hasher)(middleware.Compress(middleware.NewEncryption(privateKey).MiddleWare(handler)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverHandler.ServeHTTP(w, r)
+		responseEncrypted = w.Header().Get("X-Encrypted-Response") != ""
+	}))
+	defer server.Close()
+
+	encryptor, err := security.NewDefaultEncryptor(&privateKey.PublicKey, security.SchemeRSAOAEP)
+	require.NoError(t, err)
 	cnf := config.Config{
 		Address:        server.URL,
 		ReportInterval: config.Duration{Duration: time.Second * 5},
 		PollInterval:   config.Duration{Duration: time.Second * 10},
-		RateLimit:      2,
+		RateLimit:      1,
 	}
-	a := NewAgent(cnf, mc)
+	a := NewAgent(cnf, new(MockMetricsCollector), WithHasher(hasher), WithEncryptor(encryptor), WithResponseEncryption())
 
 	metrics := services.NewAgentMetrics()
 	metrics.Gauge.UpdateMetric("test_gauge", 123.45)
-	metrics.Counter.UpdateMetric("test_counter", 1)
 
-	err := a.sendMetricsToServer(context.Background(), metrics)
-	assert.Error(t, err)
-	assert.Equal(t, "request failed with status 500: Internal Server Error", err.Error())
+	assert.NoError(t, a.sendMetricsToServer(context.Background(), metrics))
+	assert.True(t, responseEncrypted)
+
+	t.Run("response signed with another key", func(t *testing.T) {
+		a := NewAgent(cnf, new(MockMetricsCollector), WithHasher(security.NewDefaultHasher("other")), WithEncryptor(encryptor))
+		err := a.sendMetricsToServer(context.Background(), metrics)
+		assert.Error(t, err)
+	})
+}
+
+func TestSendMetricsEncryptedSigned(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	// the replay protection accepts the encrypted requests once the signature covers their timestamp and nonce
+	hasher := security.NewDefaultHasher("secret")
+	server := httptest.NewServer(middleware.HashChecker(hasher)(middleware.ReplayProtection(time.Minute)(
+		middleware.Compress(middleware.NewEncryption(privateKey).MiddleWare(handler)))))
+	defer server.Close()
+
+	encryptor, err := security.NewDefaultEncryptor(&privateKey.PublicKey, security.SchemeRSAOAEP)
+	require.NoError(t, err)
+	cnf := config.Config{Address: server.URL, RateLimit: 1}
+	a := NewAgent(cnf, new(MockMetricsCollector), WithEncryptor(encryptor), WithHasher(hasher))
+
+	metrics := services.NewAgentMetrics()
+	metrics.Gauge.UpdateMetric("test_gauge", 123.45)
+
+	assert.NoError(t, a.sendMetricsToServer(context.Background(), metrics))
+}
+
+func TestSendMetricsCompressionNegotiation(t *testing.T) {
+	value := 1.5
+	metrics := []*models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}
+
+	t.Run("advertised encoding", func(t *testing.T) {
+		var encodings []string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var received []*models.Metrics
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+			assert.Len(t, received, 1)
+			w.Write([]byte("ok"))
+		})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings = append(encodings, r.Header.Get("Content-Encoding"))
+			middleware.Compress(next).ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		a := NewAgent(config.Config{Address: server.URL, RateLimit: 1}, new(MockMetricsCollector),
+			WithCompression("", compression.LevelFastest))
+		for i := 0; i < 2; i++ {
+			_, err := a.sendMetrics(context.Background(), metrics)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, []string{compression.Gzip, compression.Zstd}, encodings)
+	})
+
+	t.Run("unsupported encoding is sent again", func(t *testing.T) {
+		var encodings []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings = append(encodings, r.Header.Get("Content-Encoding"))
+			w.Header().Set("Accept-Encoding", "snappy")
+			if r.Header.Get("Content-Encoding") != compression.Snappy {
+				apierror.Write(w, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedEncoding, "unsupported"))
+				return
+			}
+			body, err := io.ReadAll(compressionReader(t, r))
+			assert.NoError(t, err)
+			assert.Contains(t, string(body), "Alloc")
+		}))
+		defer server.Close()
+
+		a := NewAgent(config.Config{Address: server.URL, RateLimit: 1}, new(MockMetricsCollector))
+		_, err := a.sendMetrics(context.Background(), metrics)
+		require.NoError(t, err)
+		assert.Equal(t, []string{compression.Gzip, compression.Snappy}, encodings)
+	})
+}
+
+func compressionReader(t *testing.T, r *http.Request) io.Reader {
+	reader, err := compression.NewReader(r.Header.Get("Content-Encoding"), r.Body)
+	require.NoError(t, err)
+	return reader
+}
+
+func TestSendMetricsStream(t *testing.T) {
+	metrics := make([]*models.Metrics, 0, 5)
+	for i := 0; i < 5; i++ {
+		value := float64(i)
+		metrics = append(metrics, &models.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: "gauge", Value: &value})
+	}
+
+	t.Run("streamed", func(t *testing.T) {
+		var received []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/updates/stream", r.URL.Path)
+			assert.Equal(t, models.StreamContentType, r.Header.Get("Content-Type"))
+			decoder := json.NewDecoder(compressionReader(t, r))
+			for decoder.More() {
+				var metric models.Metrics
+				require.NoError(t, decoder.Decode(&metric))
+				received = append(received, metric.ID)
+			}
+			w.Write([]byte(`{"processed":5,"applied":5,"rejected":0}`))
+		}))
+		defer server.Close()
+
+		a := NewAgent(config.Config{Address: server.URL, RateLimit: 1}, new(MockMetricsCollector), WithStreaming())
+		failed, err := a.sendMetrics(context.Background(), metrics)
+		require.NoError(t, err)
+		assert.Empty(t, failed)
+		assert.Equal(t, []string{"Gauge0", "Gauge1", "Gauge2", "Gauge3", "Gauge4"}, received)
+	})
+
+	t.Run("stopped stream", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("X-Processed", "3")
+			apierror.Write(w, apierror.New(http.StatusServiceUnavailable, apierror.CodeUnavailable, "storage is down"))
+		}))
+		defer server.Close()
+
+		a := NewAgent(config.Config{Address: server.URL, RateLimit: 1}, new(MockMetricsCollector), WithStreaming())
+		failed, err := a.sendMetrics(context.Background(), metrics)
+		require.Error(t, err)
+		assert.True(t, isRetryable(err))
+		assert.Equal(t, metrics[3:], failed)
+	})
+}
+
+// TestSendMetricsMsgPack tests sending the metrics in MessagePack through the signing, compression and encryption
+func TestSendMetricsMsgPack(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hasher := security.NewDefaultHasher("secret")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, codec.ContentTypeMsgPack, r.Header.Get("Content-Type"))
+		assert.Equal(t, codec.ContentTypeMsgPack, r.Header.Get("Accept"))
+		var received []*models.Metrics
+		require.NoError(t, codec.MsgPack.Decode(r.Body, &received))
+		require.Len(t, received, 2)
+		results := []models.BatchResult{
+			{Index: 0, ID: received[0].ID, Status: http.StatusOK, Metric: received[0]},
+			{Index: 1, ID: received[1].ID, Status: http.StatusInternalServerError,
+				Error: apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "db is down").WithIndex(1)},
+		}
+		w.Header().Set("Content-Type", codec.ContentTypeMsgPack)
+		w.WriteHeader(http.StatusMultiStatus)
+		assert.NoError(t, codec.MsgPack.Encode(w, models.BatchResponse{Results: results}))
+	})
+	server := httptest.NewServer(middleware.HashChecker(hasher)(middleware.Compress(middleware.NewEncryption(privateKey).MiddleWare(handler))))
+	defer server.Close()
+
+	encryptor, err := security.NewDefaultEncryptor(&privateKey.PublicKey, security.SchemeRSAOAEP)
+	require.NoError(t, err)
+	a := NewAgent(config.Config{Address: server.URL, RateLimit: 1}, new(MockMetricsCollector),
+		WithCodec(codec.MsgPack), WithPartialSuccess(), WithHasher(hasher), WithEncryptor(encryptor), WithResponseEncryption())
+
+	value, delta := 1.5, int64(3)
+	metrics := []*models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+	failed, err := a.sendMetrics(context.Background(), metrics)
+	require.Error(t, err)
+	assert.True(t, isRetryable(err))
+	assert.Equal(t, []*models.Metrics{metrics[1]}, failed)
 }
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/agent/logger"
+	"github.com/shadyziedan/metrica/internal/compression"
+	"github.com/shadyziedan/metrica/internal/retry"
+)
+
+// Strategy selects the server endpoints the metrics are sent to.
+type Strategy string
+
+const (
+	// StrategyFailover sends to the first healthy endpoint in the configured order
+	StrategyFailover Strategy = "failover"
+	// StrategyRoundRobin spreads the sends across the healthy endpoints
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyMirror sends every batch to all the endpoints
+	StrategyMirror Strategy = "mirror"
+)
+
+// ParseStrategy parses the endpoint strategy name, the empty name means failover.
+func ParseStrategy(name string) (Strategy, error) {
+	switch strategy := Strategy(name); strategy {
+	case "":
+		return StrategyFailover, nil
+	case StrategyFailover, StrategyRoundRobin, StrategyMirror:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown endpoint strategy %q", name)
+	}
+}
+
+// endpointFailureThreshold consecutive failed sends make an endpoint unhealthy for endpointCooldown.
+const (
+	endpointFailureThreshold = 3
+	endpointCooldown         = 30 * time.Second
+)
+
+// endpoint is a server the agent sends the metrics to, along with its health.
+type endpoint struct {
+	url string
+	// breaker is the circuit breaker of the endpoint in the mirror mode, the other modes share the policy's one
+	breaker *retry.Breaker
+
+	mu       sync.Mutex
+	failures int
+	retryAt  time.Time
+	encoding string
+}
+
+// contentEncoding returns the encoding the requests to the endpoint are compressed with,
+// gzip until the server advertises the encodings it supports.
+func (e *endpoint) contentEncoding() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.encoding == "" {
+		return compression.Gzip
+	}
+	return e.encoding
+}
+
+// negotiate picks the most preferred of the encodings the server advertises in its Accept-Encoding header.
+// It returns whether the encoding changed.
+func (e *endpoint) negotiate(acceptEncoding string) bool {
+	if acceptEncoding == "" {
+		return false
+	}
+	encoding := compression.Negotiate(acceptEncoding, compression.Supported)
+	if encoding == "" {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	changed := encoding != e.encoding
+	e.encoding = encoding
+	return changed
+}
+
+// healthy reports whether the endpoint may be used: it hasn't failed repeatedly or its cooldown has passed.
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failures < endpointFailureThreshold || !now.Before(e.retryAt)
+}
+
+// record records the outcome of a send to the endpoint.
+func (e *endpoint) record(success bool, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if success {
+		if e.failures >= endpointFailureThreshold {
+			logger.Log.Info("Server endpoint is healthy again", zap.String("endpoint", e.url))
+		}
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if e.failures >= endpointFailureThreshold {
+		if e.failures == endpointFailureThreshold {
+			logger.Log.Warn("Server endpoint is unhealthy", zap.String("endpoint", e.url))
+		}
+		e.retryAt = now.Add(endpointCooldown)
+	}
+}
+
+// endpointSet orders the endpoints for a send according to the strategy.
+type endpointSet struct {
+	strategy  Strategy
+	endpoints []*endpoint
+	next      atomic.Uint64
+	now       func() time.Time
+}
+
+// newEndpointSet creates the endpoints from the server addresses, the ones without a scheme get the given one.
+func newEndpointSet(strategy Strategy, scheme string, addresses ...string) *endpointSet {
+	set := &endpointSet{strategy: strategy, now: time.Now}
+	for _, address := range addresses {
+		address = strings.TrimSuffix(address, "/")
+		if address == "" {
+			continue
+		}
+		if !strings.Contains(address, "://") {
+			address = scheme + "://" + address
+		}
+		set.endpoints = append(set.endpoints, &endpoint{url: address})
+	}
+	return set
+}
+
+// order returns the endpoints to try for a send: the healthy ones first, starting with the primary endpoint
+// for failover and with the next endpoint in turn for round-robin. The unhealthy ones are kept as a last resort.
+func (s *endpointSet) order() []*endpoint {
+	n := len(s.endpoints)
+	start := 0
+	if s.strategy == StrategyRoundRobin && n > 0 {
+		start = int((s.next.Add(1) - 1) % uint64(n))
+	}
+	now := s.now()
+	healthy := make([]*endpoint, 0, n)
+	var unhealthy []*endpoint
+	for i := 0; i < n; i++ {
+		e := s.endpoints[(start+i)%n]
+		if e.healthy(now) {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/agent/config"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/retry"
+)
+
+func urls(endpoints []*endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.url)
+	}
+	return result
+}
+
+func TestEndpointSet_Order(t *testing.T) {
+	now := time.Now()
+
+	t.Run("failover", func(t *testing.T) {
+		set := newEndpointSet(StrategyFailover, "http", "a:8080", "https://b:8443/", "c:8080")
+		set.now = func() time.Time { return now }
+		assert.Equal(t, []string{"http://a:8080", "https://b:8443", "http://c:8080"}, urls(set.order()))
+		assert.Equal(t, []string{"http://a:8080", "https://b:8443", "http://c:8080"}, urls(set.order()))
+
+		// the unhealthy primary is tried last until its cooldown passes
+		for i := 0; i < endpointFailureThreshold; i++ {
+			set.endpoints[0].record(false, now)
+		}
+		assert.Equal(t, []string{"https://b:8443", "http://c:8080", "http://a:8080"}, urls(set.order()))
+		now = now.Add(endpointCooldown)
+		assert.Equal(t, []string{"http://a:8080", "https://b:8443", "http://c:8080"}, urls(set.order()))
+	})
+
+	t.Run("round-robin", func(t *testing.T) {
+		set := newEndpointSet(StrategyRoundRobin, "http", "a", "b", "c")
+		set.now = func() time.Time { return now }
+		assert.Equal(t, []string{"http://a", "http://b", "http://c"}, urls(set.order()))
+		assert.Equal(t, []string{"http://b", "http://c", "http://a"}, urls(set.order()))
+		assert.Equal(t, []string{"http://c", "http://a", "http://b"}, urls(set.order()))
+	})
+}
+
+func TestParseStrategy(t *testing.T) {
+	strategy, err := ParseStrategy("")
+	require.NoError(t, err)
+	assert.Equal(t, StrategyFailover, strategy)
+
+	strategy, err = ParseStrategy("mirror")
+	require.NoError(t, err)
+	assert.Equal(t, StrategyMirror, strategy)
+
+	_, err = ParseStrategy("random")
+	assert.Error(t, err)
+}
+
+func countingServer(status int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+	}))
+	return server, &requests
+}
+
+func TestSendMetricsFailover(t *testing.T) {
+	down, downRequests := countingServer(http.StatusServiceUnavailable)
+	defer down.Close()
+	up, upRequests := countingServer(http.StatusOK)
+	defer up.Close()
+
+	cnf := config.Config{Address: down.URL, ExtraAddresses: []string{up.URL}, RateLimit: 1}
+	a := NewAgent(cnf, new(MockMetricsCollector))
+
+	value := 1.5
+	failed, err := a.sendMetrics(context.Background(), []*models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}})
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	assert.Equal(t, int32(1), downRequests.Load())
+	assert.Equal(t, int32(1), upRequests.Load())
+}
+
+func TestDeliverMirror(t *testing.T) {
+	first, firstRequests := countingServer(http.StatusOK)
+	defer first.Close()
+	second, secondRequests := countingServer(http.StatusOK)
+	defer second.Close()
+	failing, failingRequests := countingServer(http.StatusBadGateway)
+	defer failing.Close()
+
+	cnf := config.Config{
+		Address:          first.URL,
+		ExtraAddresses:   []string{second.URL, failing.URL},
+		EndpointStrategy: string(StrategyMirror),
+		RateLimit:        1,
+	}
+	a := NewAgent(cnf, new(MockMetricsCollector), WithRetryPolicy(retry.Policy{MaxRetries: 2, InitialInterval: time.Millisecond}))
+
+	value := 1.5
+	err := a.deliver(context.Background(), []*models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}})
+
+	// the failing endpoint is retried on its own
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), failing.URL)
+	assert.Equal(t, int32(1), firstRequests.Load())
+	assert.Equal(t, int32(1), secondRequests.Load())
+	assert.Equal(t, int32(3), failingRequests.Load())
+}
+
+func TestDeliverMirror_BreakerPerEndpoint(t *testing.T) {
+	up, upRequests := countingServer(http.StatusOK)
+	defer up.Close()
+	failing, failingRequests := countingServer(http.StatusBadGateway)
+	defer failing.Close()
+
+	cnf := config.Config{
+		Address:          up.URL,
+		ExtraAddresses:   []string{failing.URL},
+		EndpointStrategy: string(StrategyMirror),
+		RateLimit:        1,
+	}
+	a := NewAgent(cnf, new(MockMetricsCollector), WithRetryPolicy(retry.Policy{Breaker: retry.NewBreaker(1, time.Hour)}))
+
+	value := 1.5
+	metrics := []*models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}
+	require.Error(t, a.deliver(context.Background(), metrics))
+
+	// only the breaker of the failing endpoint is open
+	err := a.deliver(context.Background(), metrics)
+	require.ErrorIs(t, err, retry.ErrCircuitOpen)
+	assert.Contains(t, err.Error(), failing.URL)
+	assert.Equal(t, int32(2), upRequests.Load())
+	assert.Equal(t, int32(1), failingRequests.Load())
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/shadyziedan/metrica/internal/agent/logger"
 	"go.uber.org/zap"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v10"
@@ -16,16 +17,69 @@ import (
 type Config struct {
 	// Address is web server host address
 	Address string `env:"ADDRESS" json:"address"`
+	// ExtraAddresses are additional server addresses the metrics are sent to according to EndpointStrategy
+	ExtraAddresses []string `env:"EXTRA_ADDRESSES" envSeparator:"," json:"extra_addresses"`
+	// EndpointStrategy selects the servers the metrics are sent to: failover, round-robin or mirror
+	EndpointStrategy string `env:"ENDPOINT_STRATEGY" json:"endpoint_strategy"`
 	// ReportInterval is interval in seconds of reporting metrics
 	ReportInterval Duration `env:"REPORT_INTERVAL" json:"report_interval"`
 	// PollInterval is interval or frequency in seconds of gathering metrics from runtime package
 	PollInterval Duration `env:"POLL_INTERVAL" json:"poll_interval"`
 	// Key is a secret key for hashing data
 	Key string `env:"KEY" json:"-"`
+	// Token is the bearer token sent to the server
+	Token string `env:"TOKEN" json:"-"`
 	// RateLimit is a rate limiter of metrics being sent
 	RateLimit int `env:"RATE_LIMIT" json:"-"`
 	// CryptoKey is a path to public key to encrypt data sent to the server
 	CryptoKey string `env:"CRYPTO_KEY" json:"crypto_key"`
+	// EncryptionScheme is the scheme used to transfer the encryption key: rsa-pkcs1v15, rsa-oaep or x25519-aes-gcm.
+	// The default scheme for the key type is used when it is empty
+	EncryptionScheme string `env:"ENCRYPTION_SCHEME" json:"encryption_scheme"`
+	// SessionKeyTTL is how long a session encryption key is used, a new key is generated for every batch when it is zero
+	SessionKeyTTL Duration `env:"SESSION_KEY_TTL" json:"session_key_ttl"`
+	// EncryptResponses asks the server to encrypt its responses with the session key
+	EncryptResponses bool `env:"ENCRYPT_RESPONSES" json:"encrypt_responses"`
+	// PartialSuccess asks the server to apply the valid metrics of a batch and report the rejected ones
+	PartialSuccess bool `env:"PARTIAL_SUCCESS" json:"partial_success"`
+	// RetryMaxRetries is the number of times a failed send is retried, a negative value means unlimited
+	RetryMaxRetries int `env:"RETRY_MAX_RETRIES" json:"retry_max_retries"`
+	// RetryInitialInterval is the upper bound of the random delay before the first retry
+	RetryInitialInterval Duration `env:"RETRY_INITIAL_INTERVAL" json:"retry_initial_interval"`
+	// RetryMaxInterval caps the delay between the retries
+	RetryMaxInterval Duration `env:"RETRY_MAX_INTERVAL" json:"retry_max_interval"`
+	// RetryMaxElapsedTime is the time after which a failed send is no longer retried, zero means no limit
+	RetryMaxElapsedTime Duration `env:"RETRY_MAX_ELAPSED_TIME" json:"retry_max_elapsed_time"`
+	// BreakerThreshold is the number of consecutive failed sends opening the circuit breaker, zero disables it
+	BreakerThreshold int `env:"BREAKER_THRESHOLD" json:"breaker_threshold"`
+	// BreakerCooldown is how long the circuit breaker stays open before a trial send
+	BreakerCooldown Duration `env:"BREAKER_COOLDOWN" json:"breaker_cooldown"`
+	// Format is the format the metrics are sent in: json or msgpack
+	Format string `env:"FORMAT" json:"format"`
+	// Stream sends the metrics to the streaming endpoint in the newline-delimited JSON format
+	Stream bool `env:"STREAM" json:"stream"`
+	// Compression is the encoding the metrics are compressed with: gzip, zstd or snappy.
+	// The most preferred encoding advertised by the server is used when it is empty
+	Compression string `env:"COMPRESSION" json:"compression"`
+	// CompressionLevel is the compression level: fastest, default or best
+	CompressionLevel string `env:"COMPRESSION_LEVEL" json:"compression_level"`
+	// Aggregate makes the agent report the min, max and avg of every gauge over the report window
+	// as the <name>_min, <name>_max and <name>_avg series
+	Aggregate bool `env:"AGGREGATE" json:"aggregate"`
+	// SkipUnchanged leaves out of the report the gauges that haven't changed since the last report
+	SkipUnchanged bool `env:"SKIP_UNCHANGED" json:"skip_unchanged"`
+	// ChangeThreshold is the relative change of a gauge that triggers an early report, zero disables it
+	ChangeThreshold float64 `env:"CHANGE_THRESHOLD" json:"change_threshold"`
+	// EarlyReportInterval is the minimum time between a report and an early one
+	EarlyReportInterval Duration `env:"EARLY_REPORT_INTERVAL" json:"early_report_interval"`
+	// ChangeIgnore are the gauges whose changes never trigger an early report
+	ChangeIgnore []string `env:"CHANGE_IGNORE" envSeparator:"," json:"change_ignore"`
+	// TLSCA is a path to the CA bundle used to verify the server certificate
+	TLSCA string `env:"TLS_CA" json:"tls_ca"`
+	// TLSCert is a path to the client certificate presented to the server
+	TLSCert string `env:"TLS_CERT" json:"tls_cert"`
+	// TLSKey is a path to the private key of the client certificate
+	TLSKey string `env:"TLS_KEY" json:"tls_key"`
 }
 
 type Duration struct {
@@ -40,11 +94,43 @@ func ParseConfig() Config {
 
 	flag.StringVar(&configJSONPath, "c", "", "Path to JSON config file")
 	flag.StringVar(&cnf.Address, "a", "localhost:8080", "адрес эндпоинта HTTP-сервера")
+	flag.Func("extra-address", "дополнительные адреса серверов через запятую", func(value string) error {
+		cnf.ExtraAddresses = append(cnf.ExtraAddresses, strings.Split(value, ",")...)
+		return nil
+	})
+	flag.StringVar(&cnf.EndpointStrategy, "endpoint-strategy", "failover", "стратегия выбора серверов: failover, round-robin или mirror")
 	flag.DurationVar(&cnf.ReportInterval.Duration, "r", 10*time.Second, "частота отправки метрик на сервер")
 	flag.DurationVar(&cnf.PollInterval.Duration, "p", 2*time.Second, "частота опроса метрик из пакета runtime")
 	flag.StringVar(&cnf.Key, "k", "", "Ключ")
 	flag.IntVar(&cnf.RateLimit, "l", 1, "Rate limit")
+	flag.StringVar(&cnf.Token, "token", "", "токен API для доступа к серверу")
 	flag.StringVar(&cnf.CryptoKey, "crypto-key", "", "путь до файла с публичным ключом")
+	flag.DurationVar(&cnf.SessionKeyTTL.Duration, "session-key-ttl", 10*time.Minute, "время жизни сеансового ключа шифрования, 0 - новый ключ для каждой отправки")
+	flag.BoolVar(&cnf.EncryptResponses, "encrypt-responses", false, "запрашивать шифрование ответов сервера")
+	flag.BoolVar(&cnf.PartialSuccess, "partial-success", false, "применять корректные метрики пакета и повторно отправлять только отклонённые")
+	flag.StringVar(&cnf.EncryptionScheme, "encryption-scheme", "", "схема шифрования: rsa-pkcs1v15, rsa-oaep или x25519-aes-gcm")
+	flag.IntVar(&cnf.RetryMaxRetries, "retry-max-retries", 3, "число повторных попыток отправки, отрицательное значение - без ограничений")
+	flag.DurationVar(&cnf.RetryInitialInterval.Duration, "retry-initial-interval", time.Second, "верхняя граница случайной задержки перед первой повторной попыткой")
+	flag.DurationVar(&cnf.RetryMaxInterval.Duration, "retry-max-interval", 10*time.Second, "максимальная задержка между повторными попытками")
+	flag.DurationVar(&cnf.RetryMaxElapsedTime.Duration, "retry-max-elapsed-time", 30*time.Second, "время, после которого отправка больше не повторяется, 0 - без ограничений")
+	flag.IntVar(&cnf.BreakerThreshold, "breaker-threshold", 5, "число неудачных отправок подряд, после которого отправка приостанавливается, 0 - отключено")
+	flag.DurationVar(&cnf.BreakerCooldown.Duration, "breaker-cooldown", 30*time.Second, "время приостановки отправки после неудачных попыток")
+	flag.StringVar(&cnf.Format, "format", "json", "формат отправки метрик: json или msgpack")
+	flag.BoolVar(&cnf.Stream, "stream", false, "отправлять метрики потоком в формате NDJSON")
+	flag.StringVar(&cnf.Compression, "compression", "", "алгоритм сжатия: gzip, zstd или snappy, по умолчанию выбирается по ответу сервера")
+	flag.StringVar(&cnf.CompressionLevel, "compression-level", "best", "уровень сжатия: fastest, default или best")
+	flag.BoolVar(&cnf.Aggregate, "aggregate", false, "отправлять минимум, максимум и среднее значение метрик gauge за период отправки")
+	flag.BoolVar(&cnf.SkipUnchanged, "skip-unchanged", false, "не отправлять метрики gauge, не изменившиеся с прошлой отправки")
+	flag.Float64Var(&cnf.ChangeThreshold, "change-threshold", 0, "относительное изменение метрики gauge, при котором метрики отправляются досрочно, 0 - отключено")
+	flag.DurationVar(&cnf.EarlyReportInterval.Duration, "early-report-interval", 5*time.Second, "минимальное время между отправками метрик при досрочной отправке")
+	cnf.ChangeIgnore = []string{"RandomValue"}
+	flag.Func("change-ignore", "метрики gauge через запятую, изменение которых не вызывает досрочную отправку (по умолчанию RandomValue)", func(value string) error {
+		cnf.ChangeIgnore = strings.Split(value, ",")
+		return nil
+	})
+	flag.StringVar(&cnf.TLSCA, "tls-ca", "", "путь до файла с корневыми сертификатами для проверки сертификата сервера")
+	flag.StringVar(&cnf.TLSCert, "tls-cert", "", "путь до файла с сертификатом агента")
+	flag.StringVar(&cnf.TLSKey, "tls-key", "", "путь до файла с приватным ключом сертификата агента")
 
 	flag.Parse()
 
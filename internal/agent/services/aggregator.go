@@ -0,0 +1,152 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// fullReportEvery forces a report of all the gauges every that many reports, even unchanged ones,
+// so that a restarted server gets the values back.
+const fullReportEvery = 10
+
+// AggregatorConfig configures the Aggregator.
+type AggregatorConfig struct {
+	// Derived adds the <name>_min, <name>_max and <name>_avg series of every gauge to the report
+	Derived bool
+	// SkipUnchanged leaves out the gauges that kept the last reported value over the whole window
+	SkipUnchanged bool
+	// ChangeThreshold is the relative change of a gauge since the last report that calls for an early report,
+	// zero disables the early reports
+	ChangeThreshold float64
+	// MinEarlyInterval is the minimum time between the last report and an early one,
+	// zero allows an early report at every poll
+	MinEarlyInterval time.Duration
+	// ChangeIgnore are the gauges that never call for an early report, e.g. the noisy RandomValue
+	ChangeIgnore []string
+}
+
+// GaugeSummary holds the statistics of a gauge over a report window.
+type GaugeSummary struct {
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count int
+	Last  float64
+}
+
+// Avg returns the average of the gauge samples.
+func (s *GaugeSummary) Avg() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+func (s *GaugeSummary) add(value float64) {
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Sum += value
+	s.Count++
+	s.Last = value
+}
+
+// Aggregator accumulates the metrics polled within a report window, so that the variation of the gauges
+// between the reports isn't lost.
+type Aggregator struct {
+	config AggregatorConfig
+
+	ignore map[string]bool
+	now    func() time.Time
+
+	mu          sync.Mutex
+	gauges      map[string]*GaugeSummary
+	counters    map[string]int
+	reported    map[string]float64
+	reports     int
+	lastFlushed time.Time
+}
+
+// NewAggregator creates a new Aggregator.
+func NewAggregator(config AggregatorConfig) *Aggregator {
+	ignore := make(map[string]bool, len(config.ChangeIgnore))
+	for _, name := range config.ChangeIgnore {
+		ignore[name] = true
+	}
+	return &Aggregator{
+		config:   config,
+		ignore:   ignore,
+		now:      time.Now,
+		gauges:   make(map[string]*GaugeSummary),
+		counters: make(map[string]int),
+		reported: make(map[string]float64),
+	}
+}
+
+// Add adds the polled metrics to the current window and reports whether a gauge changed
+// by more than the change threshold since its last reported value, and the minimum interval
+// between the early reports has passed since the last report.
+func (a *Aggregator) Add(metrics *AgentMetrics) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sharpChange := false
+	for _, gauge := range metrics.Gauge.GetAll() {
+		summary, ok := a.gauges[gauge.Name]
+		if !ok {
+			summary = &GaugeSummary{}
+			a.gauges[gauge.Name] = summary
+		}
+		summary.add(gauge.Value)
+		if reported, ok := a.reported[gauge.Name]; ok && !a.ignore[gauge.Name] && a.changedSharply(reported, gauge.Value) {
+			sharpChange = true
+		}
+	}
+	for _, counter := range metrics.Counter.GetAll() {
+		a.counters[counter.Name] = counter.Value
+	}
+	return sharpChange && a.now().Sub(a.lastFlushed) >= a.config.MinEarlyInterval
+}
+
+func (a *Aggregator) changedSharply(reported, value float64) bool {
+	if a.config.ChangeThreshold <= 0 {
+		return false
+	}
+	if reported == 0 {
+		return value != 0
+	}
+	return math.Abs(value-reported)/math.Abs(reported) > a.config.ChangeThreshold
+}
+
+// Flush returns the metrics of the current window and starts a new one.
+// Every gauge is reported with its last value, along with its derived series if configured.
+func (a *Aggregator) Flush() *AgentMetrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	metrics := NewAgentMetrics()
+	fullReport := a.reports%fullReportEvery == 0
+	a.reports++
+	a.lastFlushed = a.now()
+	for name, summary := range a.gauges {
+		reported, ok := a.reported[name]
+		unchanged := ok && summary.Min == reported && summary.Max == reported
+		if a.config.SkipUnchanged && unchanged && !fullReport {
+			continue
+		}
+		metrics.Gauge.UpdateMetric(name, summary.Last)
+		if a.config.Derived {
+			metrics.Gauge.UpdateMetric(name+"_min", summary.Min)
+			metrics.Gauge.UpdateMetric(name+"_max", summary.Max)
+			metrics.Gauge.UpdateMetric(name+"_avg", summary.Avg())
+		}
+		a.reported[name] = summary.Last
+	}
+	for name, value := range a.counters {
+		metrics.Counter.UpdateMetric(name, value)
+	}
+	a.gauges = make(map[string]*GaugeSummary, len(a.gauges))
+	return metrics
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gauges(metrics *AgentMetrics) map[string]float64 {
+	values := make(map[string]float64)
+	for _, gauge := range metrics.Gauge.GetAll() {
+		values[gauge.Name] = gauge.Value
+	}
+	return values
+}
+
+func sample(value float64) *AgentMetrics {
+	metrics := NewAgentMetrics()
+	metrics.Gauge.UpdateMetric("Alloc", value)
+	metrics.Counter.UpdateMetric("PollCount", 1)
+	return metrics
+}
+
+func TestAggregator_Derived(t *testing.T) {
+	a := NewAggregator(AggregatorConfig{Derived: true})
+	for _, value := range []float64{4, 1, 7} {
+		a.Add(sample(value))
+	}
+
+	metrics := a.Flush()
+	assert.Equal(t, map[string]float64{"Alloc": 7, "Alloc_min": 1, "Alloc_max": 7, "Alloc_avg": 4}, gauges(metrics))
+	assert.Len(t, metrics.Counter.GetAll(), 1)
+
+	a.Add(sample(2))
+	assert.Equal(t, map[string]float64{"Alloc": 2, "Alloc_min": 2, "Alloc_max": 2, "Alloc_avg": 2}, gauges(a.Flush()))
+}
+
+func TestAggregator_SkipUnchanged(t *testing.T) {
+	a := NewAggregator(AggregatorConfig{SkipUnchanged: true})
+	a.Add(sample(5))
+	assert.Equal(t, map[string]float64{"Alloc": 5}, gauges(a.Flush()))
+
+	a.Add(sample(5))
+	assert.Empty(t, gauges(a.Flush()), "unchanged gauge is skipped")
+
+	a.Add(sample(6))
+	a.Add(sample(5))
+	assert.Equal(t, map[string]float64{"Alloc": 5}, gauges(a.Flush()), "gauge varied within the window")
+
+	for i := 3; i < fullReportEvery; i++ {
+		a.Add(sample(5))
+		a.Flush()
+	}
+	a.Add(sample(5))
+	assert.Equal(t, map[string]float64{"Alloc": 5}, gauges(a.Flush()), "periodic full report")
+}
+
+func TestAggregator_ChangeThreshold(t *testing.T) {
+	a := NewAggregator(AggregatorConfig{ChangeThreshold: 0.5})
+	assert.False(t, a.Add(sample(100)), "nothing reported yet")
+	a.Flush()
+
+	assert.False(t, a.Add(sample(140)))
+	assert.True(t, a.Add(sample(160)))
+	a.Flush()
+	assert.False(t, a.Add(sample(100)))
+	assert.True(t, a.Add(sample(50)))
+
+	disabled := NewAggregator(AggregatorConfig{})
+	disabled.Add(sample(1))
+	disabled.Flush()
+	assert.False(t, disabled.Add(sample(1000)))
+}
+
+func TestAggregator_EarlyReportLimits(t *testing.T) {
+	now := time.Now()
+	a := NewAggregator(AggregatorConfig{ChangeThreshold: 0.5, MinEarlyInterval: 5 * time.Second, ChangeIgnore: []string{"RandomValue"}})
+	a.now = func() time.Time { return now }
+	noisy := func(alloc, random float64) *AgentMetrics {
+		metrics := sample(alloc)
+		metrics.Gauge.UpdateMetric("RandomValue", random)
+		return metrics
+	}
+	a.Add(noisy(100, 1))
+	a.Flush()
+
+	// the ignored gauges don't trigger an early report
+	now = now.Add(10 * time.Second)
+	assert.False(t, a.Add(noisy(100, 1000)))
+
+	// the early reports are spaced out
+	a.Flush()
+	now = now.Add(2 * time.Second)
+	assert.False(t, a.Add(noisy(200, 1)), "too soon after the last report")
+	now = now.Add(3 * time.Second)
+	assert.True(t, a.Add(noisy(200, 1)))
+}
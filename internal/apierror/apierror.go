@@ -0,0 +1,133 @@
+// Package apierror provides the error envelope of the server API, shared by the server writing it
+// and the agent reading it.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadyziedan/metrica/internal/retry"
+)
+
+// Error codes of the error envelope.
+const (
+	CodeUnknown              = "unknown"
+	CodeInternal             = "internal"
+	CodeUnavailable          = "unavailable"
+	CodeInvalidBody          = "invalid_body"
+	CodeUnknownMetricType    = "unknown_metric_type"
+	CodeInvalidValue         = "invalid_value"
+	CodeMissingValue         = "missing_value"
+	CodeMetricNotFound       = "metric_not_found"
+	CodeInvalidMetricName    = "invalid_metric_name"
+	CodeMetricNameTooLong    = "metric_name_too_long"
+	CodeBatchTooLarge        = "batch_too_large"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeTooManySeries        = "too_many_series"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeInvalidSignature     = "invalid_signature"
+	CodeReplayedRequest      = "replayed_request"
+	CodeUnknownKey           = "unknown_encryption_key"
+	CodeUnknownScheme        = "unknown_encryption_scheme"
+	CodeDecryptionFailed     = "decryption_failed"
+	CodeRateLimited          = "rate_limited"
+	CodeUnsupportedEncoding  = "unsupported_encoding"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+)
+
+// Error is an API error written to the client as a JSON object.
+type Error struct {
+	// Status is the HTTP status code of the response
+	Status int `json:"-"`
+	// RetryAfter is sent in the Retry-After header when it is positive
+	RetryAfter time.Duration `json:"-"`
+	// Code is a stable machine readable error code
+	Code string `json:"code"`
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+	// MetricID is the metric the error relates to, if any
+	MetricID string `json:"metric_id,omitempty"`
+	// Index is the position of the offending metric in the batch, if any
+	Index *int `json:"index,omitempty"`
+	// Retryable tells the client whether sending the same request again may succeed
+	Retryable bool `json:"retryable"`
+}
+
+func (e *Error) Error() string {
+	if e.MetricID != "" {
+		return fmt.Sprintf("%s: %s (metric %s)", e.Code, e.Message, e.MetricID)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// New creates a new Error. The retryability is derived from the status code, see retry.IsRetryableStatus.
+func New(status int, code, message string) *Error {
+	return &Error{
+		Status:    status,
+		Code:      code,
+		Message:   message,
+		Retryable: retry.IsRetryableStatus(status),
+	}
+}
+
+// Internal creates the 500 Internal Server Error for an unexpected error.
+func Internal(err error) *Error {
+	return New(http.StatusInternalServerError, CodeInternal, err.Error())
+}
+
+// WithMetric returns a copy of the error related to the given metric.
+func (e *Error) WithMetric(metricID string) *Error {
+	e2 := *e
+	e2.MetricID = metricID
+	return &e2
+}
+
+// WithIndex returns a copy of the error related to the metric at the given position in the batch.
+func (e *Error) WithIndex(index int) *Error {
+	e2 := *e
+	e2.Index = &index
+	return &e2
+}
+
+// Write writes the JSON response for the error.
+// Errors other than API errors are written as 500 Internal Server Error.
+func Write(w http.ResponseWriter, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	if apiErr.RetryAfter > 0 {
+		retryAfter := int(math.Ceil(apiErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	_ = json.NewEncoder(w).Encode(apiErr)
+}
+
+// Parse reads the error envelope from a response body.
+// If the body is not an envelope, e.g. it comes from a proxy, an error with the unknown code
+// and the retryability derived from the status code is returned.
+func Parse(status int, body []byte) *Error {
+	apiErr := &Error{}
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Code == "" {
+		apiErr = New(status, CodeUnknown, strings.TrimSpace(string(body)))
+	}
+	apiErr.Status = status
+	return apiErr
+}
+
+// IsRetryable reports whether the error is an API error that may succeed when retried.
+func IsRetryable(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Retryable
+}
@@ -0,0 +1,59 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	t.Run("api error", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		Write(rec, New(http.StatusBadRequest, CodeMissingValue, "gauge metric has no value").WithMetric("Alloc").WithIndex(2))
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"code":"missing_value","message":"gauge metric has no value","metric_id":"Alloc","index":2,"retryable":false}`, rec.Body.String())
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		apiErr := New(http.StatusTooManyRequests, CodeRateLimited, "too many requests")
+		apiErr.RetryAfter = 1500 * time.Millisecond
+		rec := httptest.NewRecorder()
+		Write(rec, apiErr)
+
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+		assert.Contains(t, rec.Body.String(), `"retryable":true`)
+	})
+
+	t.Run("other error", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		Write(rec, errors.New("connection refused"))
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.JSONEq(t, `{"code":"internal","message":"connection refused","retryable":true}`, rec.Body.String())
+	})
+}
+
+func TestParse(t *testing.T) {
+	apiErr := Parse(http.StatusBadRequest, []byte(`{"code":"invalid_metric_name","message":"bad","metric_id":"a b","index":3,"retryable":false}`))
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, CodeInvalidMetricName, apiErr.Code)
+	assert.Equal(t, "a b", apiErr.MetricID)
+	require.NotNil(t, apiErr.Index)
+	assert.Equal(t, 3, *apiErr.Index)
+	assert.False(t, IsRetryable(apiErr))
+
+	apiErr = Parse(http.StatusBadGateway, []byte("<html>Bad Gateway</html>\n"))
+	assert.Equal(t, CodeUnknown, apiErr.Code)
+	assert.Equal(t, "<html>Bad Gateway</html>", apiErr.Message)
+	assert.True(t, IsRetryable(apiErr))
+
+	assert.False(t, IsRetryable(errors.New("other")))
+}
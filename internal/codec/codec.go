@@ -0,0 +1,125 @@
+// Package codec implements the wire formats of the metrics API: JSON and the compact binary MessagePack.
+// The format of a request body is selected by its Content-Type and the format of a response by the Accept header.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The content types of the supported formats.
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgPack = "application/msgpack"
+)
+
+// Codec encodes and decodes the API models in a wire format.
+type Codec interface {
+	// ContentType returns the content type of the format
+	ContentType() string
+	// Encode writes the value to w
+	Encode(w io.Writer, v any) error
+	// Decode reads the value from r
+	Decode(r io.Reader, v any) error
+}
+
+var (
+	// JSON is the JSON format, the default one
+	JSON Codec = jsonCodec{}
+	// MsgPack is the MessagePack format. The models are encoded as maps keyed by their JSON field names,
+	// so that both formats carry the same fields
+	MsgPack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (msgpackCodec) Encode(w io.Writer, v any) error {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	encoder.SetOmitEmpty(true)
+	return encoder.Encode(v)
+}
+
+func (msgpackCodec) Decode(r io.Reader, v any) error {
+	decoder := msgpack.NewDecoder(r)
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// ForContentType returns the codec of the Content-Type header value.
+// Anything but MessagePack is treated as JSON, which the API has always accepted regardless of the content type.
+func ForContentType(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && isMsgPack(mediaType) {
+		return MsgPack
+	}
+	return JSON
+}
+
+// ForAccept returns the codec of the response from the Accept header value: the first of the formats it lists,
+// or the fallback codec if it lists neither. A format refused with a zero weight is never used.
+func ForAccept(accept string, fallback Codec) Codec {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var c Codec
+		switch {
+		case isMsgPack(mediaType):
+			c = MsgPack
+		case mediaType == ContentTypeJSON:
+			c = JSON
+		default:
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			if c == fallback {
+				fallback = JSON
+			}
+			continue
+		}
+		return c
+	}
+	return fallback
+}
+
+func isMsgPack(mediaType string) bool {
+	return mediaType == ContentTypeMsgPack || mediaType == "application/x-msgpack" || mediaType == "application/vnd.msgpack"
+}
+
+// ParseFormat returns the codec of the format name: json or msgpack. The empty name means JSON.
+func ParseFormat(name string) (Codec, error) {
+	switch name {
+	case "", "json":
+		return JSON, nil
+	case "msgpack":
+		return MsgPack, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", name)
+	}
+}
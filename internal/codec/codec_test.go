@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+func TestCodecs(t *testing.T) {
+	value, delta := 1.5, int64(3)
+	metrics := []*models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+	response := models.BatchResponse{Results: []models.BatchResult{
+		{Index: 0, ID: "Alloc", Status: http.StatusOK, Metric: metrics[0]},
+		{Index: 1, ID: "bad", Status: http.StatusBadRequest,
+			Error: apierror.New(http.StatusBadRequest, apierror.CodeInvalidMetricName, "bad name").WithIndex(1)},
+	}}
+
+	for _, c := range []Codec{JSON, MsgPack} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, c.Encode(&buf, metrics))
+			var decoded []*models.Metrics
+			require.NoError(t, c.Decode(&buf, &decoded))
+			assert.Equal(t, metrics, decoded)
+
+			buf.Reset()
+			require.NoError(t, c.Encode(&buf, response))
+			var decodedResponse models.BatchResponse
+			require.NoError(t, c.Decode(&buf, &decodedResponse))
+			require.Len(t, decodedResponse.Results, 2)
+			assert.Equal(t, metrics[0], decodedResponse.Results[0].Metric)
+			assert.Equal(t, apierror.CodeInvalidMetricName, decodedResponse.Results[1].Error.Code)
+			assert.Equal(t, 1, *decodedResponse.Results[1].Error.Index)
+		})
+	}
+
+	var jsonBuf, msgpackBuf bytes.Buffer
+	require.NoError(t, JSON.Encode(&jsonBuf, metrics))
+	require.NoError(t, MsgPack.Encode(&msgpackBuf, metrics))
+	assert.Less(t, msgpackBuf.Len(), jsonBuf.Len())
+}
+
+func TestNegotiation(t *testing.T) {
+	assert.Equal(t, JSON, ForContentType(""))
+	assert.Equal(t, JSON, ForContentType("text/plain"))
+	assert.Equal(t, JSON, ForContentType("application/json; charset=utf-8"))
+	assert.Equal(t, MsgPack, ForContentType("application/msgpack"))
+	assert.Equal(t, MsgPack, ForContentType("application/x-msgpack"))
+
+	assert.Equal(t, MsgPack, ForAccept("", MsgPack))
+	assert.Equal(t, JSON, ForAccept("*/*", JSON))
+	assert.Equal(t, JSON, ForAccept("application/json, application/msgpack", MsgPack))
+	assert.Equal(t, MsgPack, ForAccept("text/html, application/msgpack", JSON))
+	assert.Equal(t, JSON, ForAccept("application/msgpack;q=0", MsgPack))
+
+	c, err := ParseFormat("msgpack")
+	require.NoError(t, err)
+	assert.Equal(t, MsgPack, c)
+	_, err = ParseFormat("protobuf")
+	assert.Error(t, err)
+}
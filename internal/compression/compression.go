@@ -0,0 +1,180 @@
+// Package compression implements the content encodings the agent and the server exchange the metrics with
+// and the negotiation of the encoding through the Accept-Encoding header.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The supported content encodings.
+const (
+	Gzip   = "gzip"
+	Zstd   = "zstd"
+	Snappy = "snappy"
+)
+
+// Supported lists the supported content encodings from the most to the least preferred.
+var Supported = []string{Zstd, Gzip, Snappy}
+
+// Level is a compression level, mapped to the closest level of every encoding.
+type Level int
+
+const (
+	// LevelDefault balances the speed and the compression ratio
+	LevelDefault Level = iota
+	// LevelFastest favors the speed
+	LevelFastest
+	// LevelBest favors the compression ratio, it is CPU heavy
+	LevelBest
+)
+
+// ParseLevel parses the compression level name: fastest, default or best. The empty name means default.
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "", "default":
+		return LevelDefault, nil
+	case "fastest":
+		return LevelFastest, nil
+	case "best":
+		return LevelBest, nil
+	default:
+		return LevelDefault, fmt.Errorf("unknown compression level %q", name)
+	}
+}
+
+// IsSupported reports whether the content encoding is supported.
+func IsSupported(encoding string) bool {
+	for _, supported := range Supported {
+		if encoding == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWriter returns a writer compressing the data written to w with the encoding.
+// The writer must be closed to flush the compressed data.
+func NewWriter(encoding string, w io.Writer, level Level) (io.WriteCloser, error) {
+	switch encoding {
+	case Gzip:
+		gzipLevel := gzip.DefaultCompression
+		switch level {
+		case LevelFastest:
+			gzipLevel = gzip.BestSpeed
+		case LevelBest:
+			gzipLevel = gzip.BestCompression
+		}
+		return gzip.NewWriterLevel(w, gzipLevel)
+	case Zstd:
+		zstdLevel := zstd.SpeedDefault
+		switch level {
+		case LevelFastest:
+			zstdLevel = zstd.SpeedFastest
+		case LevelBest:
+			zstdLevel = zstd.SpeedBestCompression
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+	case Snappy:
+		// snappy has no compression levels
+		return snappy.NewBufferedWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// NewReader returns a reader decompressing the data read from r with the encoding.
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case Snappy:
+		return io.NopCloser(snappy.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// Compress compresses the data with the encoding.
+func Compress(encoding string, level Level, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(encoding, &buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses the data with the encoding.
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	r, err := NewReader(encoding, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Negotiate picks the encoding to use from the value of an Accept-Encoding header:
+// the accepted encoding with the highest weight, the ties broken by the order of the supported encodings.
+// It returns the empty string if none of the supported encodings is accepted.
+func Negotiate(acceptEncoding string, supported []string) string {
+	weights := parseAcceptEncoding(acceptEncoding)
+	best, bestWeight := "", 0.0
+	for _, encoding := range supported {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
+
+// Header returns the value of an Accept-Encoding header listing the encodings.
+func Header(encodings []string) string {
+	return strings.Join(encodings, ", ")
+}
+
+func parseAcceptEncoding(value string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(value, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+					weight = q
+				}
+			}
+		}
+		weights[name] = weight
+	}
+	return weights
+}
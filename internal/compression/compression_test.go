@@ -0,0 +1,61 @@
+package compression
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	data := []byte(strings.Repeat(`{"id":"Alloc","type":"gauge","value":1.5}`, 100))
+	for _, encoding := range Supported {
+		for _, level := range []Level{LevelFastest, LevelDefault, LevelBest} {
+			compressed, err := Compress(encoding, level, data)
+			require.NoError(t, err, encoding)
+			assert.Less(t, len(compressed), len(data), encoding)
+
+			decompressed, err := Decompress(encoding, compressed)
+			require.NoError(t, err, encoding)
+			assert.Equal(t, data, decompressed, encoding)
+		}
+	}
+
+	_, err := Compress("br", LevelDefault, data)
+	assert.Error(t, err)
+	_, err = Decompress("zstd", []byte("not compressed"))
+	assert.Error(t, err)
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{name: "none", acceptEncoding: "", want: ""},
+		{name: "gzip only", acceptEncoding: "gzip, deflate, br", want: Gzip},
+		{name: "preference order", acceptEncoding: "snappy, gzip, zstd", want: Zstd},
+		{name: "weights", acceptEncoding: "zstd;q=0.5, snappy;q=0.8", want: Snappy},
+		{name: "refused", acceptEncoding: "zstd;q=0, gzip", want: Gzip},
+		{name: "wildcard", acceptEncoding: "*", want: Zstd},
+		{name: "unsupported", acceptEncoding: "br", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.acceptEncoding, Supported))
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("")
+	require.NoError(t, err)
+	assert.Equal(t, LevelDefault, level)
+	level, err = ParseLevel("fastest")
+	require.NoError(t, err)
+	assert.Equal(t, LevelFastest, level)
+	_, err = ParseLevel("max")
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package models
+
+import "github.com/shadyziedan/metrica/internal/apierror"
+
+// BatchResult is the result of a single metric of a batch update in the partial-success mode
+type BatchResult struct {
+	// Index is the position of the metric in the batch
+	Index int `json:"index"`
+	// ID is the metric identifier
+	ID string `json:"id"`
+	// Status is the HTTP status code the metric would get if it was sent alone
+	Status int `json:"status"`
+	// Metric is the updated metric, if it was applied
+	Metric *Metrics `json:"metric,omitempty"`
+	// Error describes why the metric was rejected, if it was
+	Error *apierror.Error `json:"error,omitempty"`
+}
+
+// BatchResponse is the response to a batch update in the partial-success mode
+type BatchResponse struct {
+	// Results holds the result of every metric in the batch order
+	Results []BatchResult `json:"results"`
+}
+
+// StreamContentType is the content type of the streamed updates, the metrics in the newline-delimited JSON format
+const StreamContentType = "application/x-ndjson"
+
+// StreamResponse is the response to a streamed update
+type StreamResponse struct {
+	// Processed is the number of metrics read from the stream, applied or rejected
+	Processed int `json:"processed"`
+	// Applied is the number of metrics applied
+	Applied int `json:"applied"`
+	// Rejected is the number of invalid metrics skipped
+	Rejected int `json:"rejected"`
+	// Errors describes the first rejected metrics, with their position in the stream
+	Errors []*apierror.Error `json:"errors,omitempty"`
+}
@@ -0,0 +1,86 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling a service considered down.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Breaker is a circuit breaker. After threshold consecutive failures it opens and rejects the calls
+// for the cooldown period, then lets a single trial call through: the breaker closes if the call succeeds
+// and opens again for another cooldown if it fails.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker creates a new Breaker. A nil Breaker, returned when the threshold is not positive, allows every call.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Clone returns a new closed Breaker with the same threshold and cooldown, e.g. for another instance of the service.
+// The clone of a nil Breaker is nil.
+func (b *Breaker) Clone() *Breaker {
+	if b == nil {
+		return nil
+	}
+	return &Breaker{threshold: b.threshold, cooldown: b.cooldown, now: b.now}
+}
+
+// Allow returns ErrCircuitOpen if the call must not be made.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Record records the outcome of an allowed call.
+func (b *Breaker) Record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// Open reports whether the breaker currently rejects the calls.
+func (b *Breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
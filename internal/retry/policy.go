@@ -0,0 +1,112 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy describes how a failed operation is retried: the delay before the n-th retry is
+// a random duration between zero and InitialInterval * Multiplier^n, capped at MaxInterval (full jitter).
+// A server-provided delay (see WithRetryAfter) is used as is instead of the backoff.
+type Policy struct {
+	// MaxRetries is the number of retries after the first attempt, a negative value means unlimited
+	MaxRetries int
+	// InitialInterval is the upper bound of the delay before the first retry
+	InitialInterval time.Duration
+	// Multiplier is the growth factor of the delay bound, values below 1 are treated as 2
+	Multiplier float64
+	// MaxInterval caps the delay bound, zero means no cap
+	MaxInterval time.Duration
+	// MaxElapsedTime stops the retries once the next one would start after it, zero means no limit
+	MaxElapsedTime time.Duration
+	// IsRetryable reports whether the error is worth retrying, every error is when it is nil
+	IsRetryable func(error) bool
+	// Breaker stops the attempts while the called service is considered down, it is optional
+	Breaker *Breaker
+
+	random func() float64
+	now    func() time.Time
+}
+
+// DefaultPolicy returns the policy with three retries within half a minute.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxRetries:      3,
+		InitialInterval: time.Second,
+		Multiplier:      2,
+		MaxInterval:     10 * time.Second,
+		MaxElapsedTime:  30 * time.Second,
+	}
+}
+
+// Do executes the callback and retries it according to the policy.
+// It returns the last error of the callback, or the context error if the context is done while waiting.
+// If the breaker is open, the callback is not executed and ErrCircuitOpen is returned.
+func (p Policy) Do(ctx context.Context, callback func() error) error {
+	start := p.clock()
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if p.Breaker != nil {
+			if err := p.Breaker.Allow(); err != nil {
+				if lastErr != nil {
+					return fmt.Errorf("%w: %w", err, lastErr)
+				}
+				return err
+			}
+		}
+		err := callback()
+		retryable := err != nil && (p.IsRetryable == nil || p.IsRetryable(err))
+		if p.Breaker != nil {
+			// only the retryable errors mean the service is unavailable
+			p.Breaker.Record(!retryable)
+		}
+		if !retryable || (p.MaxRetries >= 0 && attempt >= p.MaxRetries) {
+			return err
+		}
+		lastErr = err
+
+		delay := p.Delay(attempt, err)
+		if p.MaxElapsedTime > 0 && p.clock().Sub(start)+delay > p.MaxElapsedTime {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Delay returns the delay before the retry following the given attempt, counted from zero.
+func (p Policy) Delay(attempt int, err error) time.Duration {
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.Delay > 0 {
+		return retryAfter.Delay
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	bound := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempt))
+	if p.MaxInterval > 0 {
+		bound = math.Min(bound, float64(p.MaxInterval))
+	}
+	random := p.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return time.Duration(random() * bound)
+}
+
+func (p Policy) clock() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
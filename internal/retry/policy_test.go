@@ -0,0 +1,179 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Delay(t *testing.T) {
+	p := Policy{
+		InitialInterval: 100 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     time.Second,
+		random:          func() float64 { return 0.5 },
+	}
+	assert.Equal(t, 50*time.Millisecond, p.Delay(0, errors.New("failed")))
+	assert.Equal(t, 100*time.Millisecond, p.Delay(1, errors.New("failed")))
+	assert.Equal(t, 200*time.Millisecond, p.Delay(2, errors.New("failed")))
+	// the bound is capped at MaxInterval
+	assert.Equal(t, 500*time.Millisecond, p.Delay(10, errors.New("failed")))
+	// the delay requested by the server replaces the backoff
+	assert.Equal(t, 3*time.Second, p.Delay(0, WithRetryAfter(errors.New("busy"), 3*time.Second)))
+}
+
+func TestPolicy_Do(t *testing.T) {
+	errRetryable := errors.New("retryable")
+	errFatal := errors.New("fatal")
+	policy := Policy{
+		MaxRetries:      3,
+		InitialInterval: time.Millisecond,
+		IsRetryable:     func(err error) bool { return errors.Is(err, errRetryable) },
+	}
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		var attempts int
+		err := policy.Do(context.Background(), func() error {
+			attempts++
+			if attempts < 3 {
+				return errRetryable
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		var attempts int
+		err := policy.Do(context.Background(), func() error {
+			attempts++
+			return errRetryable
+		})
+		assert.ErrorIs(t, err, errRetryable)
+		assert.Equal(t, 4, attempts)
+	})
+
+	t.Run("doesn't retry fatal errors", func(t *testing.T) {
+		var attempts int
+		err := policy.Do(context.Background(), func() error {
+			attempts++
+			return errFatal
+		})
+		assert.ErrorIs(t, err, errFatal)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("stops at max elapsed time", func(t *testing.T) {
+		p := policy
+		p.MaxRetries = -1
+		p.MaxElapsedTime = time.Minute
+		now := time.Now()
+		p.now = func() time.Time { return now }
+		var attempts int
+		err := p.Do(context.Background(), func() error {
+			attempts++
+			now = now.Add(25 * time.Second)
+			return errRetryable
+		})
+		assert.ErrorIs(t, err, errRetryable)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("stops when context is done", func(t *testing.T) {
+		p := policy
+		p.InitialInterval = time.Hour
+		p.random = func() float64 { return 1 }
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := p.Do(ctx, func() error { return errRetryable })
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("breaker stops the attempts", func(t *testing.T) {
+		p := policy
+		p.MaxRetries = 10
+		p.Breaker = NewBreaker(2, time.Hour)
+		var attempts int
+		err := p.Do(context.Background(), func() error {
+			attempts++
+			return errRetryable
+		})
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.ErrorIs(t, err, errRetryable)
+		assert.Equal(t, 2, attempts)
+
+		err = p.Do(context.Background(), func() error {
+			attempts++
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.Equal(t, 2, attempts)
+	})
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	require.NoError(t, b.Allow())
+	b.Record(false)
+	require.NoError(t, b.Allow())
+	b.Record(false)
+	assert.True(t, b.Open())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	// a single trial call is let through after the cooldown
+	now = now.Add(time.Minute)
+	require.NoError(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+	b.Record(false)
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	now = now.Add(time.Minute)
+	require.NoError(t, b.Allow())
+	b.Record(true)
+	assert.False(t, b.Open())
+	assert.NoError(t, b.Allow())
+
+	// a clone has the settings but not the state
+	b.Record(false)
+	b.Record(false)
+	clone := b.Clone()
+	assert.False(t, clone.Open())
+	clone.Record(false)
+	clone.Record(false)
+	assert.True(t, clone.Open())
+
+	var disabled *Breaker
+	assert.Nil(t, NewBreaker(0, time.Minute))
+	assert.NoError(t, disabled.Allow())
+	assert.Nil(t, disabled.Clone())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := ParseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, delay)
+
+	delay, ok = ParseRetryAfter("Tue, 01 Oct 2024 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, delay)
+
+	_, ok = ParseRetryAfter("", now)
+	assert.False(t, ok)
+	_, ok = ParseRetryAfter("soon", now)
+	assert.False(t, ok)
+
+	assert.True(t, IsRetryableStatus(503))
+	assert.True(t, IsRetryableStatus(429))
+	assert.False(t, IsRetryableStatus(400))
+	assert.False(t, IsRetryableStatus(501))
+}
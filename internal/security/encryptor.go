@@ -1,67 +1,254 @@
 package security
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
+// DefaultSessionKeyTTL is how long a session key is used when no rotation schedule is configured.
+const DefaultSessionKeyTTL = 10 * time.Minute
+
+// DefaultEncryptor encrypts the data sent to the server with AES-GCM using a session key.
+// The session key is transferred to the server according to the encryption scheme:
+// encrypted with the server RSA key or derived from an X25519 key agreement.
+// The session key is rotated once its TTL elapses; the encrypted key is cached for the session,
+// so the public key operation is done once per session rather than per request.
 type DefaultEncryptor struct {
-	pubKey *rsa.PublicKey
+	mu      sync.Mutex
+	path    string
+	scheme  string
+	ttl     time.Duration
+	now     func() time.Time
+	pubKey  crypto.PublicKey
+	keyID   string
+	session *session
+}
+
+// session is a session key used until it expires.
+type session struct {
+	key     EncryptedKey
+	expires time.Time
+}
+
+// EncryptedKey describes how the AES key is transferred to the server.
+type EncryptedKey struct {
+	// KeyID identifies the server key, it is sent in the X-Key-ID header
+	KeyID string
+	// Scheme is the encryption scheme, it is sent in the X-Encryption-Scheme header
+	Scheme string
+	// Key is the base64 encoded encrypted AES key or ephemeral public key, it is sent in the X-Encrypted-Key header
+	Key string
+	// aesKey is the session key itself, it is kept to decrypt the server response
 	aesKey []byte
 }
 
-func NewDefaultEncryptor(pubKey *rsa.PublicKey) (*DefaultEncryptor, error) {
-	aesKey := make([]byte, 32)
-	_, err := rand.Read(aesKey)
+// EncryptorOption configures optional DefaultEncryptor features.
+type EncryptorOption = func(e *DefaultEncryptor)
+
+// WithSessionKeyTTL sets how long a session key is used before a new one is generated.
+// If the ttl is not positive, a new session key is generated for every encrypted message.
+func WithSessionKeyTTL(ttl time.Duration) EncryptorOption {
+	return func(e *DefaultEncryptor) {
+		e.ttl = ttl
+	}
+}
+
+// NewDefaultEncryptor creates an encryptor for the RSA or X25519 public key of the server.
+// If scheme is empty, the default scheme for the key type is used.
+func NewDefaultEncryptor(pubKey crypto.PublicKey, scheme string, options ...EncryptorOption) (*DefaultEncryptor, error) {
+	e := &DefaultEncryptor{scheme: scheme, ttl: DefaultSessionKeyTTL, now: time.Now}
+	for _, option := range options {
+		option(e)
+	}
+	if err := e.setKey(pubKey); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// NewDefaultEncryptorFromFile creates an encryptor using the public key at path,
+// which is a certificate or a bare public key PEM. The key can be reloaded from the same path with Reload.
+func NewDefaultEncryptorFromFile(path string, scheme string, options ...EncryptorOption) (*DefaultEncryptor, error) {
+	pubKey, err := readPublicKey(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate random AES key: %w", err)
+		return nil, err
+	}
+	encryptor, err := NewDefaultEncryptor(pubKey, scheme, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encryptor: %w", err)
 	}
-	return &DefaultEncryptor{pubKey: pubKey, aesKey: aesKey}, nil
+	encryptor.path = path
+	return encryptor, nil
 }
 
-func NewDefaultEncryptorFromFile(path string) (*DefaultEncryptor, error) {
-	f, err := os.Open(path)
+// Reload reads the public key again from the file the encryptor was created from,
+// so that the server key can be rotated without restarting the agent.
+// The current key is kept if the new one can't be loaded.
+func (e *DefaultEncryptor) Reload() error {
+	if e.path == "" {
+		return errors.New("encryptor is not loaded from a file")
+	}
+	pubKey, err := readPublicKey(e.path)
 	if err != nil {
-		return nil, fmt.Errorf("error opening file %s: %w", path, err)
+		return err
 	}
-	defer f.Close()
+	return e.setKey(pubKey)
+}
 
-	keyData, err := io.ReadAll(f)
+// setKey switches the encryptor to the public key, the current session is ended.
+func (e *DefaultEncryptor) setKey(pubKey crypto.PublicKey) error {
+	keyID, err := KeyID(pubKey)
+	if err != nil {
+		return err
+	}
+	scheme := e.scheme
+	if scheme == "" {
+		scheme = DefaultScheme(pubKey)
+	}
+	switch scheme {
+	case SchemeRSAPKCS1v15, SchemeRSAOAEP:
+		if _, ok := pubKey.(*rsa.PublicKey); !ok {
+			return fmt.Errorf("scheme %s requires an RSA key", scheme)
+		}
+	case SchemeX25519AESGCM:
+		if _, ok := pubKey.(*ecdh.PublicKey); !ok {
+			return fmt.Errorf("scheme %s requires an X25519 key", scheme)
+		}
+	default:
+		return fmt.Errorf("unknown encryption scheme %q", scheme)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pubKey = pubKey
+	e.keyID = keyID
+	e.session = nil
+	return nil
+}
+
+// newSession generates a new session key and encrypts it for the server.
+// For the X25519 scheme, the session key is derived from a new ephemeral key.
+func (e *DefaultEncryptor) newSession() (*session, error) {
+	scheme := e.scheme
+	if scheme == "" {
+		scheme = DefaultScheme(e.pubKey)
+	}
+	s := &session{
+		key:     EncryptedKey{KeyID: e.keyID, Scheme: scheme},
+		expires: e.now().Add(e.ttl),
+	}
+	var encryptedKey []byte
+	switch pubKey := e.pubKey.(type) {
+	case *rsa.PublicKey:
+		s.key.aesKey = make([]byte, 32)
+		if _, err := rand.Read(s.key.aesKey); err != nil {
+			return nil, fmt.Errorf("failed to generate random AES key: %w", err)
+		}
+		var err error
+		if scheme == SchemeRSAOAEP {
+			encryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, s.key.aesKey, nil)
+		} else {
+			encryptedKey, err = rsa.EncryptPKCS1v15(rand.Reader, pubKey, s.key.aesKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case *ecdh.PublicKey:
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+		}
+		sharedSecret, err := ephemeral.ECDH(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey = ephemeral.PublicKey().Bytes()
+		s.key.aesKey, err = DeriveX25519Key(sharedSecret, encryptedKey, pubKey.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnsupportedKey
+	}
+	s.key.Key = base64.StdEncoding.EncodeToString(encryptedKey)
+	return s, nil
+}
+
+// currentSession returns the session to encrypt the next message with, starting a new one when it has expired.
+func (e *DefaultEncryptor) currentSession() (*session, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != nil && e.ttl > 0 && e.now().Before(e.session.expires) {
+		return e.session, nil
+	}
+	s, err := e.newSession()
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode(keyData)
-	if block == nil || block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("failed to decode PEM block containing the public key")
+	e.session = s
+	return s, nil
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %w", path, err)
 	}
+	return ParsePublicKeyPEM(keyData)
+}
 
-	cert, err := x509.ParseCertificate(block.Bytes)
+// KeyID returns the identifier of a public key: the beginning of the hex encoded
+// SHA-256 digest of its PKIX encoding. The agent sends it along with the encrypted key,
+// so that the server can pick the matching private key.
+func KeyID(pubKey any) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
 	}
+	digest := sha256.Sum256(der)
+	return hex.EncodeToString(digest[:8]), nil
+}
 
-	rsaPub, ok := cert.PublicKey.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("not an RSA public key")
+// Encrypt encrypts the data with the current session key and returns the ciphertext
+// along with the encrypted session key the server needs to decrypt it.
+func (e *DefaultEncryptor) Encrypt(data []byte) ([]byte, EncryptedKey, error) {
+	s, err := e.currentSession()
+	if err != nil {
+		return nil, EncryptedKey{}, err
 	}
-	encryptor, err := NewDefaultEncryptor(rsaPub)
+	ciphertext, err := SealAESGCM(s.key.aesKey, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create encryptor: %w", err)
+		return nil, EncryptedKey{}, err
 	}
-	return encryptor, nil
+	return ciphertext, s.key, nil
 }
 
-func (e *DefaultEncryptor) Encrypt(data []byte) ([]byte, error) {
+// Decrypt decrypts the server response encrypted with the session key of the request.
+func (e *DefaultEncryptor) Decrypt(data []byte, key EncryptedKey) ([]byte, error) {
+	if key.aesKey == nil {
+		return nil, errors.New("session key is not known")
+	}
+	return OpenAESGCM(key.aesKey, data)
+}
+
+// SealAESGCM encrypts the data with AES-GCM. The random nonce is prepended to the ciphertext.
+func SealAESGCM(key []byte, data []byte) ([]byte, error) {
 	// Create a new AES cipher block
-	block, err := aes.NewCipher(e.aesKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -80,14 +267,26 @@ func (e *DefaultEncryptor) Encrypt(data []byte) ([]byte, error) {
 
 	// Encrypt the plaintext and append the nonce at the beginning of the ciphertext.
 	// GCM seals and adds an authentication tag automatically.
-	ciphertext := aesGCM.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return aesGCM.Seal(nonce, nonce, data, nil), nil
 }
 
-func (e *DefaultEncryptor) GetEncryptedKey() (string, error) {
-	encryptedAESKey, err := rsa.EncryptPKCS1v15(rand.Reader, e.pubKey, e.aesKey)
+// OpenAESGCM decrypts the data encrypted by SealAESGCM and returns the plaintext.
+func OpenAESGCM(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return base64.StdEncoding.EncodeToString(encryptedAESKey), nil
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, nil)
 }
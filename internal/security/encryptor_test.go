@@ -0,0 +1,77 @@
+package security
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDefaultEncryptor_SchemeMismatch(t *testing.T) {
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = NewDefaultEncryptor(x25519Key.PublicKey(), SchemeRSAOAEP)
+	assert.Error(t, err)
+
+	encryptor, err := NewDefaultEncryptor(x25519Key.PublicKey(), "")
+	require.NoError(t, err)
+	_, key, err := encryptor.Encrypt([]byte("data"))
+	require.NoError(t, err)
+	assert.Equal(t, SchemeX25519AESGCM, key.Scheme)
+}
+
+func TestDefaultEncryptor_SessionKeyRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	t.Run("session key is reused until it expires", func(t *testing.T) {
+		encryptor, err := NewDefaultEncryptor(&rsaKey.PublicKey, SchemeRSAOAEP, WithSessionKeyTTL(time.Minute))
+		require.NoError(t, err)
+		now := time.Now()
+		encryptor.now = func() time.Time { return now }
+
+		_, first, err := encryptor.Encrypt([]byte("first"))
+		require.NoError(t, err)
+		_, second, err := encryptor.Encrypt([]byte("second"))
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+
+		now = now.Add(2 * time.Minute)
+		_, third, err := encryptor.Encrypt([]byte("third"))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.Key, third.Key)
+		assert.Equal(t, first.KeyID, third.KeyID)
+	})
+
+	t.Run("new session key per message", func(t *testing.T) {
+		encryptor, err := NewDefaultEncryptor(&rsaKey.PublicKey, "", WithSessionKeyTTL(0))
+		require.NoError(t, err)
+
+		_, first, err := encryptor.Encrypt([]byte("first"))
+		require.NoError(t, err)
+		_, second, err := encryptor.Encrypt([]byte("second"))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.Key, second.Key)
+		assert.Equal(t, SchemeRSAPKCS1v15, first.Scheme)
+	})
+
+	t.Run("server key change ends the session", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		encryptor, err := NewDefaultEncryptor(&rsaKey.PublicKey, "")
+		require.NoError(t, err)
+
+		_, first, err := encryptor.Encrypt([]byte("first"))
+		require.NoError(t, err)
+		require.NoError(t, encryptor.setKey(&otherKey.PublicKey))
+		_, second, err := encryptor.Encrypt([]byte("second"))
+		require.NoError(t, err)
+		assert.NotEqual(t, first.KeyID, second.KeyID)
+		assert.NotEqual(t, first.Key, second.Key)
+	})
+}
@@ -3,6 +3,7 @@ package security
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 )
@@ -33,3 +34,24 @@ func (hs *DefaultHasher) Hash(value []byte) (string, error) {
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
+
+// SignedPayload returns the data covered by the request signature: the request timestamp
+// and nonce followed by the body. Including them in the signature prevents the request
+// from being replayed with a different timestamp or nonce.
+func SignedPayload(timestamp, nonce string, body []byte) []byte {
+	payload := make([]byte, 0, len(timestamp)+len(nonce)+len(body)+2)
+	payload = append(payload, timestamp...)
+	payload = append(payload, '\n')
+	payload = append(payload, nonce...)
+	payload = append(payload, '\n')
+	return append(payload, body...)
+}
+
+// NewNonce returns a random hex encoded nonce identifying a single request.
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
@@ -0,0 +1,146 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encryption schemes used to transfer the AES key to the server. The scheme is sent in the X-Encryption-Scheme header.
+const (
+	// SchemeRSAPKCS1v15 encrypts the AES key with RSA PKCS #1 v1.5, it is assumed when the header is missing.
+	SchemeRSAPKCS1v15 = "rsa-pkcs1v15"
+	// SchemeRSAOAEP encrypts the AES key with RSA-OAEP using SHA-256.
+	SchemeRSAOAEP = "rsa-oaep"
+	// SchemeX25519AESGCM derives the AES key from an X25519 key agreement between an ephemeral agent key
+	// and the server key; the ephemeral public key is sent instead of an encrypted key.
+	SchemeX25519AESGCM = "x25519-aes-gcm"
+)
+
+var errUnsupportedKey = errors.New("unsupported key type, RSA or X25519 key expected")
+
+// ParsePublicKeyPEM parses an RSA or X25519 public key from PEM data.
+// It accepts an X.509 CERTIFICATE, a PKIX PUBLIC KEY and a PKCS #1 RSA PUBLIC KEY.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing the public key")
+	}
+	var pubKey crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		pubKey = cert.PublicKey
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		pubKey = key
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		pubKey = key
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case *ecdh.PublicKey:
+		if key.Curve() == ecdh.X25519() {
+			return key, nil
+		}
+	}
+	return nil, errUnsupportedKey
+}
+
+// ParsePrivateKeyPEM parses an RSA or X25519 private key from PEM data.
+// It accepts a PKCS #1 RSA PRIVATE KEY and a PKCS #8 PRIVATE KEY.
+func ParsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing the key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %w", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %w", err)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdh.PrivateKey:
+			if key.Curve() == ecdh.X25519() {
+				return key, nil
+			}
+		}
+		return nil, errUnsupportedKey
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
+
+// ReadPrivateKey reads an RSA or X25519 private key from a PEM file.
+func ReadPrivateKey(path string) (crypto.PrivateKey, error) {
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key file: %w", err)
+	}
+	return ParsePrivateKeyPEM(keyData)
+}
+
+// PublicKey returns the public key of an RSA or X25519 private key.
+func PublicKey(privateKey crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey, nil
+	case *ecdh.PrivateKey:
+		return key.PublicKey(), nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+// DefaultScheme returns the encryption scheme used for the key when none is configured.
+// RSA keys keep PKCS #1 v1.5 for compatibility with the servers not knowing the newer schemes.
+func DefaultScheme(pubKey crypto.PublicKey) string {
+	if _, ok := pubKey.(*ecdh.PublicKey); ok {
+		return SchemeX25519AESGCM
+	}
+	return SchemeRSAPKCS1v15
+}
+
+// DeriveX25519Key derives the AES-256 key from the X25519 shared secret with HKDF-SHA256.
+// Both public keys are bound into the derivation.
+func DeriveX25519Key(sharedSecret, ephemeralPub, recipientPub []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeralPub)+len(recipientPub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, recipientPub...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, salt, []byte(SchemeX25519AESGCM)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,89 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePublicKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metrica"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+	require.NoError(t, err)
+	rsaPKIX, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	x25519PKIX, err := x509.MarshalPKIXPublicKey(x25519Key.PublicKey())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		block *pem.Block
+		want  any
+	}{
+		{name: "certificate", block: &pem.Block{Type: "CERTIFICATE", Bytes: certDER}, want: &rsaKey.PublicKey},
+		{name: "pkix rsa public key", block: &pem.Block{Type: "PUBLIC KEY", Bytes: rsaPKIX}, want: &rsaKey.PublicKey},
+		{name: "pkcs1 rsa public key", block: &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}, want: &rsaKey.PublicKey},
+		{name: "pkix x25519 public key", block: &pem.Block{Type: "PUBLIC KEY", Bytes: x25519PKIX}, want: x25519Key.PublicKey()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pubKey, err := ParsePublicKeyPEM(pem.EncodeToMemory(tt.block))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, pubKey)
+		})
+	}
+
+	t.Run("unexpected block", func(t *testing.T) {
+		_, err := ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte{1}}))
+		assert.Error(t, err)
+	})
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+	x25519PKCS8, err := x509.MarshalPKCS8PrivateKey(x25519Key)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		block *pem.Block
+		want  any
+	}{
+		{name: "pkcs1 rsa private key", block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, want: rsaKey},
+		{name: "pkcs8 rsa private key", block: &pem.Block{Type: "PRIVATE KEY", Bytes: rsaPKCS8}, want: rsaKey},
+		{name: "pkcs8 x25519 private key", block: &pem.Block{Type: "PRIVATE KEY", Bytes: x25519PKCS8}, want: x25519Key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			privateKey, err := ParsePrivateKeyPEM(pem.EncodeToMemory(tt.block))
+			require.NoError(t, err)
+			assert.True(t, tt.want.(interface{ Equal(crypto.PrivateKey) bool }).Equal(privateKey))
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package security
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// WatchFiles calls onChange when the process receives SIGHUP or when one of the files
+// is modified, which is detected by polling the files every interval. It returns when the context is canceled.
+func WatchFiles(ctx context.Context, interval time.Duration, onChange func(), paths ...string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	states := fileStates(paths)
+	for {
+		select {
+		case <-hup:
+			states = fileStates(paths)
+			onChange()
+		case <-ticker.C:
+			current := fileStates(paths)
+			if current != states {
+				states = current
+				onChange()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileStates returns a string describing the modification time and size of the files.
+// Missing files are included too, so that a file being replaced is noticed once it reappears.
+func fileStates(paths []string) string {
+	var states []byte
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			states = append(states, "missing;"...)
+			continue
+		}
+		states = info.ModTime().AppendFormat(states, time.RFC3339Nano)
+		states = append(states, ' ')
+		states = strconv.AppendInt(states, info.Size(), 10)
+		states = append(states, ';')
+	}
+	return string(states)
+}
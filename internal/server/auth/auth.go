@@ -0,0 +1,182 @@
+// Package auth provides the bearer token authentication of the API clients and the scopes granted to them.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a permission granted to a token.
+type Scope string
+
+const (
+	// ScopeRead allows reading metrics: /value* and /.
+	ScopeRead Scope = "read"
+	// ScopeWrite allows updating metrics: /update*.
+	ScopeWrite Scope = "write"
+	// ScopeAdmin allows everything, including the profiler and the management endpoints.
+	ScopeAdmin Scope = "admin"
+)
+
+// ErrTokenNotFound is returned when the token is not known.
+var ErrTokenNotFound = errors.New("token not found")
+
+// Token describes an API token. Only the hash of the token secret is kept.
+type Token struct {
+	Name   string
+	Hash   string
+	Scopes []Scope
+}
+
+// Allows reports whether the token is granted the scope. The admin scope grants every scope.
+func (t *Token) Allows(scope Scope) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// ParseScopes parses a list of scopes separated by "+", e.g. "read+write".
+func ParseScopes(value string) ([]Scope, error) {
+	var scopes []Scope
+	for _, s := range strings.Split(value, "+") {
+		scope := Scope(strings.TrimSpace(s))
+		switch scope {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return scopes, nil
+}
+
+// FormatScopes formats the scopes the way ParseScopes accepts them.
+func FormatScopes(scopes []Scope) string {
+	values := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		values = append(values, string(scope))
+	}
+	return strings.Join(values, "+")
+}
+
+// ParseStaticToken parses a token given in the configuration as name:scopes:secret, e.g. dashboard:read:s3cr3t.
+func ParseStaticToken(value string) (Token, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return Token{}, errors.New("token must be given as name:scopes:secret")
+	}
+	scopes, err := ParseScopes(parts[1])
+	if err != nil {
+		return Token{}, err
+	}
+	return Token{Name: parts[0], Hash: HashToken(parts[2]), Scopes: scopes}, nil
+}
+
+// HashToken returns the hex encoded SHA-256 digest of the token secret.
+func HashToken(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+// GenerateToken returns a new random token secret.
+func GenerateToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "mtr_" + hex.EncodeToString(secret), nil
+}
+
+// RequiredScope returns the scope needed to access the path.
+func RequiredScope(path string) Scope {
+	switch {
+	case strings.HasPrefix(path, "/update"), path == "/v1/metrics":
+		return ScopeWrite
+	case path == "/", path == "/ping", strings.HasPrefix(path, "/value"):
+		return ScopeRead
+	default:
+		return ScopeAdmin
+	}
+}
+
+type tokenStore interface {
+	FindByHash(ctx context.Context, hash string) (*Token, error)
+}
+
+// Authenticator checks the token secrets against the static tokens from the configuration
+// and the token stores. Tokens found in the stores are cached for a short time.
+type Authenticator struct {
+	static   map[string]*Token
+	stores   []tokenStore
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	cache    map[string]cachedToken
+}
+
+type cachedToken struct {
+	token   *Token
+	expires time.Time
+}
+
+// NewAuthenticator creates a new Authenticator for the static tokens and the token stores.
+func NewAuthenticator(static []Token, stores ...tokenStore) *Authenticator {
+	a := &Authenticator{
+		static:   make(map[string]*Token, len(static)),
+		stores:   stores,
+		cacheTTL: 30 * time.Second,
+		cache:    make(map[string]cachedToken),
+	}
+	for i := range static {
+		a.static[static[i].Hash] = &static[i]
+	}
+	return a
+}
+
+// Authenticate returns the token matching the secret or ErrTokenNotFound.
+func (a *Authenticator) Authenticate(ctx context.Context, secret string) (*Token, error) {
+	hash := HashToken(secret)
+	if token, ok := a.static[hash]; ok {
+		return token, nil
+	}
+
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	for _, store := range a.stores {
+		token, err := store.FindByHash(ctx, hash)
+		if errors.Is(err, ErrTokenNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.cache[hash] = cachedToken{token: token, expires: time.Now().Add(a.cacheTTL)}
+		a.mu.Unlock()
+		return token, nil
+	}
+	return nil, ErrTokenNotFound
+}
+
+type tokenKey struct{}
+
+// WithToken returns a copy of the context carrying the authenticated token.
+func WithToken(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFromContext returns the token authenticated for the request.
+func TokenFromContext(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(tokenKey{}).(*Token)
+	return token, ok
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type MockTokenStore struct {
+	mock.Mock
+}
+
+func (m *MockTokenStore) FindByHash(ctx context.Context, hash string) (*Token, error) {
+	args := m.Called(ctx, hash)
+	token, _ := args.Get(0).(*Token)
+	return token, args.Error(1)
+}
+
+func TestParseStaticToken(t *testing.T) {
+	token, err := ParseStaticToken("dashboard:read+write:s3:cr3t")
+	require.NoError(t, err)
+	assert.Equal(t, Token{Name: "dashboard", Hash: HashToken("s3:cr3t"), Scopes: []Scope{ScopeRead, ScopeWrite}}, token)
+
+	_, err = ParseStaticToken("dashboard:read")
+	assert.Error(t, err)
+	_, err = ParseStaticToken("dashboard:root:secret")
+	assert.Error(t, err)
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		path string
+		want Scope
+	}{
+		{path: "/update/counter/test/1", want: ScopeWrite},
+		{path: "/update/", want: ScopeWrite},
+		{path: "/updates/", want: ScopeWrite},
+		{path: "/v1/metrics", want: ScopeWrite},
+		{path: "/value/gauge/test", want: ScopeRead},
+		{path: "/value/", want: ScopeRead},
+		{path: "/", want: ScopeRead},
+		{path: "/ping", want: ScopeRead},
+		{path: "/debug/pprof/heap", want: ScopeAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, RequiredScope(tt.path))
+		})
+	}
+}
+
+func TestToken_Allows(t *testing.T) {
+	reader := &Token{Scopes: []Scope{ScopeRead}}
+	assert.True(t, reader.Allows(ScopeRead))
+	assert.False(t, reader.Allows(ScopeWrite))
+
+	admin := &Token{Scopes: []Scope{ScopeAdmin}}
+	assert.True(t, admin.Allows(ScopeRead))
+	assert.True(t, admin.Allows(ScopeWrite))
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	static, err := ParseStaticToken("agent:write:static-secret")
+	require.NoError(t, err)
+	stored := &Token{Name: "dashboard", Hash: HashToken("stored-secret"), Scopes: []Scope{ScopeRead}}
+
+	store := new(MockTokenStore)
+	store.On("FindByHash", ctx, stored.Hash).Return(stored, nil).Once()
+	store.On("FindByHash", ctx, HashToken("unknown")).Return(nil, ErrTokenNotFound)
+	authenticator := NewAuthenticator([]Token{static}, store)
+
+	token, err := authenticator.Authenticate(ctx, "static-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "agent", token.Name)
+
+	// the stored token is looked up once and then cached
+	for i := 0; i < 2; i++ {
+		token, err = authenticator.Authenticate(ctx, "stored-secret")
+		require.NoError(t, err)
+		assert.Equal(t, stored, token)
+	}
+
+	_, err = authenticator.Authenticate(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+	store.AssertExpectations(t)
+}
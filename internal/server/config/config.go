@@ -8,8 +8,10 @@ import (
 	"fmt"
 	"github.com/caarlos0/env/v10"
 	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/quota"
 	"go.uber.org/zap"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -19,16 +21,104 @@ type Config struct {
 	Address string `env:"ADDRESS" json:"address"`
 	// StoreInterval is interval in seconds to save current server metrics to disk
 	StoreInterval Duration `env:"STORE_INTERVAL" json:"store_interval"`
+	// CompactInterval is interval to compact the write-ahead log into a snapshot when StoreInterval is zero
+	CompactInterval Duration `env:"COMPACT_INTERVAL" json:"compact_interval"`
 	// FileStoragePath is full path to file where server metrics will be saved to/loaded from
 	FileStoragePath string `env:"FILE_STORAGE_PATH" json:"store_file"`
 	// Restore is a flag to indicate whether to load previously saved metrics from file on server start or not
 	Restore bool `env:"RESTORE" json:"restore"`
 	// DatabaseDsn is a string to connect to the database
 	DatabaseDsn string `env:"DATABASE_DSN" json:"database_dsn"`
+	// DatabaseReplicaDsns are strings to connect to the read replicas of the database
+	DatabaseReplicaDsns []string `env:"DATABASE_REPLICA_DSNS" envSeparator:"," json:"database_replica_dsns"`
+	// SampleRetention is how long the metric samples history is kept in the database
+	SampleRetention Duration `env:"SAMPLE_RETENTION" json:"sample_retention"`
+	// BoltPath is a path to the embedded database file used when no database dsn is provided
+	BoltPath string `env:"BOLT_PATH" json:"bolt_path"`
 	// Key is a secret key used by the hash checker middleware
 	Key string `env:"KEY" json:"-"`
+	// APITokens are the static API tokens given as name:scopes:secret, e.g. dashboard:read:s3cr3t
+	APITokens []string `env:"API_TOKENS" envSeparator:"," json:"api_tokens"`
+	// RequireAuth requires a bearer token for every request even when no static tokens are configured
+	RequireAuth bool `env:"REQUIRE_AUTH" json:"require_auth"`
+	// RequestsPerSecond is the rate of requests allowed for each client, zero disables the limit
+	RequestsPerSecond float64 `env:"REQUESTS_PER_SECOND" json:"requests_per_second"`
+	// RequestBurst is the number of requests each client may send at once
+	RequestBurst int `env:"REQUEST_BURST" json:"request_burst"`
+	// MetricsPerSecond is the rate of metric updates allowed for each client, zero disables the limit
+	MetricsPerSecond float64 `env:"METRICS_PER_SECOND" json:"metrics_per_second"`
+	// MetricsBurst is the number of metric updates each client may send at once
+	MetricsBurst int `env:"METRICS_BURST" json:"metrics_burst"`
+	// MaxMetricNames is the number of distinct metric names each client may write, zero disables the limit
+	MaxMetricNames int `env:"MAX_METRIC_NAMES" json:"max_metric_names"`
+	// ClientIdleTimeout is the time after which the quota state of an idle client is dropped
+	ClientIdleTimeout Duration `env:"CLIENT_IDLE_TIMEOUT" json:"client_idle_timeout"`
+	// MaxNameLength is the maximum length of a metric name, zero disables the limit
+	MaxNameLength int `env:"MAX_NAME_LENGTH" json:"max_name_length"`
+	// NamePattern is the regular expression every metric name must match, empty disables the check
+	NamePattern string `env:"NAME_PATTERN" json:"name_pattern"`
+	// MaxBatchSize is the maximum number of metrics in a single batch, zero disables the limit
+	MaxBatchSize int `env:"MAX_BATCH_SIZE" json:"max_batch_size"`
+	// MaxBodyBytes is the maximum size of a request body in bytes, zero disables the limit
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES" json:"max_body_bytes"`
+	// MaxStreamBytes is the maximum size of a streamed updates body in bytes, zero disables the limit.
+	// A signed or encrypted stream is held in memory as a whole, so the limit bounds the memory it takes
+	MaxStreamBytes int64 `env:"MAX_STREAM_BYTES" json:"max_stream_bytes"`
+	// MaxSeries is the maximum number of distinct metrics stored by the server, zero disables the limit
+	MaxSeries int `env:"MAX_SERIES" json:"max_series"`
+	// CompressionLevel is the level the responses are compressed with: fastest, default or best
+	CompressionLevel string `env:"COMPRESSION_LEVEL" json:"compression_level"`
+	// ReplayWindow is the allowed clock skew of signed requests, the replay protection is disabled when it is zero.
+	// It requires the signing key.
+	ReplayWindow Duration `env:"REPLAY_WINDOW" json:"replay_window"`
 	// CryptoKey is a path to the private key to decrypt message received from the agent
 	CryptoKey string `env:"CRYPTO_KEY" json:"crypto_key"`
+	// ExtraCryptoKeys are paths to additional private keys accepted while the keys are being rotated
+	ExtraCryptoKeys []string `env:"EXTRA_CRYPTO_KEYS" envSeparator:"," json:"extra_crypto_keys"`
+	// TLSCert is a path to the server certificate, the server accepts only TLS connections when it is set
+	TLSCert string `env:"TLS_CERT" json:"tls_cert"`
+	// TLSKey is a path to the private key of the server certificate
+	TLSKey string `env:"TLS_KEY" json:"tls_key"`
+	// TLSClientCA is a path to the CA bundle used to verify the agents client certificates
+	TLSClientCA string `env:"TLS_CLIENT_CA" json:"tls_client_ca"`
+	// OTLPEndpoint is the URL of the OpenTelemetry collector the metrics are exported to, empty disables the export
+	OTLPEndpoint string `env:"OTLP_ENDPOINT" json:"otlp_endpoint"`
+	// OTLPMode is the way the metrics are exported: push the current values periodically or forward every update
+	OTLPMode string `env:"OTLP_MODE" json:"otlp_mode"`
+	// OTLPInterval is how often the metrics are pushed or the forwarded updates are flushed
+	OTLPInterval Duration `env:"OTLP_INTERVAL" json:"otlp_interval"`
+	// OTLPBatchSize is the maximum number of data points in an export request, zero disables the limit
+	OTLPBatchSize int `env:"OTLP_BATCH_SIZE" json:"otlp_batch_size"`
+	// OTLPQueueSize is the number of forwarded updates waiting to be exported, the updates above it are dropped
+	OTLPQueueSize int `env:"OTLP_QUEUE_SIZE" json:"otlp_queue_size"`
+	// OTLPTimeout bounds a single export request
+	OTLPTimeout Duration `env:"OTLP_TIMEOUT" json:"otlp_timeout"`
+	// OTLPHeaders are the headers added to the export requests given as key=value, e.g. the collector credentials
+	OTLPHeaders []string `env:"OTLP_HEADERS" envSeparator:"," json:"-"`
+	// OTLPServiceName is the service.name resource attribute of the exported metrics
+	OTLPServiceName string `env:"OTLP_SERVICE_NAME" json:"otlp_service_name"`
+	// ForwardAddress is the address of the upstream metrica server the updates are forwarded to, empty disables it
+	ForwardAddress string `env:"FORWARD_ADDRESS" json:"forward_address"`
+	// ForwardMode is the way the updates are forwarded: aggregate over the interval or raw
+	ForwardMode string `env:"FORWARD_MODE" json:"forward_mode"`
+	// ForwardInterval is how often the updates are forwarded
+	ForwardInterval Duration `env:"FORWARD_INTERVAL" json:"forward_interval"`
+	// ForwardBatchSize is the maximum number of metrics in a forwarded batch, zero disables the limit
+	ForwardBatchSize int `env:"FORWARD_BATCH_SIZE" json:"forward_batch_size"`
+	// ForwardBufferDir is the directory the batches are buffered in while the upstream is down
+	ForwardBufferDir string `env:"FORWARD_BUFFER_DIR" json:"forward_buffer_dir"`
+	// ForwardMaxBufferBytes is the size of the buffered batches above which the oldest ones are dropped
+	ForwardMaxBufferBytes int64 `env:"FORWARD_MAX_BUFFER_BYTES" json:"forward_max_buffer_bytes"`
+	// ForwardKey is a secret key the forwarded batches are signed with
+	ForwardKey string `env:"FORWARD_KEY" json:"-"`
+	// ForwardCryptoKey is a path to the public key of the upstream the forwarded batches are encrypted with
+	ForwardCryptoKey string `env:"FORWARD_CRYPTO_KEY" json:"forward_crypto_key"`
+	// ForwardToken is the bearer token sent to the upstream
+	ForwardToken string `env:"FORWARD_TOKEN" json:"-"`
+	// EdgeName is the name of this server the forwarded series are marked with
+	EdgeName string `env:"EDGE_NAME" json:"edge_name"`
+	// EdgeNaming is the way the forwarded series are marked with the edge name: none, prefix or label
+	EdgeNaming string `env:"EDGE_NAMING" json:"edge_naming"`
 }
 
 type Duration struct {
@@ -68,11 +158,66 @@ func ParseConfig() Config {
 
 	flag.StringVar(&cnf.Address, "a", "localhost:8080", "адрес эндпоинта HTTP-сервера")
 	flag.DurationVar(&cnf.StoreInterval.Duration, "i", 3*time.Second, "интервал времени в секундах, по истечении которого текущие показания сервера сохраняются на диск")
+	flag.DurationVar(&cnf.CompactInterval.Duration, "compact-interval", time.Minute, "интервал сжатия журнала предзаписи в снимок")
 	flag.StringVar(&cnf.FileStoragePath, "f", "/tmp/metrics-db.json", "полное имя файла, куда сохраняются текущие значения")
 	flag.BoolVar(&cnf.Restore, "r", true, "загружать или нет ранее сохранённые значения из указанного файла при старте сервера")
 	flag.StringVar(&cnf.DatabaseDsn, "d", "", "Строка с адресом подключения к БД")
+	flag.Func("replica-dsn", "Строки с адресами подключения к репликам БД через запятую", func(value string) error {
+		cnf.DatabaseReplicaDsns = append(cnf.DatabaseReplicaDsns, strings.Split(value, ",")...)
+		return nil
+	})
+	flag.DurationVar(&cnf.SampleRetention.Duration, "sample-retention", 7*24*time.Hour, "срок хранения истории метрик в БД")
+	flag.StringVar(&cnf.BoltPath, "b", "", "путь до файла встроенной базы данных")
 	flag.StringVar(&cnf.Key, "k", "", "Ключ")
+	flag.Func("api-token", "статический токен API в виде имя:права:секрет, права через +", func(value string) error {
+		cnf.APITokens = append(cnf.APITokens, value)
+		return nil
+	})
+	flag.BoolVar(&cnf.RequireAuth, "require-auth", false, "требовать токен API для всех запросов")
+	flag.Float64Var(&cnf.RequestsPerSecond, "requests-per-second", 0, "допустимая частота запросов одного клиента, 0 - без ограничений")
+	flag.IntVar(&cnf.RequestBurst, "request-burst", 0, "допустимое число одновременных запросов одного клиента")
+	flag.Float64Var(&cnf.MetricsPerSecond, "metrics-per-second", 0, "допустимая частота обновления метрик одного клиента, 0 - без ограничений")
+	flag.IntVar(&cnf.MetricsBurst, "metrics-burst", 0, "допустимое число метрик в одном запросе клиента")
+	flag.IntVar(&cnf.MaxMetricNames, "max-metric-names", 0, "допустимое число различных метрик одного клиента, 0 - без ограничений")
+	flag.DurationVar(&cnf.ClientIdleTimeout.Duration, "client-idle-timeout", quota.DefaultIdleTimeout, "время, после которого сбрасываются лимиты неактивного клиента")
+	flag.IntVar(&cnf.MaxNameLength, "max-name-length", 0, "максимальная длина имени метрики, 0 - без ограничений")
+	flag.StringVar(&cnf.NamePattern, "name-pattern", "", "регулярное выражение для имён метрик, пустое значение отключает проверку")
+	flag.IntVar(&cnf.MaxBatchSize, "max-batch-size", 0, "максимальное число метрик в одном пакете, 0 - без ограничений")
+	flag.Int64Var(&cnf.MaxBodyBytes, "max-body-bytes", 10<<20, "максимальный размер тела запроса в байтах, 0 - без ограничений")
+	flag.Int64Var(&cnf.MaxStreamBytes, "max-stream-bytes", 1<<30, "максимальный размер потока обновлений в байтах, 0 - без ограничений")
+	flag.IntVar(&cnf.MaxSeries, "max-series", 0, "максимальное число хранимых метрик, 0 - без ограничений")
+	flag.StringVar(&cnf.CompressionLevel, "compression-level", "default", "уровень сжатия ответов: fastest, default или best")
+	flag.DurationVar(&cnf.ReplayWindow.Duration, "replay-window", 0, "допустимое расхождение времени подписанных запросов, 0 отключает защиту от повторов")
 	flag.StringVar(&cnf.CryptoKey, "crypto-key", "", "путь до файла с приватным ключом")
+	flag.Func("extra-crypto-key", "пути до файлов с дополнительными приватными ключами через запятую", func(value string) error {
+		cnf.ExtraCryptoKeys = append(cnf.ExtraCryptoKeys, strings.Split(value, ",")...)
+		return nil
+	})
+	flag.StringVar(&cnf.TLSCert, "tls-cert", "", "путь до файла с сертификатом сервера")
+	flag.StringVar(&cnf.TLSKey, "tls-key", "", "путь до файла с приватным ключом сертификата сервера")
+	flag.StringVar(&cnf.TLSClientCA, "tls-client-ca", "", "путь до файла с корневыми сертификатами для проверки сертификатов агентов")
+	flag.StringVar(&cnf.OTLPEndpoint, "otlp-endpoint", "", "адрес коллектора OpenTelemetry для экспорта метрик, например http://localhost:4318/v1/metrics")
+	flag.StringVar(&cnf.OTLPMode, "otlp-mode", "push", "режим экспорта метрик: push - периодически, forward - каждое обновление")
+	flag.DurationVar(&cnf.OTLPInterval.Duration, "otlp-interval", 10*time.Second, "интервал экспорта метрик")
+	flag.IntVar(&cnf.OTLPBatchSize, "otlp-batch-size", 1000, "максимальное число точек в одном запросе экспорта, 0 - без ограничений")
+	flag.IntVar(&cnf.OTLPQueueSize, "otlp-queue-size", 10000, "размер очереди обновлений для экспорта")
+	flag.DurationVar(&cnf.OTLPTimeout.Duration, "otlp-timeout", 10*time.Second, "таймаут запроса экспорта")
+	flag.Func("otlp-header", "заголовок запросов экспорта в виде ключ=значение", func(value string) error {
+		cnf.OTLPHeaders = append(cnf.OTLPHeaders, value)
+		return nil
+	})
+	flag.StringVar(&cnf.OTLPServiceName, "otlp-service-name", "metrica", "имя сервиса экспортируемых метрик")
+	flag.StringVar(&cnf.ForwardAddress, "forward-address", "", "адрес вышестоящего сервера metrica для пересылки обновлений")
+	flag.StringVar(&cnf.ForwardMode, "forward-mode", "aggregate", "режим пересылки: aggregate - агрегированные за интервал, raw - каждое обновление")
+	flag.DurationVar(&cnf.ForwardInterval.Duration, "forward-interval", 10*time.Second, "интервал пересылки обновлений")
+	flag.IntVar(&cnf.ForwardBatchSize, "forward-batch-size", 1000, "максимальное число метрик в одном пакете пересылки, 0 - без ограничений")
+	flag.StringVar(&cnf.ForwardBufferDir, "forward-buffer-dir", "", "директория для буферизации пакетов, пока вышестоящий сервер недоступен")
+	flag.Int64Var(&cnf.ForwardMaxBufferBytes, "forward-max-buffer-bytes", 100<<20, "максимальный размер буфера пересылки в байтах, 0 - без ограничений")
+	flag.StringVar(&cnf.ForwardKey, "forward-key", "", "ключ подписи пересылаемых пакетов")
+	flag.StringVar(&cnf.ForwardCryptoKey, "forward-crypto-key", "", "путь до файла с публичным ключом вышестоящего сервера")
+	flag.StringVar(&cnf.ForwardToken, "forward-token", "", "токен API вышестоящего сервера")
+	flag.StringVar(&cnf.EdgeName, "edge-name", "", "имя сервера, которым помечаются пересылаемые метрики")
+	flag.StringVar(&cnf.EdgeNaming, "edge-naming", "none", "способ пометки пересылаемых метрик именем сервера: none, prefix или label")
 	flag.Parse()
 
 	if configPathJSON != "" {
@@ -0,0 +1,394 @@
+// Package exporter pushes the metrics stored by the server to an OpenTelemetry collector over OTLP/HTTP.
+//
+// In the push mode the current values of all the metrics are exported periodically. In the forward mode
+// every update is exported: the exporter observes the repository and queues the updated metrics
+// in a bounded queue, the updates that don't fit in it are dropped. In both modes the metrics are sent
+// in batches with retries. The counters are exported as cumulative monotonic sums and the gauges as gauges,
+// the labels encoded in the series names (see otlp.SeriesName) become the attributes of the data points.
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/retry"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/otlp"
+	"github.com/shadyziedan/metrica/internal/server/storage"
+)
+
+// Mode is the way the metrics are exported.
+type Mode string
+
+const (
+	// ModePush exports the current values of all the metrics every interval
+	ModePush Mode = "push"
+	// ModeForward exports every update of the metrics
+	ModeForward Mode = "forward"
+)
+
+// ParseMode parses the export mode name: push or forward. The empty name means push.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModePush:
+		return ModePush, nil
+	case ModeForward:
+		return ModeForward, nil
+	default:
+		return "", fmt.Errorf("unknown export mode %q", name)
+	}
+}
+
+// The defaults of the Config settings.
+const (
+	DefaultInterval  = 10 * time.Second
+	DefaultQueueSize = 10000
+)
+
+// flushTimeout bounds the export of the queued updates when the exporter stops.
+const flushTimeout = 5 * time.Second
+
+type metricsRepository interface {
+	FindAll(ctx context.Context) ([]*models.Metric, error)
+	Attach(observer storage.MetricsObserver)
+	Detach(observer storage.MetricsObserver)
+}
+
+// Config represents the configuration settings for the Exporter.
+type Config struct {
+	// Endpoint is the URL of the collector metrics endpoint, e.g. http://localhost:4318/v1/metrics
+	Endpoint string
+	// Mode is the way the metrics are exported
+	Mode Mode
+	// Interval is how often the metrics are pushed, in the forward mode how often the partial batch is flushed,
+	// DefaultInterval if it is not positive
+	Interval time.Duration
+	// BatchSize is the maximum number of data points sent in a request, zero means no limit
+	BatchSize int
+	// QueueSize is the number of updates queued in the forward mode, DefaultQueueSize if it is not positive
+	QueueSize int
+	// Timeout bounds a single request to the collector, zero means no timeout
+	Timeout time.Duration
+	// Headers are added to every request, e.g. the collector credentials
+	Headers map[string]string
+	// ServiceName is the service.name attribute of the exported resource
+	ServiceName string
+}
+
+// Option configures the Exporter.
+type Option = func(*Exporter)
+
+// WithRetryPolicy sets the policy of retrying the failed requests, retry.DefaultPolicy is used by default.
+// The policy's IsRetryable defaults to retrying the network errors and the statuses retry.IsRetryableStatus allows.
+func WithRetryPolicy(policy retry.Policy) Option {
+	return func(e *Exporter) {
+		e.retryPolicy = policy
+	}
+}
+
+// WithClient sets the HTTP client the requests are sent with.
+func WithClient(client *http.Client) Option {
+	return func(e *Exporter) {
+		e.client = client
+	}
+}
+
+// Exporter exports the metrics of the repository to an OTLP/HTTP collector.
+type Exporter struct {
+	conf        Config
+	repository  metricsRepository
+	client      *http.Client
+	retryPolicy retry.Policy
+	resource    *resourcepb.Resource
+	start       time.Time
+	now         func() time.Time
+
+	queue   chan models.Metric
+	dropped atomic.Int64
+}
+
+// NewExporter creates a new instance of the Exporter.
+func NewExporter(repository metricsRepository, conf Config, options ...Option) *Exporter {
+	if conf.Interval <= 0 {
+		conf.Interval = DefaultInterval
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = DefaultQueueSize
+	}
+	e := &Exporter{
+		conf:        conf,
+		repository:  repository,
+		client:      &http.Client{Timeout: conf.Timeout},
+		retryPolicy: retry.DefaultPolicy(),
+		now:         time.Now,
+		queue:       make(chan models.Metric, conf.QueueSize),
+	}
+	for _, option := range options {
+		option(e)
+	}
+	if e.retryPolicy.IsRetryable == nil {
+		e.retryPolicy.IsRetryable = isRetryable
+	}
+	if conf.ServiceName != "" {
+		e.resource = &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", conf.ServiceName)}}
+	}
+	e.start = e.now()
+	return e
+}
+
+// Start attaches the exporter to the repository in the forward mode. It must be called before Run,
+// once the repository is restored, so that the exporter gets every update from then on.
+func (e *Exporter) Start() {
+	if e.conf.Mode == ModeForward {
+		e.repository.Attach(e)
+	}
+}
+
+// Run exports the metrics until the context is done.
+func (e *Exporter) Run(ctx context.Context) {
+	if e.conf.Mode == ModeForward {
+		e.forward(ctx)
+		return
+	}
+	ticker := time.NewTicker(e.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.push(ctx); err != nil {
+				logger.Log.Error("Failed to export metrics", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Notify is called by the repository when a metric is updated, it queues the update in the forward mode.
+// It never blocks the update: when the queue is full the update is dropped.
+func (e *Exporter) Notify(metric *models.Metric) error {
+	update := models.Metric{Name: metric.Name, MType: metric.MType}
+	if metric.Gauge != nil {
+		value := *metric.Gauge
+		update.Gauge = &value
+	}
+	if metric.Counter != nil {
+		value := *metric.Counter
+		update.Counter = &value
+	}
+	select {
+	case e.queue <- update:
+	default:
+		e.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped returns the number of the updates dropped because the queue was full.
+func (e *Exporter) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+func (e *Exporter) push(ctx context.Context) error {
+	metrics, err := e.repository.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return e.export(ctx, metrics)
+}
+
+// forward exports the queued updates. The updates of a series waiting in the same batch are coalesced,
+// only its last value is sent. The batch is sent when it is full or every interval.
+func (e *Exporter) forward(ctx context.Context) {
+	ticker := time.NewTicker(e.conf.Interval)
+	defer ticker.Stop()
+	pending := make(map[string]*models.Metric)
+	var reported int64
+	flush := func(ctx context.Context) {
+		if dropped := e.dropped.Load(); dropped > reported {
+			logger.Log.Warn("Export queue is full, updates dropped", zap.Int64("dropped", dropped-reported))
+			reported = dropped
+		}
+		if len(pending) == 0 {
+			return
+		}
+		metrics := make([]*models.Metric, 0, len(pending))
+		for _, metric := range pending {
+			metrics = append(metrics, metric)
+		}
+		clear(pending)
+		if err := e.export(ctx, metrics); err != nil {
+			logger.Log.Error("Failed to export metrics", zap.Error(err))
+		}
+	}
+	for {
+		select {
+		case update := <-e.queue:
+			pending[update.Name] = &update
+			if e.conf.BatchSize > 0 && len(pending) >= e.conf.BatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			// the queued updates are exported before stopping
+			e.repository.Detach(e)
+			for drained := false; !drained; {
+				select {
+				case update := <-e.queue:
+					pending[update.Name] = &update
+				default:
+					drained = true
+				}
+			}
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+			flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+// export sends the metrics in batches, every batch is retried on its own.
+func (e *Exporter) export(ctx context.Context, metrics []*models.Metric) error {
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+	size := e.conf.BatchSize
+	if size <= 0 {
+		size = len(metrics)
+	}
+	var errs []error
+	for start := 0; start < len(metrics); start += size {
+		batch := metrics[start:min(start+size, len(metrics))]
+		body, err := proto.Marshal(e.newRequest(batch))
+		if err != nil {
+			return err
+		}
+		err = e.retryPolicy.Do(ctx, func() error {
+			return e.send(ctx, body)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("couldn't export %d metrics: %w", len(batch), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *Exporter) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for key, value := range e.conf.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	responseBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		apiErr := apierror.Parse(res.StatusCode, responseBody)
+		if delay, ok := retry.ParseRetryAfter(res.Header.Get("Retry-After"), e.now()); ok {
+			return retry.WithRetryAfter(apiErr, delay)
+		}
+		return apiErr
+	}
+	response := &colmetricspb.ExportMetricsServiceResponse{}
+	if err = proto.Unmarshal(responseBody, response); err == nil && response.GetPartialSuccess().GetRejectedDataPoints() > 0 {
+		logger.Log.Warn("Collector rejected exported data points",
+			zap.Int64("rejected", response.GetPartialSuccess().GetRejectedDataPoints()),
+			zap.String("message", response.GetPartialSuccess().GetErrorMessage()))
+	}
+	return nil
+}
+
+// newRequest converts the metrics to an export request. The series of a metric name are the data points
+// of a single OTLP metric.
+func (e *Exporter) newRequest(metrics []*models.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	start, now := uint64(e.start.UnixNano()), uint64(e.now().UnixNano())
+	var result []*metricspb.Metric
+	byName := make(map[string]*metricspb.Metric)
+	for _, metric := range metrics {
+		name, labels := otlp.ParseSeriesName(metric.Name)
+		point := &metricspb.NumberDataPoint{Attributes: attributes(labels), TimeUnixNano: now}
+		key := metric.MType + " " + name
+		switch {
+		case metric.MType == "counter" && metric.Counter != nil:
+			point.StartTimeUnixNano = start
+			point.Value = &metricspb.NumberDataPoint_AsInt{AsInt: *metric.Counter}
+			if m, ok := byName[key]; ok {
+				m.GetSum().DataPoints = append(m.GetSum().DataPoints, point)
+				continue
+			}
+			byName[key] = &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+				DataPoints:             []*metricspb.NumberDataPoint{point},
+			}}}
+		case metric.MType == "gauge" && metric.Gauge != nil:
+			point.Value = &metricspb.NumberDataPoint_AsDouble{AsDouble: *metric.Gauge}
+			if m, ok := byName[key]; ok {
+				m.GetGauge().DataPoints = append(m.GetGauge().DataPoints, point)
+				continue
+			}
+			byName[key] = &metricspb.Metric{Name: name, Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{point},
+			}}}
+		default:
+			continue
+		}
+		result = append(result, byName[key])
+	}
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource:     e.resource,
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: &commonpb.InstrumentationScope{Name: "metrica"}, Metrics: result}},
+	}}}
+}
+
+func attributes(labels map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, stringAttribute(key, labels[key]))
+	}
+	return result
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// isRetryable reports whether sending the request again may succeed:
+// on network errors and on the statuses that are retryable.
+func isRetryable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || apierror.IsRetryable(err)
+}
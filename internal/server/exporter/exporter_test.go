@@ -0,0 +1,206 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/retry"
+	"github.com/shadyziedan/metrica/internal/server/storage"
+)
+
+type fakeRepository struct {
+	metrics []*models.Metric
+
+	mu        sync.Mutex
+	observers []storage.MetricsObserver
+}
+
+func (r *fakeRepository) FindAll(context.Context) ([]*models.Metric, error) {
+	return r.metrics, nil
+}
+
+func (r *fakeRepository) Attach(observer storage.MetricsObserver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
+func (r *fakeRepository) Detach(storage.MetricsObserver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = nil
+}
+
+func (r *fakeRepository) attached() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.observers) > 0
+}
+
+// collector records the export requests, failing the first failures of them with 503.
+type collector struct {
+	failures int
+
+	mu       sync.Mutex
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	headers  []http.Header
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.requests = append(c.requests, request)
+	c.headers = append(c.headers, r.Header)
+	response, _ := proto.Marshal(&colmetricspb.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(response)
+}
+
+func (c *collector) received() []*colmetricspb.ExportMetricsServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
+}
+
+func fastRetries() Option {
+	return WithRetryPolicy(retry.Policy{MaxRetries: 2, InitialInterval: time.Millisecond})
+}
+
+func TestExporter_Push(t *testing.T) {
+	c := &collector{failures: 1}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	repo := &fakeRepository{metrics: []*models.Metric{
+		models.NewGaugeMetric("cpu.usage;cpu=0", 0.5),
+		models.NewGaugeMetric("cpu.usage;cpu=1", 0.75),
+		models.NewCounterMetric("PollCount", 42),
+	}}
+	e := NewExporter(repo, Config{
+		Endpoint:    server.URL,
+		BatchSize:   2,
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+		ServiceName: "metrica",
+	}, fastRetries())
+
+	require.NoError(t, e.push(context.Background()))
+
+	requests := c.received()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "Bearer secret", c.headers[0].Get("Authorization"))
+	assert.Equal(t, "application/x-protobuf", c.headers[0].Get("Content-Type"))
+
+	resource := requests[0].GetResourceMetrics()[0].GetResource()
+	assert.Equal(t, "service.name", resource.GetAttributes()[0].GetKey())
+	assert.Equal(t, "metrica", resource.GetAttributes()[0].GetValue().GetStringValue())
+
+	counter := requests[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	assert.Equal(t, "PollCount", counter.GetName())
+	assert.True(t, counter.GetSum().GetIsMonotonic())
+	assert.Equal(t, int64(42), counter.GetSum().GetDataPoints()[0].GetAsInt())
+
+	first := requests[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[1]
+	assert.Equal(t, "cpu.usage", first.GetName())
+	require.Len(t, first.GetGauge().GetDataPoints(), 1)
+	assert.Equal(t, "0", first.GetGauge().GetDataPoints()[0].GetAttributes()[0].GetValue().GetStringValue())
+
+	second := requests[1].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	assert.Equal(t, 0.75, second.GetGauge().GetDataPoints()[0].GetAsDouble())
+}
+
+func TestExporter_PushFailure(t *testing.T) {
+	c := &collector{failures: 10}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	repo := &fakeRepository{metrics: []*models.Metric{models.NewCounterMetric("PollCount", 1)}}
+	e := NewExporter(repo, Config{Endpoint: server.URL}, fastRetries())
+
+	err := e.push(context.Background())
+
+	require.Error(t, err)
+	assert.Equal(t, 7, c.failures, "the request is sent three times")
+}
+
+func TestExporter_Forward(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	repo := &fakeRepository{}
+	e := NewExporter(repo, Config{Endpoint: server.URL, Mode: ModeForward, BatchSize: 2, Interval: time.Hour}, fastRetries())
+
+	e.Start()
+	require.True(t, repo.attached())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+
+	// the updates of a series are coalesced, the batch is sent once it has two series
+	require.NoError(t, e.Notify(models.NewCounterMetric("PollCount", 1)))
+	require.NoError(t, e.Notify(models.NewCounterMetric("PollCount", 2)))
+	require.NoError(t, e.Notify(models.NewGaugeMetric("Alloc", 10)))
+	require.Eventually(t, func() bool {
+		return len(c.received()) == 1
+	}, time.Second, time.Millisecond)
+	metrics := c.received()[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "Alloc", metrics[0].GetName())
+	assert.Equal(t, int64(2), metrics[1].GetSum().GetDataPoints()[0].GetAsInt())
+
+	// the partial batch is sent when the exporter stops
+	require.NoError(t, e.Notify(models.NewGaugeMetric("Alloc", 20)))
+	cancel()
+	<-done
+	assert.False(t, repo.attached())
+	require.Len(t, c.received(), 2)
+	assert.Equal(t, 20.0, c.received()[1].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetGauge().GetDataPoints()[0].GetAsDouble())
+}
+
+func TestExporter_QueueIsBounded(t *testing.T) {
+	e := NewExporter(&fakeRepository{}, Config{Mode: ModeForward, QueueSize: 2})
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, e.Notify(models.NewCounterMetric("PollCount", int64(i))))
+	}
+
+	assert.Equal(t, int64(3), e.Dropped())
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("")
+	require.NoError(t, err)
+	assert.Equal(t, ModePush, mode)
+
+	mode, err = ParseMode("forward")
+	require.NoError(t, err)
+	assert.Equal(t, ModeForward, mode)
+
+	_, err = ParseMode("pull")
+	assert.Error(t, err)
+}
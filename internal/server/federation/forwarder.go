@@ -0,0 +1,348 @@
+// Package federation forwards the metrics updated on an edge server to a central metrica server.
+//
+// The forwarder observes the repository of the edge server and sends the updates with the agent protocol,
+// so the upstream sees the edge as one more agent, along with its signing and encryption. A counter update
+// is forwarded as the increase of the counter since its last forwarded value. In the aggregate mode the updates
+// of a series are coalesced over the forward interval, in the raw mode every update is forwarded.
+// The batches the upstream can't receive are buffered on disk and sent first once it is back.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/otlp"
+	"github.com/shadyziedan/metrica/internal/server/storage"
+)
+
+// Mode is the way the updates are forwarded.
+type Mode string
+
+const (
+	// ModeAggregate forwards the last value of every updated gauge and the total increase
+	// of every updated counter once per interval
+	ModeAggregate Mode = "aggregate"
+	// ModeRaw forwards every update
+	ModeRaw Mode = "raw"
+)
+
+// ParseMode parses the forward mode name: aggregate or raw. The empty name means aggregate.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModeAggregate:
+		return ModeAggregate, nil
+	case ModeRaw:
+		return ModeRaw, nil
+	default:
+		return "", fmt.Errorf("unknown forward mode %q", name)
+	}
+}
+
+// Naming is the way the forwarded series are marked with the edge name.
+type Naming string
+
+const (
+	// NamingNone forwards the series under their own names
+	NamingNone Naming = "none"
+	// NamingPrefix prefixes the series names with the edge name: <edge>.<name>
+	NamingPrefix Naming = "prefix"
+	// NamingLabel adds the edge name as the EdgeLabel label of the series, see otlp.SeriesName
+	NamingLabel Naming = "label"
+)
+
+// EdgeLabel is the label the edge name is added as.
+const EdgeLabel = "edge"
+
+// ParseNaming parses the naming name: none, prefix or label. The empty name means none.
+func ParseNaming(name string) (Naming, error) {
+	switch Naming(name) {
+	case "", NamingNone:
+		return NamingNone, nil
+	case NamingPrefix:
+		return NamingPrefix, nil
+	case NamingLabel:
+		return NamingLabel, nil
+	default:
+		return "", fmt.Errorf("unknown edge naming %q", name)
+	}
+}
+
+// DefaultInterval is the forward interval used when none is configured.
+const DefaultInterval = 10 * time.Second
+
+// flushTimeout bounds the forwarding of the pending updates when the forwarder stops.
+const flushTimeout = 5 * time.Second
+
+type metricsRepository interface {
+	FindAll(ctx context.Context) ([]*models.Metric, error)
+	Attach(observer storage.MetricsObserver)
+	Detach(observer storage.MetricsObserver)
+}
+
+// sender sends the metrics to the upstream, agent.Agent is one.
+type sender interface {
+	Send(ctx context.Context, metrics []*models.Metrics) error
+}
+
+// Config represents the configuration settings for the Forwarder.
+type Config struct {
+	// Mode is the way the updates are forwarded
+	Mode Mode
+	// Interval is how often the updates are forwarded, DefaultInterval if it is not positive
+	Interval time.Duration
+	// BatchSize is the maximum number of metrics in a request, the pending updates are forwarded early
+	// once there are as many of them; zero means no limit
+	BatchSize int
+	// BufferDir is the directory the batches are buffered in while the upstream is down.
+	// The batches are dropped when it is empty
+	BufferDir string
+	// MaxBufferBytes is the size of the buffered batches above which the oldest ones are dropped, zero means no limit
+	MaxBufferBytes int64
+	// EdgeName is the name of the edge server the forwarded series are marked with
+	EdgeName string
+	// Naming is the way the forwarded series are marked with the edge name
+	Naming Naming
+}
+
+// Forwarder forwards the updates of the repository to the upstream server.
+type Forwarder struct {
+	conf       Config
+	repository metricsRepository
+	sender     sender
+	spool      *spool
+
+	mu      sync.Mutex
+	totals  map[string]int64
+	pending []*models.Metrics
+	index   map[string]*models.Metrics
+	full    chan struct{}
+}
+
+// NewForwarder creates a new instance of the Forwarder.
+// It fails if the buffer directory is configured and can't be created.
+func NewForwarder(repository metricsRepository, sender sender, conf Config) (*Forwarder, error) {
+	if conf.Interval <= 0 {
+		conf.Interval = DefaultInterval
+	}
+	f := &Forwarder{
+		conf:       conf,
+		repository: repository,
+		sender:     sender,
+		totals:     make(map[string]int64),
+		index:      make(map[string]*models.Metrics),
+		full:       make(chan struct{}, 1),
+	}
+	if conf.BufferDir != "" {
+		var err error
+		if f.spool, err = newSpool(conf.BufferDir, conf.MaxBufferBytes); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Start attaches the forwarder to the repository. The counters stored when it starts, e.g. restored
+// from a file, are considered forwarded already, so it must be called once the repository is restored
+// and before Run.
+func (f *Forwarder) Start(ctx context.Context) {
+	if err := f.seed(ctx); err != nil {
+		logger.Log.Error("Failed to read the forwarded counters", zap.Error(err))
+	}
+	f.repository.Attach(f)
+}
+
+// Run forwards the updates until the context is done, then forwards or buffers the pending ones.
+func (f *Forwarder) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.flush(ctx)
+		case <-f.full:
+			f.flush(ctx)
+		case <-ctx.Done():
+			f.repository.Detach(f)
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+			f.flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+func (f *Forwarder) seed(ctx context.Context) error {
+	metrics, err := f.repository.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, metric := range metrics {
+		if metric.MType == "counter" && metric.Counter != nil {
+			f.totals[metric.Name] = *metric.Counter
+		}
+	}
+	return nil
+}
+
+// Notify is called by the repository when a metric is updated, it adds the update to the pending ones.
+func (f *Forwarder) Notify(metric *models.Metric) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	update := &models.Metrics{ID: f.seriesName(metric.Name), MType: metric.MType}
+	switch {
+	case metric.MType == "counter" && metric.Counter != nil:
+		total := *metric.Counter
+		delta := total - f.totals[metric.Name]
+		if delta < 0 {
+			// the counter was reset
+			delta = total
+		}
+		f.totals[metric.Name] = total
+		if delta == 0 {
+			return nil
+		}
+		update.Delta = &delta
+	case metric.MType == "gauge" && metric.Gauge != nil:
+		value := *metric.Gauge
+		update.Value = &value
+	default:
+		return nil
+	}
+
+	if f.conf.Mode != ModeRaw {
+		if previous, ok := f.index[update.ID]; ok {
+			if update.Delta != nil {
+				*previous.Delta += *update.Delta
+			} else {
+				previous.Value = update.Value
+			}
+			return nil
+		}
+		f.index[update.ID] = update
+	}
+	f.pending = append(f.pending, update)
+	if f.conf.BatchSize > 0 && len(f.pending) >= f.conf.BatchSize {
+		select {
+		case f.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// seriesName marks the series name with the edge name.
+func (f *Forwarder) seriesName(name string) string {
+	if f.conf.EdgeName == "" {
+		return name
+	}
+	switch f.conf.Naming {
+	case NamingPrefix:
+		return f.conf.EdgeName + "." + name
+	case NamingLabel:
+		metricName, labels := otlp.ParseSeriesName(name)
+		if labels == nil {
+			labels = make(map[string]string, 1)
+		}
+		labels[EdgeLabel] = f.conf.EdgeName
+		return otlp.SeriesName(metricName, labels)
+	default:
+		return name
+	}
+}
+
+// flush forwards the buffered batches and then the pending updates.
+// While the upstream is down, the pending updates are buffered after the batches waiting already.
+func (f *Forwarder) flush(ctx context.Context) {
+	f.mu.Lock()
+	metrics := f.pending
+	f.pending = nil
+	clear(f.index)
+	f.mu.Unlock()
+
+	var batches [][]*models.Metrics
+	size := f.conf.BatchSize
+	if size <= 0 {
+		size = len(metrics)
+	}
+	for start := 0; start < len(metrics); start += size {
+		batches = append(batches, metrics[start:min(start+size, len(metrics))])
+	}
+
+	err := f.drain(ctx)
+	for i, batch := range batches {
+		if err == nil {
+			if err = f.sender.Send(ctx, batch); err == nil {
+				continue
+			}
+		}
+		if !isUpstreamFailure(err) {
+			logger.Log.Error("Forwarded metrics rejected by the upstream, dropped", zap.Int("metrics", len(batch)), zap.Error(err))
+			err = nil
+			continue
+		}
+		f.buffer(batches[i:], err)
+		return
+	}
+}
+
+// drain sends the buffered batches, the oldest first. It returns the error of the upstream if it is still down.
+func (f *Forwarder) drain(ctx context.Context) error {
+	if f.spool == nil {
+		return nil
+	}
+	names, err := f.spool.names()
+	if err != nil {
+		logger.Log.Error("Failed to read forward buffer", zap.Error(err))
+		return nil
+	}
+	for _, name := range names {
+		batch, err := f.spool.read(name)
+		if err == nil {
+			err = f.sender.Send(ctx, batch)
+			if isUpstreamFailure(err) {
+				return err
+			}
+		}
+		if err != nil {
+			logger.Log.Error("Buffered batch dropped", zap.String("batch", name), zap.Error(err))
+		}
+		if err = f.spool.remove(name); err != nil {
+			logger.Log.Error("Failed to remove buffered batch", zap.String("batch", name), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// buffer writes the batches to the spool, they are dropped without it.
+func (f *Forwarder) buffer(batches [][]*models.Metrics, cause error) {
+	if f.spool == nil {
+		logger.Log.Error("Upstream is unavailable, forwarded metrics dropped", zap.Int("batches", len(batches)), zap.Error(cause))
+		return
+	}
+	logger.Log.Warn("Upstream is unavailable, forwarded metrics buffered", zap.Int("batches", len(batches)), zap.Error(cause))
+	for _, batch := range batches {
+		if err := f.spool.push(batch); err != nil {
+			logger.Log.Error("Failed to buffer forwarded metrics", zap.Int("metrics", len(batch)), zap.Error(err))
+		}
+	}
+}
+
+// isUpstreamFailure reports whether the upstream failed to receive the metrics, so they should be sent again later.
+// The metrics the upstream rejects with an error that is not retryable would be rejected again.
+func isUpstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *apierror.Error
+	return !errors.As(err, &apiErr) || apiErr.Retryable
+}
@@ -0,0 +1,239 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/storage"
+)
+
+type fakeRepository struct {
+	metrics []*models.Metric
+
+	mu        sync.Mutex
+	observers []storage.MetricsObserver
+}
+
+func (r *fakeRepository) FindAll(context.Context) ([]*models.Metric, error) {
+	return r.metrics, nil
+}
+
+func (r *fakeRepository) Attach(observer storage.MetricsObserver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
+func (r *fakeRepository) Detach(storage.MetricsObserver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = nil
+}
+
+func (r *fakeRepository) attached() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.observers) > 0
+}
+
+// fakeSender records the batches it sends, it fails with err while it is set.
+type fakeSender struct {
+	mu      sync.Mutex
+	err     error
+	batches [][]*models.Metrics
+}
+
+func (s *fakeSender) Send(_ context.Context, metrics []*models.Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, metrics)
+	return nil
+}
+
+func (s *fakeSender) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *fakeSender) sent() [][]*models.Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+// values returns the metrics keyed by the series name.
+func values(metrics []*models.Metrics) map[string]any {
+	result := make(map[string]any, len(metrics))
+	for _, metric := range metrics {
+		if metric.Delta != nil {
+			result[metric.ID] = *metric.Delta
+		} else {
+			result[metric.ID] = *metric.Value
+		}
+	}
+	return result
+}
+
+func TestForwarder_Aggregate(t *testing.T) {
+	repo := &fakeRepository{metrics: []*models.Metric{models.NewCounterMetric("PollCount", 100)}}
+	sender := &fakeSender{}
+	f, err := NewForwarder(repo, sender, Config{})
+	require.NoError(t, err)
+	require.NoError(t, f.seed(context.Background()))
+
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 103)))
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 110)))
+	require.NoError(t, f.Notify(models.NewCounterMetric("Requests", 5)))
+	require.NoError(t, f.Notify(models.NewGaugeMetric("Alloc", 1)))
+	require.NoError(t, f.Notify(models.NewGaugeMetric("Alloc", 2)))
+	f.flush(context.Background())
+
+	require.Len(t, sender.sent(), 1)
+	assert.Equal(t, map[string]any{"PollCount": int64(10), "Requests": int64(5), "Alloc": 2.0}, values(sender.sent()[0]))
+
+	// the counters are forwarded from their last forwarded value, a reset one from zero
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 111)))
+	require.NoError(t, f.Notify(models.NewCounterMetric("Requests", 2)))
+	f.flush(context.Background())
+
+	require.Len(t, sender.sent(), 2)
+	assert.Equal(t, map[string]any{"PollCount": int64(1), "Requests": int64(2)}, values(sender.sent()[1]))
+}
+
+func TestForwarder_Raw(t *testing.T) {
+	sender := &fakeSender{}
+	f, err := NewForwarder(&fakeRepository{}, sender, Config{Mode: ModeRaw, BatchSize: 2})
+	require.NoError(t, err)
+
+	require.NoError(t, f.Notify(models.NewGaugeMetric("Alloc", 1)))
+	require.NoError(t, f.Notify(models.NewGaugeMetric("Alloc", 2)))
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 3)))
+	select {
+	case <-f.full:
+	default:
+		t.Fatal("full batch is not signaled")
+	}
+	f.flush(context.Background())
+
+	require.Len(t, sender.sent(), 2)
+	assert.Equal(t, 1.0, *sender.sent()[0][0].Value)
+	assert.Equal(t, 2.0, *sender.sent()[0][1].Value)
+	assert.Equal(t, int64(3), *sender.sent()[1][0].Delta)
+}
+
+func TestForwarder_EdgeNaming(t *testing.T) {
+	tests := []struct {
+		naming Naming
+		name   string
+		want   string
+	}{
+		{naming: NamingNone, name: "Alloc", want: "Alloc"},
+		{naming: NamingPrefix, name: "Alloc", want: "edge-1.Alloc"},
+		{naming: NamingLabel, name: "Alloc", want: "Alloc;edge=edge-1"},
+		{naming: NamingLabel, name: "cpu.usage;cpu=0", want: "cpu.usage;cpu=0;edge=edge-1"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.naming)+" "+tt.name, func(t *testing.T) {
+			f, err := NewForwarder(&fakeRepository{}, &fakeSender{}, Config{EdgeName: "edge-1", Naming: tt.naming})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, f.seriesName(tt.name))
+		})
+	}
+}
+
+func TestForwarder_BuffersWhileUpstreamIsDown(t *testing.T) {
+	dir := t.TempDir()
+	sender := &fakeSender{err: errors.New("connection refused")}
+	f, err := NewForwarder(&fakeRepository{}, sender, Config{BufferDir: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 1)))
+	f.flush(context.Background())
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 3)))
+	f.flush(context.Background())
+	names, err := f.spool.names()
+	require.NoError(t, err)
+	assert.Len(t, names, 2)
+
+	// a new forwarder sends the batches left by the previous one in order
+	sender.setErr(nil)
+	f, err = NewForwarder(&fakeRepository{}, sender, Config{BufferDir: dir})
+	require.NoError(t, err)
+	require.NoError(t, f.Notify(models.NewCounterMetric("PollCount", 10)))
+	f.flush(context.Background())
+
+	require.Len(t, sender.sent(), 3)
+	assert.Equal(t, int64(1), *sender.sent()[0][0].Delta)
+	assert.Equal(t, int64(2), *sender.sent()[1][0].Delta)
+	assert.Equal(t, int64(10), *sender.sent()[2][0].Delta)
+	names, err = f.spool.names()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestForwarder_DropsRejectedMetrics(t *testing.T) {
+	sender := &fakeSender{err: apierror.New(http.StatusBadRequest, apierror.CodeInvalidMetricName, "invalid name")}
+	f, err := NewForwarder(&fakeRepository{}, sender, Config{BufferDir: t.TempDir()})
+	require.NoError(t, err)
+
+	require.NoError(t, f.Notify(models.NewGaugeMetric("Alloc", 1)))
+	f.flush(context.Background())
+
+	names, err := f.spool.names()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestForwarder_Run(t *testing.T) {
+	repo := &fakeRepository{}
+	sender := &fakeSender{}
+	f, err := NewForwarder(repo, sender, Config{Interval: time.Hour})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.Start(ctx)
+	require.True(t, repo.attached())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(ctx)
+	}()
+	require.NoError(t, f.Notify(models.NewGaugeMetric("Alloc", 1)))
+	cancel()
+	<-done
+
+	// the pending updates are forwarded when the forwarder stops
+	assert.False(t, repo.attached())
+	require.Len(t, sender.sent(), 1)
+	assert.Equal(t, "Alloc", sender.sent()[0][0].ID)
+}
+
+func TestSpool_Trim(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 1)
+	require.NoError(t, err)
+	value := 1.0
+
+	require.NoError(t, s.push([]*models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}))
+	require.NoError(t, s.push([]*models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}))
+
+	// only the newest batch is kept
+	names, err := s.names()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000000000000000002.json"}, names)
+	_, err = os.Stat(s.dir + "/00000000000000000001.json")
+	assert.True(t, os.IsNotExist(err))
+}
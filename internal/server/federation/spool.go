@@ -0,0 +1,131 @@
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+)
+
+const spoolExt = ".json"
+
+// spool keeps the batches that couldn't be forwarded, a file per batch named by its sequence number,
+// so that they are sent in order once the upstream is back, even after a restart.
+type spool struct {
+	dir      string
+	maxBytes int64
+	seq      uint64
+}
+
+// newSpool creates the spool in the directory, the batches left by a previous run are kept.
+// The oldest batches are dropped when the spool grows over maxBytes, zero disables the limit.
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("couldn't create buffer directory: %w", err)
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes}
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		s.seq, _ = strconv.ParseUint(strings.TrimSuffix(names[len(names)-1], spoolExt), 10, 64)
+	}
+	return s, nil
+}
+
+// push writes the batch to a new file. The file is renamed into place once written,
+// so a crash never leaves a torn batch behind.
+func (s *spool) push(metrics []*models.Metrics) error {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolExt))
+	tmp := name + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("couldn't write buffered batch: %w", err)
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("couldn't write buffered batch: %w", err)
+	}
+	return s.trim()
+}
+
+// names returns the names of the buffered batches, the oldest first.
+func (s *spool) names() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read buffer directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), spoolExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// read returns the metrics of the buffered batch.
+func (s *spool) read(name string) ([]*models.Metrics, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var metrics []*models.Metrics
+	if err = json.Unmarshal(data, &metrics); err != nil {
+		return nil, fmt.Errorf("corrupt buffered batch %s: %w", name, err)
+	}
+	return metrics, nil
+}
+
+// remove removes the buffered batch.
+func (s *spool) remove(name string) error {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// trim drops the oldest batches until the spool fits in maxBytes, the newest batch is always kept.
+func (s *spool) trim() error {
+	if s.maxBytes <= 0 {
+		return nil
+	}
+	names, err := s.names()
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(names))
+	var total int64
+	for i, name := range names {
+		info, err := os.Stat(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+	for i := 0; total > s.maxBytes && i < len(names)-1; i++ {
+		if err = s.remove(names[i]); err != nil {
+			return err
+		}
+		total -= sizes[i]
+		logger.Log.Warn("Forward buffer is full, the oldest batch is dropped", zap.String("batch", names[i]))
+	}
+	return nil
+}
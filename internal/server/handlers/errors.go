@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+func toAPIError(err error) *apierror.Error {
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return apierror.Internal(err)
+}
+
+// storageFailure is the error of a metric the repository failed to store. The metric was valid,
+// so sending it again may succeed unless the repository failed with an API error of its own.
+func storageFailure(metricID string, err error) *apierror.Error {
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.WithMetric(metricID)
+	}
+	return apierror.New(http.StatusServiceUnavailable, apierror.CodeUnavailable, err.Error()).WithMetric(metricID)
+}
+
+func unknownMetricType(metricID, metricType string) *apierror.Error {
+	return apierror.New(http.StatusBadRequest, apierror.CodeUnknownMetricType,
+		"unknown metric type: "+metricType).WithMetric(metricID)
+}
+
+func invalidValue(metricID string, err error) *apierror.Error {
+	return apierror.New(http.StatusBadRequest, apierror.CodeInvalidValue, err.Error()).WithMetric(metricID)
+}
+
+func missingValue(metricID, metricType string) *apierror.Error {
+	field := "value"
+	if metricType == "counter" {
+		field = "delta"
+	}
+	return apierror.New(http.StatusBadRequest, apierror.CodeMissingValue,
+		fmt.Sprintf("%s metric has no %s", metricType, field)).WithMetric(metricID)
+}
+
+func metricNotFound(metricID string) *apierror.Error {
+	return apierror.New(http.StatusNotFound, apierror.CodeMetricNotFound, "metric not found").WithMetric(metricID)
+}
+
+// checkMetric checks that the metric has a known type and the value of that type.
+func checkMetric(metric *models.Metrics) *apierror.Error {
+	switch metric.MType {
+	case "counter":
+		if metric.Delta == nil {
+			return missingValue(metric.ID, metric.MType)
+		}
+	case "gauge":
+		if metric.Value == nil {
+			return missingValue(metric.ID, metric.MType)
+		}
+	default:
+		return unknownMetricType(metric.ID, metric.MType)
+	}
+	return nil
+}
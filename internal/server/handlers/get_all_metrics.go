@@ -5,6 +5,8 @@ package handlers
 import (
 	"html/template"
 	"net/http"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
 )
 
 var getAllMetricsTemplate = `
@@ -28,7 +30,7 @@ var getAllMetricsTemplate = `
 func (h *MetricHandler) GetAll(rw http.ResponseWriter, r *http.Request) {
 	metrics, err := h.repository.FindAll(r.Context())
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		apierror.Write(rw, err)
 		return
 	}
 
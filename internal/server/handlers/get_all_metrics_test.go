@@ -52,8 +52,8 @@ func TestGetAll_Error(t *testing.T) {
 	// Assert
 	repo.AssertExpectations(t)
 	assert.Equal(t, http.StatusInternalServerError, rw.Code)
-	assert.Equal(t, "text/plain; charset=utf-8", rw.Header().Get("Content-Type"))
-	assert.Equal(t, "failed to fetch metrics\n", rw.Body.String())
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"code":"internal","message":"failed to fetch metrics","retryable":true}`, rw.Body.String())
 }
 
 func TestGetAll_NoMetrics(t *testing.T) {
@@ -110,6 +110,11 @@ func (m *MockRepository) FindAllByName(ctx context.Context, names []string) ([]*
 	return args.Get(0).([]*models.Metric), args.Error(1)
 }
 
+func (m *MockRepository) Count(ctx context.Context) (int, error) {
+	args := m.Called(ctx)
+	return args.Int(0), args.Error(1)
+}
+
 func (m *MockRepository) FindAll(ctx context.Context) ([]*models.Metric, error) {
 	args := m.Called(ctx)
 	return args.Get(0).([]*models.Metric), args.Error(1)
@@ -6,6 +6,8 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
 )
 
 // GetMetric retrieves a specific metric based on the provided metric type and name.
@@ -23,7 +25,7 @@ func (h *MetricHandler) GetMetric(rw http.ResponseWriter, r *http.Request) {
 	metricName := chi.URLParam(r, "metricName")
 	metric, err := h.repository.Find(r.Context(), metricName)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusNotFound)
+		apierror.Write(rw, metricNotFound(metricName))
 		return
 	}
 	switch metricType {
@@ -34,7 +36,9 @@ func (h *MetricHandler) GetMetric(rw http.ResponseWriter, r *http.Request) {
 		io.WriteString(rw, fmt.Sprintf("%v", *metric.Gauge))
 		return
 	default:
-		http.Error(rw, "unknown metric type: "+metricType, http.StatusNotFound)
+		apiErr := unknownMetricType(metricName, metricType)
+		apiErr.Status = http.StatusNotFound
+		apierror.Write(rw, apiErr)
 		return
 	}
 }
@@ -1,9 +1,9 @@
 package handlers
 
 import (
-	"encoding/json"
 	"net/http"
 
+	"github.com/shadyziedan/metrica/internal/apierror"
 	"github.com/shadyziedan/metrica/internal/models"
 )
 
@@ -22,28 +22,22 @@ import (
 // If the metric with the given ID is not found in the repository,
 // the function returns a 404 Not Found status with the message "metric not found".
 //
-// The function sets the "Content-Type" header of the response to "application/json".
+// The request and the response may be in MessagePack instead of JSON, as selected by the Content-Type
+// and Accept headers; the response is in the format of the request by default.
 //
-// If an error occurs while encoding the metric to JSON,
-// the function returns a 500 Internal Server Error status with the error message.
+// The errors are written as the JSON error envelope.
 func (h *MetricHandler) GetMetricJSON(w http.ResponseWriter, r *http.Request) {
 	data := &models.Metrics{}
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "invalid data format", http.StatusBadRequest)
+	if err := requestCodec(r).Decode(r.Body, &data); err != nil {
+		apierror.Write(w, apierror.New(http.StatusBadRequest, apierror.CodeInvalidBody, "invalid data format"))
 		return
 	}
 	metric, err := h.repository.Find(r.Context(), data.ID)
 	if err != nil {
-		http.Error(w, "metric not found", http.StatusNotFound)
+		apierror.Write(w, metricNotFound(data.ID))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-
 	resp := &models.Metrics{}
 	resp.ParseMetricModel(metric)
-
-	if err = json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	writeBody(w, r, http.StatusOK, resp)
 }
@@ -4,11 +4,13 @@ import (
 	"context"
 
 	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/otlp"
 )
 
 type MetricHandler struct {
 	repository metricsRepository
 	conn       dbConnection
+	otlp       *otlp.Converter
 }
 
 type dbConnection interface {
@@ -26,5 +28,5 @@ type metricsRepository interface {
 }
 
 func NewMetricHandler(conn dbConnection, repository metricsRepository) *MetricHandler {
-	return &MetricHandler{repository: repository, conn: conn}
+	return &MetricHandler{repository: repository, conn: conn, otlp: otlp.NewConverter()}
 }
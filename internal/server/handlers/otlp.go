@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+// The content types of the OTLP/HTTP encodings.
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// ExportOTLP handles the OTLP/HTTP metrics export requests in the protobuf or the JSON encoding.
+// The metrics are converted by otlp.Converter and stored like a batch update.
+// The data points that can't be converted or get an invalid series name are skipped and reported
+// in the partial success of the response, which has the encoding of the request.
+// The limits shared by the whole request, the batch size, the series count and the quota, fail it as a whole.
+func (h *MetricHandler) ExportOTLP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != contentTypeProtobuf && mediaType != contentTypeJSON {
+		apierror.Write(w, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType,
+			fmt.Sprintf("content type %q is not supported, use %s or %s", mediaType, contentTypeProtobuf, contentTypeJSON)))
+		return
+	}
+	body, err := io.ReadAll(validation.LimitBody(w, r))
+	if err != nil {
+		apierror.Write(w, validation.BodyError(err))
+		return
+	}
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if mediaType == contentTypeJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, request)
+	} else {
+		err = proto.Unmarshal(body, request)
+	}
+	if err != nil {
+		apierror.Write(w, validation.BodyError(err))
+		return
+	}
+
+	batch := h.otlp.Convert(request)
+	stored := false
+	defer func() {
+		if !stored {
+			batch.Rollback()
+		}
+	}()
+	if err = validation.CheckBatch(ctx, len(batch.Metrics)); err != nil {
+		apierror.Write(w, err)
+		return
+	}
+	rejected, message := batch.Rejected, batch.Message
+	valid := make([]models.Metrics, 0, len(batch.Metrics))
+	names := make([]string, 0, len(batch.Metrics))
+	for _, metric := range batch.Metrics {
+		if err = validation.CheckName(ctx, metric.ID); err != nil {
+			if rejected == 0 {
+				message = err.Error()
+			}
+			rejected++
+			continue
+		}
+		valid = append(valid, metric)
+		names = append(names, metric.ID)
+	}
+	if len(valid) > 0 {
+		if err = validation.CheckNames(ctx, names...); err != nil {
+			apierror.Write(w, err)
+			return
+		}
+		if err = quota.AllowMetrics(ctx, names...); err != nil {
+			quota.WriteExceeded(w, err)
+			return
+		}
+		if batchRepo, ok := h.repository.(batchRepository); ok {
+			_, err = h.updateBulk(ctx, batchRepo, valid)
+		} else {
+			_, err = h.updateEach(ctx, valid)
+		}
+		if err != nil {
+			apierror.Write(w, err)
+			return
+		}
+	}
+	stored = true
+
+	response := &colmetricspb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		response.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       message,
+		}
+	}
+	var responseBody []byte
+	if mediaType == contentTypeJSON {
+		responseBody, err = protojson.Marshal(response)
+	} else {
+		responseBody, err = proto.Marshal(response)
+	}
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	if _, err = w.Write(responseBody); err != nil {
+		logger.Log.Error("Error writing response", zap.Error(err))
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/otlp"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+// otlpRepository records the metrics it is given.
+type otlpRepository struct {
+	MockRepository
+	metrics []models.Metrics
+}
+
+func (r *otlpRepository) UpdateBatch(_ context.Context, metrics []models.Metrics) ([]*models.Metric, error) {
+	r.metrics = append(r.metrics, metrics...)
+	result := make([]*models.Metric, 0, len(metrics))
+	for _, item := range metrics {
+		if item.MType == "counter" {
+			result = append(result, models.NewCounterMetric(item.ID, *item.Delta))
+		} else {
+			result = append(result, models.NewGaugeMetric(item.ID, *item.Value))
+		}
+	}
+	return result, nil
+}
+
+func otlpRequest() *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+			{Name: "cpu.usage", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+				{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 0.75}},
+			}}}},
+			{Name: "requests", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				IsMonotonic:            true,
+				DataPoints:             []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsInt{AsInt: 3}}},
+			}}},
+			{Name: "a_very_long_metric_name", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+				{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 1}},
+			}}}},
+		}}},
+	}}}
+}
+
+func TestExportOTLP(t *testing.T) {
+	validator := validation.NewValidator(validation.Limits{MaxNameLength: 16}, nil)
+	tests := []struct {
+		name        string
+		contentType string
+		marshal     func(proto.Message) ([]byte, error)
+		unmarshal   func([]byte, proto.Message) error
+	}{
+		{name: "protobuf", contentType: "application/x-protobuf", marshal: proto.Marshal, unmarshal: proto.Unmarshal},
+		{name: "json", contentType: "application/json", marshal: protojson.Marshal, unmarshal: protojson.Unmarshal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &otlpRepository{}
+			handler := &MetricHandler{repository: repo, otlp: otlp.NewConverter()}
+			body, err := tt.marshal(otlpRequest())
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+			req = req.WithContext(validation.WithValidator(req.Context(), validator))
+			req.Header.Set("Content-Type", tt.contentType)
+			rw := httptest.NewRecorder()
+
+			handler.ExportOTLP(rw, req)
+
+			require.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tt.contentType, rw.Header().Get("Content-Type"))
+			require.Len(t, repo.metrics, 2)
+			assert.Equal(t, "cpu.usage", repo.metrics[0].ID)
+			assert.Equal(t, 0.75, *repo.metrics[0].Value)
+			assert.Equal(t, "requests", repo.metrics[1].ID)
+			assert.Equal(t, int64(3), *repo.metrics[1].Delta)
+
+			response := &colmetricspb.ExportMetricsServiceResponse{}
+			require.NoError(t, tt.unmarshal(rw.Body.Bytes(), response))
+			assert.Equal(t, int64(1), response.GetPartialSuccess().GetRejectedDataPoints())
+			assert.Contains(t, response.GetPartialSuccess().GetErrorMessage(), "longer than 16 bytes")
+		})
+	}
+}
+
+func TestExportOTLP_UnsupportedContentType(t *testing.T) {
+	handler := &MetricHandler{repository: &otlpRepository{}, otlp: otlp.NewConverter()}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader("cpu.usage 0.75"))
+	req.Header.Set("Content-Type", "text/plain")
+	rw := httptest.NewRecorder()
+
+	handler.ExportOTLP(rw, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, rw.Code)
+	assert.Contains(t, rw.Body.String(), "unsupported_media_type")
+}
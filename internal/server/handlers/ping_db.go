@@ -1,6 +1,10 @@
 package handlers
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+)
 
 // Ping handles a HTTP request to check the database connection.
 // It responds with a status code 500 if the database connection is closed.
@@ -9,11 +13,11 @@ import "net/http"
 // - No return value. If the database connection is closed, it writes an HTTP error response.
 func (h *MetricHandler) Ping(w http.ResponseWriter, r *http.Request) {
 	if h.conn == nil {
-		http.Error(w, "db connection closed", http.StatusInternalServerError)
+		apierror.Write(w, apierror.New(http.StatusInternalServerError, apierror.CodeUnavailable, "db connection closed"))
 		return
 	}
 	if err := h.conn.Ping(r.Context()); err != nil {
-		http.Error(w, "db connection closed", http.StatusInternalServerError)
+		apierror.Write(w, apierror.New(http.StatusInternalServerError, apierror.CodeUnavailable, "db connection closed"))
 		return
 	}
 }
@@ -21,5 +21,9 @@ func NewRouter(conn dbConnection, repo metricsRepository, middlewares ...middlew
 	r.Post(`/update/`, metricsHandler.UpdateJSON)
 	r.Post(`/value/`, metricsHandler.GetMetricJSON)
 	r.Post(`/updates/`, metricsHandler.UpdateBatch)
+	r.Post(`/updates/stream`, metricsHandler.UpdateStream)
+
+	//OpenTelemetry
+	r.Post(`/v1/metrics`, metricsHandler.ExportOTLP)
 	return r
 }
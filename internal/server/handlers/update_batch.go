@@ -1,69 +1,239 @@
 package handlers
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
+	"github.com/shadyziedan/metrica/internal/apierror"
 	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
-// UpdateBatch handles a batch update of metrics.
+// batchRepository is implemented by repositories that can apply a whole batch at once.
+type batchRepository interface {
+	UpdateBatch(ctx context.Context, metrics []models.Metrics) ([]*models.Metric, error)
+}
 
+// UpdateBatch handles a batch update of metrics.
+// The whole batch is validated first. If the repository supports bulk updates the batch is applied at once,
+// otherwise the metrics are updated one by one.
+// With the X-Partial-Success header, the invalid metrics don't fail the batch: the valid ones are applied
+// and the response lists the result of every metric, with 207 Multi-Status when some of them were rejected.
+// The batch may be sent in MessagePack instead of JSON, see writeBody for the format of the response.
 func (h *MetricHandler) UpdateBatch(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var data []models.Metrics
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := requestCodec(r).Decode(validation.LimitBody(w, r), &data); err != nil {
+		apierror.Write(w, validation.BodyError(err))
 		return
 	}
-	response := make([]*models.Metrics, 0, len(data))
-	for _, item := range data {
-		metric, err := h.repository.FindOrCreate(ctx, item.ID, item.MType)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validation.CheckBatch(ctx, len(data)); err != nil {
+		apierror.Write(w, err)
+		return
+	}
+	if r.Header.Get(`X-Partial-Success`) != "" {
+		h.updateBatchPartial(w, r, data)
+		return
+	}
+	names := make([]string, 0, len(data))
+	for i := range data {
+		if apiErr := checkMetric(&data[i]); apiErr != nil {
+			apierror.Write(w, apiErr.WithIndex(i))
 			return
 		}
+		names = append(names, data[i].ID)
+	}
 
-		switch item.MType {
-		case "counter":
-			if item.Delta == nil {
-				http.Error(w, fmt.Sprintf("error updating null counter value metric: %s", err), http.StatusBadRequest)
-				return
-			}
+	if err := validation.CheckNames(ctx, names...); err != nil {
+		apierror.Write(w, withBatchIndex(err, data))
+		return
+	}
+	if err := quota.AllowMetrics(ctx, names...); err != nil {
+		quota.WriteExceeded(w, err)
+		return
+	}
 
-			if err = h.repository.UpdateCounter(ctx, metric.Name, *item.Delta); err != nil {
-				http.Error(w, fmt.Sprintf("error updating counter metric: %s", err), http.StatusInternalServerError)
-				return
-			}
-		case "gauge":
-			if item.Value == nil {
-				http.Error(w, fmt.Sprintf("error updating null gauge value metric: %s", err), http.StatusBadRequest)
-				return
-			}
+	var response []*models.Metrics
+	var err error
+	if batchRepo, ok := h.repository.(batchRepository); ok {
+		response, err = h.updateBulk(ctx, batchRepo, data)
+	} else {
+		response, err = h.updateEach(ctx, data)
+	}
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	writeBody(w, r, http.StatusOK, response)
+}
+
+// withBatchIndex points an error related to a metric at the first position of the metric in the batch.
+func withBatchIndex(err error, data []models.Metrics) error {
+	var apiErr *apierror.Error
+	if !errors.As(err, &apiErr) || apiErr.MetricID == "" {
+		return err
+	}
+	for i := range data {
+		if data[i].ID == apiErr.MetricID {
+			return apiErr.WithIndex(i)
+		}
+	}
+	return err
+}
+
+// updateBatchPartial applies the valid metrics of the batch and writes the result of every metric.
+// The limits shared by the whole batch, the series count and the quota, still fail the whole request.
+// A repository without bulk updates applies the metrics one by one, so a metric it fails to store
+// is reported as a retryable failure of its own; a failed bulk update fails the whole request.
+func (h *MetricHandler) updateBatchPartial(w http.ResponseWriter, r *http.Request, data []models.Metrics) {
+	ctx := r.Context()
+	results := make([]models.BatchResult, len(data))
+	valid := make([]models.Metrics, 0, len(data))
+	validIndexes := make([]int, 0, len(data))
+	names := make([]string, 0, len(data))
+	for i := range data {
+		results[i] = models.BatchResult{Index: i, ID: data[i].ID}
+		var err error
+		if apiErr := checkMetric(&data[i]); apiErr != nil {
+			err = apiErr
+		} else {
+			err = validation.CheckName(ctx, data[i].ID)
+		}
+		if err != nil {
+			apiErr := toAPIError(err).WithIndex(i)
+			results[i].Status = apiErr.Status
+			results[i].Error = apiErr
+			continue
+		}
+		valid = append(valid, data[i])
+		validIndexes = append(validIndexes, i)
+		names = append(names, data[i].ID)
+	}
 
-			if err = h.repository.UpdateGauge(ctx, metric.Name, *item.Value); err != nil {
-				http.Error(w, fmt.Sprintf("error updating counter metric: %s", err), http.StatusInternalServerError)
-				return
+	status := http.StatusOK
+	if len(valid) < len(data) {
+		status = http.StatusMultiStatus
+	}
+	if len(valid) > 0 {
+		if err := validation.CheckNames(ctx, names...); err != nil {
+			apierror.Write(w, err)
+			return
+		}
+		if err := quota.AllowMetrics(ctx, names...); err != nil {
+			quota.WriteExceeded(w, err)
+			return
+		}
+		batchRepo, ok := h.repository.(batchRepository)
+		if !ok {
+			for j, i := range validIndexes {
+				metric, err := h.updateOne(ctx, valid[j])
+				if err != nil {
+					apiErr := storageFailure(valid[j].ID, err).WithIndex(i)
+					results[i].Status = apiErr.Status
+					results[i].Error = apiErr
+					status = http.StatusMultiStatus
+					continue
+				}
+				results[i].Status = http.StatusOK
+				results[i].Metric = metric
 			}
-		default:
-			http.Error(w, "unknown metric type", http.StatusBadRequest)
+			writeBody(w, r, status, models.BatchResponse{Results: results})
 			return
 		}
-		updatedMetric, err := h.repository.Find(ctx, metric.Name)
+		response, err := h.updateBulk(ctx, batchRepo, valid)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			apierror.Write(w, err)
 			return
 		}
+		for j, i := range validIndexes {
+			results[i].Status = http.StatusOK
+			results[i].Metric = response[j]
+		}
+	}
+
+	writeBody(w, r, status, models.BatchResponse{Results: results})
+}
+
+// updateBulk applies the batch at once. The response lists the value of every metric right after its update,
+// as if the metrics were updated one by one: the repository returns the values after the whole batch,
+// so the running values of the counters updated more than once are derived from them.
+func (h *MetricHandler) updateBulk(ctx context.Context, repo batchRepository, data []models.Metrics) ([]*models.Metrics, error) {
+	updatedMetrics, err := repo.UpdateBatch(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("error updating metrics: %w", err)
+	}
+	byName := make(map[string]*models.Metric, len(updatedMetrics))
+	for _, metric := range updatedMetrics {
+		byName[metric.Name] = metric
+	}
+	// running starts with the counter values before the batch
+	running := make(map[string]int64)
+	for _, item := range data {
+		updatedMetric, ok := byName[item.ID]
+		if !ok {
+			return nil, fmt.Errorf("metric %s not found after update", item.ID)
+		}
+		if item.MType == "counter" && updatedMetric.Counter != nil {
+			if _, ok = running[item.ID]; !ok {
+				running[item.ID] = *updatedMetric.Counter
+			}
+			running[item.ID] -= *item.Delta
+		}
+	}
+	response := make([]*models.Metrics, 0, len(data))
+	for _, item := range data {
 		responseModel := &models.Metrics{}
-		responseModel.ParseMetricModel(updatedMetric)
+		responseModel.ParseMetricModel(byName[item.ID])
+		if value, ok := running[item.ID]; ok && item.MType == "counter" {
+			value += *item.Delta
+			running[item.ID] = value
+			responseModel.Delta = &value
+		} else if item.MType == "gauge" && responseModel.MType == "gauge" {
+			responseModel.Value = item.Value
+		}
 		response = append(response, responseModel)
 	}
+	return response, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
+func (h *MetricHandler) updateEach(ctx context.Context, data []models.Metrics) ([]*models.Metrics, error) {
+	response := make([]*models.Metrics, 0, len(data))
+	for _, item := range data {
+		responseModel, err := h.updateOne(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, responseModel)
+	}
+	return response, nil
+}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// updateOne applies a single metric of a batch and returns its updated value.
+func (h *MetricHandler) updateOne(ctx context.Context, item models.Metrics) (*models.Metrics, error) {
+	metric, err := h.repository.FindOrCreate(ctx, item.ID, item.MType)
+	if err != nil {
+		return nil, err
+	}
+
+	switch item.MType {
+	case "counter":
+		if err = h.repository.UpdateCounter(ctx, metric.Name, *item.Delta); err != nil {
+			return nil, fmt.Errorf("error updating counter metric: %w", err)
+		}
+	case "gauge":
+		if err = h.repository.UpdateGauge(ctx, metric.Name, *item.Value); err != nil {
+			return nil, fmt.Errorf("error updating gauge metric: %w", err)
+		}
+	}
+	updatedMetric, err := h.repository.Find(ctx, metric.Name)
+	if err != nil {
+		return nil, err
 	}
+	responseModel := &models.Metrics{}
+	responseModel.ParseMetricModel(updatedMetric)
+	return responseModel, nil
 }
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/codec"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+type MockBatchRepository struct {
+	MockRepository
+}
+
+func (m *MockBatchRepository) UpdateBatch(ctx context.Context, metrics []models.Metrics) ([]*models.Metric, error) {
+	args := m.Called(ctx, metrics)
+	return args.Get(0).([]*models.Metric), args.Error(1)
+}
+
+func TestUpdateBatch_Bulk(t *testing.T) {
+	repo := &MockBatchRepository{}
+	repo.On("UpdateBatch", mock.Anything, mock.Anything).Return([]*models.Metric{
+		models.NewCounterMetric("PollCount", 15),
+		models.NewGaugeMetric("Alloc", 1.5),
+	}, nil)
+	handler := &MetricHandler{repository: repo}
+
+	body := `[{"id":"PollCount","type":"counter","delta":5},{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":10}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+
+	handler.UpdateBatch(rw, req)
+
+	repo.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `[{"id":"PollCount","type":"counter","delta":5},{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":15}]`, rw.Body.String())
+}
+
+func TestUpdateBatch_InvalidItemRejectsBatch(t *testing.T) {
+	repo := &MockBatchRepository{}
+	handler := &MetricHandler{repository: repo}
+
+	body := `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter"}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+
+	handler.UpdateBatch(rw, req)
+
+	repo.AssertNotCalled(t, "UpdateBatch", mock.Anything, mock.Anything)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.JSONEq(t, `{"code":"missing_value","message":"counter metric has no delta","metric_id":"PollCount","index":1,"retryable":false}`, rw.Body.String())
+}
+
+func TestUpdateBatch_PartialSuccess(t *testing.T) {
+	repo := &MockBatchRepository{}
+	value := 1.5
+	repo.On("UpdateBatch", mock.Anything, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}).
+		Return([]*models.Metric{models.NewGaugeMetric("Alloc", 1.5)}, nil)
+	handler := &MetricHandler{repository: repo}
+
+	body := `[{"id":"PollCount","type":"counter"},{"id":"Alloc","type":"gauge","value":1.5},{"id":"test","type":"unknown"}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	req.Header.Set("X-Partial-Success", "true")
+	rw := httptest.NewRecorder()
+
+	handler.UpdateBatch(rw, req)
+
+	repo.AssertExpectations(t)
+	assert.Equal(t, http.StatusMultiStatus, rw.Code)
+	assert.JSONEq(t, `{"results":[
+		{"index":0,"id":"PollCount","status":400,"error":{"code":"missing_value","message":"counter metric has no delta","metric_id":"PollCount","index":0,"retryable":false}},
+		{"index":1,"id":"Alloc","status":200,"metric":{"id":"Alloc","type":"gauge","value":1.5}},
+		{"index":2,"id":"test","status":400,"error":{"code":"unknown_metric_type","message":"unknown metric type: unknown","metric_id":"test","index":2,"retryable":false}}
+	]}`, rw.Body.String())
+}
+
+func TestUpdateBatch_PartialSuccessStorageFailure(t *testing.T) {
+	repo := &MockRepository{}
+	repo.On("FindOrCreate", mock.Anything, "Alloc", "gauge").Return(models.NewGaugeMetric("Alloc", 0), nil)
+	repo.On("FindOrCreate", mock.Anything, "HeapAlloc", "gauge").Return(models.NewGaugeMetric("HeapAlloc", 0), nil)
+	repo.On("UpdateGauge", mock.Anything, "Alloc", 1.5).Return(nil)
+	repo.On("UpdateGauge", mock.Anything, "HeapAlloc", 2.5).Return(errors.New("disk full"))
+	repo.On("Find", mock.Anything, "Alloc").Return(models.NewGaugeMetric("Alloc", 1.5), nil)
+	handler := &MetricHandler{repository: repo}
+
+	body := `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"HeapAlloc","type":"gauge","value":2.5}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	req.Header.Set("X-Partial-Success", "true")
+	rw := httptest.NewRecorder()
+
+	handler.UpdateBatch(rw, req)
+
+	// the metric that failed to be stored is reported as retryable, so the agent sends it again
+	repo.AssertExpectations(t)
+	assert.Equal(t, http.StatusMultiStatus, rw.Code)
+	assert.JSONEq(t, `{"results":[
+		{"index":0,"id":"Alloc","status":200,"metric":{"id":"Alloc","type":"gauge","value":1.5}},
+		{"index":1,"id":"HeapAlloc","status":503,"error":{"code":"unavailable","message":"error updating gauge metric: disk full","metric_id":"HeapAlloc","index":1,"retryable":true}}
+	]}`, rw.Body.String())
+}
+
+func TestUpdateBatch_QuotaExceeded(t *testing.T) {
+	repo := &MockBatchRepository{}
+	handler := &MetricHandler{repository: repo}
+	limiter := quota.NewLimiter(quota.Limits{MaxMetricNames: 1})
+
+	body := `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":1}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	req = req.WithContext(quota.WithClient(req.Context(), limiter, "agent"))
+	rw := httptest.NewRecorder()
+
+	handler.UpdateBatch(rw, req)
+
+	repo.AssertNotCalled(t, "UpdateBatch", mock.Anything, mock.Anything)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.NotEmpty(t, rw.Header().Get("Retry-After"))
+}
+
+func TestUpdateBatch_TooLarge(t *testing.T) {
+	repo := &MockBatchRepository{}
+	handler := &MetricHandler{repository: repo}
+	validator := validation.NewValidator(validation.Limits{MaxBatchSize: 1}, repo)
+
+	body := `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":1}]`
+	req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	req = req.WithContext(validation.WithValidator(req.Context(), validator))
+	rw := httptest.NewRecorder()
+
+	handler.UpdateBatch(rw, req)
+
+	repo.AssertNotCalled(t, "UpdateBatch", mock.Anything, mock.Anything)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `"code":"batch_too_large"`)
+}
+
+func TestUpdateBatch_MsgPack(t *testing.T) {
+	repo := &MockBatchRepository{}
+	repo.On("UpdateBatch", mock.Anything, mock.Anything).Return([]*models.Metric{
+		models.NewGaugeMetric("Alloc", 1.5),
+	}, nil)
+	handler := &MetricHandler{repository: repo}
+
+	value := 1.5
+	var body bytes.Buffer
+	require.NoError(t, codec.MsgPack.Encode(&body, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}))
+	req := httptest.NewRequest(http.MethodPost, "/updates/", &body)
+	req.Header.Set("Content-Type", codec.ContentTypeMsgPack)
+
+	t.Run("response in the request format", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler.UpdateBatch(rw, req.Clone(req.Context()))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, codec.ContentTypeMsgPack, rw.Header().Get("Content-Type"))
+		var response []*models.Metrics
+		require.NoError(t, codec.MsgPack.Decode(rw.Body, &response))
+		require.Len(t, response, 1)
+		assert.Equal(t, 1.5, *response[0].Value)
+	})
+
+	t.Run("accepted response format", func(t *testing.T) {
+		require.NoError(t, codec.MsgPack.Encode(&body, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}))
+		req.Body = io.NopCloser(&body)
+		req.Header.Set("Accept", codec.ContentTypeJSON)
+		rw := httptest.NewRecorder()
+		handler.UpdateBatch(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.JSONEq(t, `[{"id":"Alloc","type":"gauge","value":1.5}]`, rw.Body.String())
+	})
+}
@@ -5,6 +5,10 @@ import (
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
 // UpdateMetricHandler handles HTTP requests to update a specific metric.
@@ -24,9 +28,18 @@ func (h *MetricHandler) UpdateMetricHandler(w http.ResponseWriter, r *http.Reque
 	metricName := chi.URLParam(r, "metricName")
 	metricValue := chi.URLParam(r, "metricValue")
 
+	if err := validation.CheckNames(r.Context(), metricName); err != nil {
+		apierror.Write(w, err)
+		return
+	}
+	if err := quota.AllowMetrics(r.Context(), metricName); err != nil {
+		quota.WriteExceeded(w, err)
+		return
+	}
+
 	metric, err := h.repository.FindOrCreate(r.Context(), metricName, metricType)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, err)
 		return
 	}
 
@@ -34,28 +47,26 @@ func (h *MetricHandler) UpdateMetricHandler(w http.ResponseWriter, r *http.Reque
 	case "counter":
 		num, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			apierror.Write(w, invalidValue(metricName, err))
 			return
 		}
-		err = h.repository.UpdateCounter(r.Context(), metric.Name, num)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err = h.repository.UpdateCounter(r.Context(), metric.Name, num); err != nil {
+			apierror.Write(w, err)
 			return
 		}
 		return
 	case "gauge":
 		num, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			apierror.Write(w, invalidValue(metricName, err))
 			return
 		}
-		err = h.repository.UpdateGauge(r.Context(), metric.Name, num)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err = h.repository.UpdateGauge(r.Context(), metric.Name, num); err != nil {
+			apierror.Write(w, err)
 			return
 		}
 		return
 	default:
-		http.Error(w, "unknown metric type", http.StatusBadRequest)
+		apierror.Write(w, unknownMetricType(metricName, metricType))
 	}
 }
@@ -1,59 +1,63 @@
 package handlers
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 
+	"github.com/shadyziedan/metrica/internal/apierror"
 	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
 // UpdateJSON handles HTTP requests to update a metric in the system.
-// It expects a JSON payload containing the metric ID, type, delta (for counter type), and value (for gauge type).
+// It expects a JSON or MessagePack payload containing the metric ID, type, delta (for counter type), and value (for gauge type).
 // The function first decodes the request body into a Metrics struct.
 // It then finds or creates a metric in the repository based on the provided ID and type.
 // Depending on the metric type, it updates the corresponding metric value in the repository.
-// Finally, it retrieves the updated metric from the repository, sets the response header to "application/json",
-// and encodes the metric data into the response body.
+// Finally, it retrieves the updated metric from the repository and encodes it into the response body
+// in the format the client accepts.
 func (h *MetricHandler) UpdateJSON(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	data := &models.Metrics{}
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := requestCodec(r).Decode(validation.LimitBody(w, r), &data); err != nil {
+		apierror.Write(w, validation.BodyError(err))
+		return
+	}
+	if apiErr := checkMetric(data); apiErr != nil {
+		apierror.Write(w, apiErr)
+		return
+	}
+	if err := validation.CheckNames(ctx, data.ID); err != nil {
+		apierror.Write(w, err)
+		return
+	}
+	if err := quota.AllowMetrics(ctx, data.ID); err != nil {
+		quota.WriteExceeded(w, err)
 		return
 	}
 	metric, err := h.repository.FindOrCreate(ctx, data.ID, data.MType)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, err)
 		return
 	}
 
 	switch data.MType {
 	case "counter":
-		if err = h.repository.UpdateCounter(ctx, metric.Name, *data.Delta); err != nil {
-			http.Error(w, fmt.Sprintf("error updating counter metric: %s", err), http.StatusInternalServerError)
-			return
-		}
+		err = h.repository.UpdateCounter(ctx, metric.Name, *data.Delta)
 	case "gauge":
-		if err = h.repository.UpdateGauge(ctx, metric.Name, *data.Value); err != nil {
-			http.Error(w, fmt.Sprintf("error updating counter metric: %s", err), http.StatusInternalServerError)
-			return
-		}
-	default:
-		http.Error(w, "unknown metric type", http.StatusBadRequest)
+		err = h.repository.UpdateGauge(ctx, metric.Name, *data.Value)
+	}
+	if err != nil {
+		apierror.Write(w, fmt.Errorf("error updating %s metric: %w", data.MType, err))
 		return
 	}
 	updatedMetric, err := h.repository.Find(ctx, metric.Name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
 	response := &models.Metrics{}
 	response.ParseMetricModel(updatedMetric)
-
-	if err = json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	writeBody(w, r, http.StatusOK, response)
 }
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+const (
+	// streamChunkSize is the number of streamed metrics applied at once
+	streamChunkSize = 1000
+	// maxStreamErrors is the number of rejected metrics described in the stream response
+	maxStreamErrors = 100
+)
+
+// UpdateStream handles a stream of metric updates in the newline-delimited JSON format.
+// The stream is decoded and applied incrementally in chunks, so the memory use doesn't depend on its length.
+// The invalid metrics are skipped and reported in the response along with the counts of the applied ones.
+// A chunk that fails to apply, for the series limit, the quota or a storage error, stops the stream:
+// the error response has the X-Processed header with the number of metrics handled before the failed chunk,
+// so that the client can send the rest again.
+func (h *MetricHandler) UpdateStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	decoder := json.NewDecoder(validation.LimitStream(w, r))
+	var response models.StreamResponse
+	chunk := make([]models.Metrics, 0, streamChunkSize)
+	// processed is the position in the stream before which every metric is either applied or rejected
+	processed := 0
+	index := 0
+	for ; ; index++ {
+		var item models.Metrics
+		err := decoder.Decode(&item)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			writeStreamError(w, validation.BodyError(err), processed)
+			return
+		}
+		if err = checkStreamItem(ctx, &item); err != nil {
+			if response.Rejected < maxStreamErrors {
+				response.Errors = append(response.Errors, toAPIError(err).WithIndex(index))
+			}
+			response.Rejected++
+		} else {
+			chunk = append(chunk, item)
+		}
+		if len(chunk) == 0 {
+			processed = index + 1
+		}
+		if len(chunk) == streamChunkSize {
+			if err = h.applyChunk(ctx, chunk); err != nil {
+				writeStreamError(w, err, processed)
+				return
+			}
+			response.Applied += len(chunk)
+			processed = index + 1
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 {
+		if err := h.applyChunk(ctx, chunk); err != nil {
+			writeStreamError(w, err, processed)
+			return
+		}
+		response.Applied += len(chunk)
+	}
+	response.Processed = index
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Log.Error("Error writing response", zap.Error(err))
+	}
+}
+
+// checkStreamItem checks a single streamed metric.
+func checkStreamItem(ctx context.Context, item *models.Metrics) error {
+	if apiErr := checkMetric(item); apiErr != nil {
+		return apiErr
+	}
+	return validation.CheckName(ctx, item.ID)
+}
+
+// applyChunk checks the series limit and the quota for a chunk of the stream and applies it.
+func (h *MetricHandler) applyChunk(ctx context.Context, chunk []models.Metrics) error {
+	names := make([]string, 0, len(chunk))
+	for i := range chunk {
+		names = append(names, chunk[i].ID)
+	}
+	if err := validation.CheckNames(ctx, names...); err != nil {
+		return err
+	}
+	if err := quota.AllowMetrics(ctx, names...); err != nil {
+		return err
+	}
+	var err error
+	if batchRepo, ok := h.repository.(batchRepository); ok {
+		_, err = h.updateBulk(ctx, batchRepo, chunk)
+	} else {
+		_, err = h.updateEach(ctx, chunk)
+	}
+	return err
+}
+
+// writeStreamError writes the error that stopped the stream along with the number of metrics processed before it.
+func writeStreamError(w http.ResponseWriter, err error, processed int) {
+	w.Header().Set(`X-Processed`, strconv.Itoa(processed))
+	if !quota.WriteExceeded(w, err) {
+		apierror.Write(w, err)
+	}
+}
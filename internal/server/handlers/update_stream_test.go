@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+// streamBody returns a stream of n gauges with a counter missing its delta at the given position.
+func streamBody(n int, invalidAt int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		if i == invalidAt {
+			sb.WriteString(`{"id":"PollCount","type":"counter"}` + "\n")
+			continue
+		}
+		fmt.Fprintf(&sb, `{"id":"Gauge%d","type":"gauge","value":%d}`+"\n", i, i)
+	}
+	return sb.String()
+}
+
+// streamRepository applies the chunks it is given, failing from the failAt-th call on if it is positive.
+type streamRepository struct {
+	MockRepository
+	chunkSizes []int
+	failAt     int
+}
+
+func (r *streamRepository) UpdateBatch(_ context.Context, metrics []models.Metrics) ([]*models.Metric, error) {
+	r.chunkSizes = append(r.chunkSizes, len(metrics))
+	if r.failAt > 0 && len(r.chunkSizes) >= r.failAt {
+		return nil, errors.New("db is down")
+	}
+	result := make([]*models.Metric, 0, len(metrics))
+	for _, item := range metrics {
+		result = append(result, models.NewGaugeMetric(item.ID, *item.Value))
+	}
+	return result, nil
+}
+
+func TestUpdateStream(t *testing.T) {
+	repo := &streamRepository{}
+	handler := &MetricHandler{repository: repo}
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/stream", strings.NewReader(streamBody(2501, 10)))
+	req.Header.Set("Content-Type", models.StreamContentType)
+	rw := httptest.NewRecorder()
+
+	handler.UpdateStream(rw, req)
+
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []int{streamChunkSize, streamChunkSize, 500}, repo.chunkSizes)
+	var response models.StreamResponse
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &response))
+	assert.Equal(t, 2501, response.Processed)
+	assert.Equal(t, 2500, response.Applied)
+	assert.Equal(t, 1, response.Rejected)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, apierror.CodeMissingValue, response.Errors[0].Code)
+	assert.Equal(t, 10, *response.Errors[0].Index)
+}
+
+func TestUpdateStream_StopsOnFailure(t *testing.T) {
+	t.Run("storage error", func(t *testing.T) {
+		repo := &streamRepository{failAt: 2}
+		handler := &MetricHandler{repository: repo}
+
+		req := httptest.NewRequest(http.MethodPost, "/updates/stream", strings.NewReader(streamBody(2500, -1)))
+		rw := httptest.NewRecorder()
+
+		handler.UpdateStream(rw, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rw.Code)
+		assert.Equal(t, "1000", rw.Header().Get("X-Processed"))
+		assert.Equal(t, []int{streamChunkSize, streamChunkSize}, repo.chunkSizes)
+	})
+
+	t.Run("malformed line", func(t *testing.T) {
+		repo := &streamRepository{}
+		handler := &MetricHandler{repository: repo}
+
+		body := streamBody(3, -1) + "{not json}\n"
+		req := httptest.NewRequest(http.MethodPost, "/updates/stream", strings.NewReader(body))
+		rw := httptest.NewRecorder()
+
+		handler.UpdateStream(rw, req)
+
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.Equal(t, "0", rw.Header().Get("X-Processed"))
+		assert.Contains(t, rw.Body.String(), `"code":"invalid_body"`)
+		assert.Empty(t, repo.chunkSizes)
+	})
+}
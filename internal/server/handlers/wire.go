@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/codec"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+)
+
+// requestCodec returns the codec of the request body format.
+func requestCodec(r *http.Request) codec.Codec {
+	return codec.ForContentType(r.Header.Get("Content-Type"))
+}
+
+// writeBody writes the response in the format the client accepts, the format of the request by default.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, v any) {
+	c := codec.ForAccept(r.Header.Get("Accept"), requestCodec(r))
+	w.Header().Set("Content-Type", c.ContentType())
+	w.WriteHeader(status)
+	if err := c.Encode(w, v); err != nil {
+		logger.Log.Error("Error writing response", zap.Error(err))
+	}
+}
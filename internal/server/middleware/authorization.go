@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/server/auth"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+)
+
+type authenticator interface {
+	Authenticate(ctx context.Context, secret string) (*auth.Token, error)
+}
+
+// Authorization is a middleware requiring a bearer token with the scope needed for the requested path:
+// write for the updates, read for the values and admin for everything else.
+// The authenticated token is stored in the request context.
+// If the authenticator is nil, it returns the next handler without any modifications.
+func Authorization(authenticator authenticator) func(http.Handler) http.Handler {
+	if authenticator == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || secret == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "missing bearer token"))
+				return
+			}
+			token, err := authenticator.Authenticate(r.Context(), secret)
+			if errors.Is(err, auth.ErrTokenNotFound) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid bearer token"))
+				return
+			}
+			if err != nil {
+				logger.Log.Error("Error authenticating token", zap.Error(err))
+				apierror.Write(w, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "failed to authenticate"))
+				return
+			}
+			if scope := auth.RequiredScope(r.URL.Path); !token.Allows(scope) {
+				apierror.Write(w, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "token is not granted the "+string(scope)+" scope"))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithToken(r.Context(), token)))
+		})
+	}
+}
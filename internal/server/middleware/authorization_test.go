@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/server/auth"
+)
+
+func TestAuthorization(t *testing.T) {
+	writer, err := auth.ParseStaticToken("agent:write:agent-secret")
+	require.NoError(t, err)
+	reader, err := auth.ParseStaticToken("dashboard:read:dashboard-secret")
+	require.NoError(t, err)
+	authenticator := auth.NewAuthenticator([]auth.Token{writer, reader})
+
+	var tokenName string
+	handler := Authorization(authenticator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := auth.TokenFromContext(r.Context())
+		tokenName = token.Name
+	}))
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		wantStatus    int
+		wantToken     string
+	}{
+		{name: "write token updates", path: "/updates/", authorization: "Bearer agent-secret", wantStatus: http.StatusOK, wantToken: "agent"},
+		{name: "read token reads", path: "/value/gauge/test", authorization: "Bearer dashboard-secret", wantStatus: http.StatusOK, wantToken: "dashboard"},
+		{name: "read token updates", path: "/update/gauge/test/1", authorization: "Bearer dashboard-secret", wantStatus: http.StatusForbidden},
+		{name: "write token profiles", path: "/debug/pprof/heap", authorization: "Bearer agent-secret", wantStatus: http.StatusForbidden},
+		{name: "unknown token", path: "/", authorization: "Bearer unknown", wantStatus: http.StatusUnauthorized},
+		{name: "missing token", path: "/", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenName = ""
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantToken, tokenName)
+		})
+	}
+}
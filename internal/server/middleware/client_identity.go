@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+type agentIDKey struct{}
+
+// ClientIdentity derives the agent identity from the verified client certificate and stores it in the request context.
+// The common name of the certificate subject is used, falling back to the whole subject when it is empty.
+// Requests without a client certificate are passed through unchanged.
+func ClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		subject := r.TLS.PeerCertificates[0].Subject
+		agentID := subject.CommonName
+		if agentID == "" {
+			agentID = subject.String()
+		}
+		next.ServeHTTP(w, r.WithContext(WithAgentID(r.Context(), agentID)))
+	})
+}
+
+// WithAgentID returns a copy of the context carrying the agent identity.
+func WithAgentID(ctx context.Context, agentID string) context.Context {
+	return context.WithValue(ctx, agentIDKey{}, agentID)
+}
+
+// AgentID returns the agent identity stored in the context by ClientIdentity.
+func AgentID(ctx context.Context) (string, bool) {
+	agentID, ok := ctx.Value(agentIDKey{}).(string)
+	return agentID, ok
+}
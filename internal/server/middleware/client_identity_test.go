@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIdentity(t *testing.T) {
+	var agentID string
+	var found bool
+	handler := ClientIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agentID, found = AgentID(r.Context())
+	}))
+
+	t.Run("certificate common name", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "agent-1", Organization: []string{"metrica"}}},
+		}}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.True(t, found)
+		assert.Equal(t, "agent-1", agentID)
+	})
+
+	t.Run("certificate without common name", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{Organization: []string{"metrica"}}},
+		}}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.True(t, found)
+		assert.Equal(t, "O=metrica", agentID)
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.False(t, found)
+	})
+}
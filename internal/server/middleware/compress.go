@@ -2,22 +2,27 @@
 package middleware
 
 import (
-	"compress/gzip"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/compression"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
 type compressResponseWriter struct {
 	http.ResponseWriter
-	zw *gzip.Writer
+	zw io.WriteCloser
 }
 
-func newCompressWriter(w http.ResponseWriter) *compressResponseWriter {
-	return &compressResponseWriter{
-		w,
-		gzip.NewWriter(w),
+func newCompressWriter(w http.ResponseWriter, encoding string, level compression.Level) (*compressResponseWriter, error) {
+	zw, err := compression.NewWriter(encoding, w, level)
+	if err != nil {
+		return nil, err
 	}
+	return &compressResponseWriter{w, zw}, nil
 }
 
 func (c *compressResponseWriter) Write(b []byte) (int, error) {
@@ -30,15 +35,15 @@ func (c *compressResponseWriter) Close() error {
 
 type compressReader struct {
 	r  io.ReadCloser
-	zr *gzip.Reader
+	zr io.ReadCloser
 }
 
-func newCompressReader(r io.ReadCloser) (*compressReader, error) {
-	gzipReader, err := gzip.NewReader(r)
+func newCompressReader(r io.ReadCloser, encoding string) (*compressReader, error) {
+	zr, err := compression.NewReader(encoding, r)
 	if err != nil {
 		return nil, err
 	}
-	return &compressReader{r: r, zr: gzipReader}, nil
+	return &compressReader{r: r, zr: zr}, nil
 }
 
 func (cr compressReader) Read(b []byte) (int, error) {
@@ -46,7 +51,7 @@ func (cr compressReader) Read(b []byte) (int, error) {
 }
 
 func (cr *compressReader) Close() error {
-	// Close the wrapped gzip.Reader first
+	// Close the wrapped decompressing reader first
 	if cr.zr != nil {
 		if err := cr.zr.Close(); err != nil {
 			return err
@@ -61,33 +66,49 @@ func (cr *compressReader) Close() error {
 	return nil
 }
 
-// Compress reads compressed request data and returns compressed response data
+// Compress reads compressed request data and returns compressed response data with the default compression level.
 func Compress(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		wo := w
-		acceptEncoding := r.Header.Get("Accept-Encoding")
-		acceptsGzip := strings.Contains(acceptEncoding, "gzip")
-
-		if acceptsGzip {
-			cw := newCompressWriter(w)
-			defer cw.Close()
-			wo = cw
-			wo.Header().Set("Content-Encoding", "gzip")
-		}
+	return CompressLevel(compression.LevelDefault)(next)
+}
 
-		contentEncoding := r.Header.Get("Content-Encoding")
-		sendsGzip := strings.Contains(contentEncoding, "gzip")
+// CompressLevel reads the request data compressed with any of compression.Supported and compresses the response data
+// with the encoding the client prefers, at the given level. The supported encodings are advertised to the clients
+// in the Accept-Encoding response header, a request in an unsupported encoding is rejected with 415.
+func CompressLevel(level compression.Level) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Accept-Encoding", compression.Header(compression.Supported))
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			wo := w
+			if encoding := compression.Negotiate(r.Header.Get("Accept-Encoding"), compression.Supported); encoding != "" {
+				cw, err := newCompressWriter(w, encoding, level)
+				if err != nil {
+					apierror.Write(w, apierror.Internal(err))
+					return
+				}
+				defer cw.Close()
+				wo = cw
+				wo.Header().Set("Content-Encoding", encoding)
+			}
 
-		if sendsGzip {
-			cr, err := newCompressReader(r.Body)
-			if err != nil {
-				http.Error(wo, err.Error(), http.StatusInternalServerError)
-				return
+			contentEncoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if contentEncoding != "" && contentEncoding != "identity" {
+				if !compression.IsSupported(contentEncoding) {
+					apierror.Write(wo, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedEncoding,
+						fmt.Sprintf("content encoding %q is not supported", contentEncoding)))
+					return
+				}
+				cr, err := newCompressReader(r.Body, contentEncoding)
+				if err != nil {
+					apierror.Write(wo, validation.BodyError(err))
+					return
+				}
+				defer cr.Close()
+				r.Body = cr
 			}
-			defer cr.Close()
-			r.Body = cr
-		}
 
-		next.ServeHTTP(wo, r)
-	})
+			next.ServeHTTP(wo, r)
+		})
+	}
 }
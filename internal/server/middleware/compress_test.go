@@ -9,6 +9,10 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/compression"
 )
 
 // Helper function to gzip data
@@ -112,3 +116,44 @@ func TestCompress_NoGzip(t *testing.T) {
 	// Assert that the response body is not compressed
 	assert.Equal(t, "no gzip here", rec.Body.String())
 }
+
+func TestCompressLevel_Zstd(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.Write(append([]byte("got "), body...))
+	})
+	handler := CompressLevel(compression.LevelFastest)(next)
+
+	body, err := compression.Compress(compression.Zstd, compression.LevelDefault, []byte("hello, server"))
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", "zstd")
+	req.Header.Set("Accept-Encoding", "gzip;q=0.5, zstd")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "zstd, gzip, snappy", rec.Header().Get("Accept-Encoding"))
+	assert.Equal(t, "zstd", rec.Header().Get("Content-Encoding"))
+	response, err := compression.Decompress(compression.Zstd, rec.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "got hello, server", string(response))
+}
+
+func TestCompress_UnsupportedEncoding(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler must not be called")
+	})
+	handler := Compress(next)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("data")))
+	req.Header.Set("Content-Encoding", "br")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	assert.Equal(t, "zstd, gzip, snappy", rec.Header().Get("Accept-Encoding"))
+	apiErr := apierror.Parse(rec.Code, rec.Body.Bytes())
+	assert.Equal(t, apierror.CodeUnsupportedEncoding, apiErr.Code)
+}
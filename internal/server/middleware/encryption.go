@@ -2,110 +2,272 @@ package middleware
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/security"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
+// Encryption is a middleware decrypting the request bodies encrypted by the agent.
+// It holds several private keys at once, so that the keys can be rotated across the agents:
+// the agent names the key it used in the X-Key-ID header.
+// The RSA and X25519 keys are supported, the agent names the encryption scheme in the X-Encryption-Scheme header.
+// The session keys recovered from the agents encrypted keys are cached, since the agents reuse them for many requests.
+// When the agent sends the X-Encrypt-Response header, the response is encrypted with its session key.
 type Encryption struct {
-	privateKey *rsa.PrivateKey
+	mu          sync.RWMutex
+	paths       []string
+	keys        map[string]crypto.PrivateKey
+	sessionKeys map[string][]byte
 }
 
-func NewEncryption(privateKey *rsa.PrivateKey) *Encryption {
-	return &Encryption{privateKey: privateKey}
-}
+// maxSessionKeys limits the number of cached session keys, the cache is emptied when it is full.
+const maxSessionKeys = 1024
 
-func NewEncryptionFromFile(privateKeyPath string) (*Encryption, error) {
-	f, err := os.Open(privateKeyPath)
-	if err != nil {
-		return nil, err
+// NewEncryption creates the middleware for the RSA or X25519 private keys. Keys of other types are ignored.
+func NewEncryption(privateKeys ...crypto.PrivateKey) *Encryption {
+	keys := make(map[string]crypto.PrivateKey, len(privateKeys))
+	for _, privateKey := range privateKeys {
+		keyID, err := privateKeyID(privateKey)
+		if err != nil {
+			continue
+		}
+		keys[keyID] = privateKey
 	}
-	defer f.Close()
-	keyData, err := io.ReadAll(f)
+	return &Encryption{keys: keys, sessionKeys: make(map[string][]byte)}
+}
+
+func privateKeyID(privateKey crypto.PrivateKey) (string, error) {
+	pubKey, err := security.PublicKey(privateKey)
 	if err != nil {
-		return nil, fmt.Errorf("error reading private key file: %w", err)
+		return "", err
 	}
-	block, _ := pem.Decode(keyData)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return nil, fmt.Errorf("failed to decode PEM block containing the key")
+	return security.KeyID(pubKey)
+}
+
+// NewEncryptionFromFile loads the private keys from the given files.
+// The keys can be reloaded from the same files with Reload.
+func NewEncryptionFromFile(privateKeyPaths ...string) (*Encryption, error) {
+	e := &Encryption{paths: privateKeyPaths}
+	if err := e.Reload(); err != nil {
+		return nil, err
 	}
+	return e, nil
+}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing private key: %w", err)
+// Reload reads the private keys again from their files and replaces the current keys.
+// The current keys are kept if any of the files can't be loaded.
+func (e *Encryption) Reload() error {
+	keys := make(map[string]crypto.PrivateKey, len(e.paths))
+	for _, path := range e.paths {
+		privateKey, err := security.ReadPrivateKey(path)
+		if err != nil {
+			return fmt.Errorf("error loading private key %s: %w", path, err)
+		}
+		keyID, err := privateKeyID(privateKey)
+		if err != nil {
+			return err
+		}
+		keys[keyID] = privateKey
 	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keys = keys
+	e.sessionKeys = make(map[string][]byte)
+	return nil
+}
 
-	return NewEncryption(privateKey), nil
+// KeyIDs returns the IDs of the loaded private keys.
+func (e *Encryption) KeyIDs() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	keyIDs := make([]string, 0, len(e.keys))
+	for keyID := range e.keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	return keyIDs
 }
 
 func (e *Encryption) MiddleWare(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		aesKey := r.Header.Get(`X-Encrypted-Key`)
 		if aesKey == "" {
-			http.Error(w, "missing encryption key", http.StatusUnauthorized)
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnknownKey, "missing encryption key"))
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
+		// the body is read after the decompression, so it is limited again
+		limited := validation.LimitBody(w, r)
+		if validation.IsStream(r) {
+			limited = validation.LimitStream(w, r)
+		}
+		body, err := io.ReadAll(limited)
 		if err != nil {
-			http.Error(w, "failed to read body", http.StatusBadRequest)
+			apierror.Write(w, validation.BodyError(err))
+			return
+		}
+		scheme := r.Header.Get(`X-Encryption-Scheme`)
+		if scheme == "" {
+			scheme = security.SchemeRSAPKCS1v15
+		}
+		decryptedBody, sessionKey, err := e.decryptMessage(scheme, r.Header.Get(`X-Key-ID`), aesKey, body)
+		if errors.Is(err, errUnknownKeyID) {
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnknownKey, "unknown encryption key"))
+			return
+		}
+		if errors.Is(err, errUnknownScheme) {
+			apierror.Write(w, apierror.New(http.StatusBadRequest, apierror.CodeUnknownScheme, "unknown encryption scheme"))
 			return
 		}
-		decryptedBody, err := e.decryptMessage(aesKey, body)
 		if err != nil {
-			http.Error(w, "failed to decrypt message", http.StatusInternalServerError)
+			apierror.Write(w, apierror.New(http.StatusBadRequest, apierror.CodeDecryptionFailed, "failed to decrypt message"))
 			return
 		}
 		r.Body = io.NopCloser(bytes.NewReader(decryptedBody))
 
-		next.ServeHTTP(w, r)
+		if r.Header.Get(`X-Encrypt-Response`) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the response is encrypted back to the agent with its session key
+		responseWriter := newBufferedResponseWriter(w)
+		next.ServeHTTP(responseWriter, r)
+		encryptedResponse, err := security.SealAESGCM(sessionKey, responseWriter.body.Bytes())
+		if err != nil {
+			logger.Log.Error("Error encrypting response", zap.Error(err))
+			apierror.Write(w, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "failed to encrypt response"))
+			return
+		}
+		w.Header().Set(`X-Encrypted-Response`, "true")
+		if err = responseWriter.send([]byte(base64.StdEncoding.EncodeToString(encryptedResponse))); err != nil {
+			logger.Log.Error("Error writing response", zap.Error(err))
+		}
 	})
 }
 
-func (e *Encryption) decryptMessage(encryptedAESKey string, body []byte) ([]byte, error) {
+var (
+	errUnknownKeyID  = errors.New("unknown key id")
+	errUnknownScheme = errors.New("unknown encryption scheme")
+)
+
+// privateKeys returns the private keys to try for the given key ID.
+// All the keys are tried when the agent didn't send the key ID.
+func (e *Encryption) privateKeys(keyID string) ([]crypto.PrivateKey, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if keyID != "" {
+		privateKey, ok := e.keys[keyID]
+		if !ok {
+			return nil, errUnknownKeyID
+		}
+		return []crypto.PrivateKey{privateKey}, nil
+	}
+	privateKeys := make([]crypto.PrivateKey, 0, len(e.keys))
+	for _, privateKey := range e.keys {
+		privateKeys = append(privateKeys, privateKey)
+	}
+	return privateKeys, nil
+}
+
+// decryptMessage decrypts the request body and returns it along with the session key.
+func (e *Encryption) decryptMessage(scheme string, keyID string, encryptedAESKey string, body []byte) ([]byte, []byte, error) {
 	decodeString, err := base64.StdEncoding.DecodeString(encryptedAESKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	decryptedAESKey, err := rsa.DecryptPKCS1v15(rand.Reader, e.privateKey, decodeString)
+	switch scheme {
+	case security.SchemeRSAPKCS1v15, security.SchemeRSAOAEP, security.SchemeX25519AESGCM:
+	default:
+		return nil, nil, errUnknownScheme
+	}
+	privateKeys, err := e.privateKeys(keyID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	body, err = base64.StdEncoding.DecodeString(string(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return decryptWithAES(decryptedAESKey, body)
-}
-
-// decryptWithAES decrypts data using AES and returns the plaintext.
-func decryptWithAES(key []byte, data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+	cacheKey := scheme + " " + keyID + " " + encryptedAESKey
+	if sessionKey, ok := e.sessionKey(cacheKey); ok {
+		if decryptedBody, err := security.OpenAESGCM(sessionKey, body); err == nil {
+			return decryptedBody, sessionKey, nil
+		}
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	err = errUnknownKeyID
+	for _, privateKey := range privateKeys {
+		var decryptedAESKey, decryptedBody []byte
+		decryptedAESKey, err = decryptAESKey(scheme, privateKey, decodeString)
+		if err != nil {
+			continue
+		}
+		decryptedBody, err = security.OpenAESGCM(decryptedAESKey, body)
+		if err == nil {
+			e.cacheSessionKey(cacheKey, decryptedAESKey)
+			return decryptedBody, decryptedAESKey, nil
+		}
 	}
+	return nil, nil, err
+}
+
+func (e *Encryption) sessionKey(cacheKey string) ([]byte, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	sessionKey, ok := e.sessionKeys[cacheKey]
+	return sessionKey, ok
+}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+func (e *Encryption) cacheSessionKey(cacheKey string, sessionKey []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.sessionKeys) >= maxSessionKeys {
+		e.sessionKeys = make(map[string][]byte)
 	}
+	e.sessionKeys[cacheKey] = sessionKey
+}
 
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+// decryptAESKey recovers the AES key from the encrypted key sent by the agent according to the encryption scheme.
+// For the X25519 scheme the encrypted key is the ephemeral public key of the agent.
+func decryptAESKey(scheme string, privateKey crypto.PrivateKey, encryptedKey []byte) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		switch scheme {
+		case security.SchemeRSAPKCS1v15:
+			return rsa.DecryptPKCS1v15(rand.Reader, key, encryptedKey)
+		case security.SchemeRSAOAEP:
+			return rsa.DecryptOAEP(sha256.New(), rand.Reader, key, encryptedKey, nil)
+		}
+	case *ecdh.PrivateKey:
+		if scheme == security.SchemeX25519AESGCM {
+			ephemeral, err := ecdh.X25519().NewPublicKey(encryptedKey)
+			if err != nil {
+				return nil, err
+			}
+			sharedSecret, err := key.ECDH(ephemeral)
+			if err != nil {
+				return nil, err
+			}
+			return security.DeriveX25519Key(sharedSecret, encryptedKey, key.PublicKey().Bytes())
+		}
+	}
+	return nil, fmt.Errorf("key doesn't support the %s scheme", scheme)
 }
@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/security"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+func encryptedRequest(t *testing.T, pubKey crypto.PublicKey, scheme string, body []byte, withKeyID bool) *http.Request {
+	t.Helper()
+	encryptor, err := security.NewDefaultEncryptor(pubKey, scheme)
+	require.NoError(t, err)
+	encryptedBody, encryptedKey, err := encryptor.Encrypt(body)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(base64.StdEncoding.EncodeToString(encryptedBody)))
+	req.Header.Set("X-Encrypted-Key", encryptedKey.Key)
+	if scheme != "" {
+		req.Header.Set("X-Encryption-Scheme", encryptedKey.Scheme)
+	}
+	if withKeyID {
+		req.Header.Set("X-Key-ID", encryptedKey.KeyID)
+	}
+	return req
+}
+
+func writePrivateKey(t *testing.T, path string, privateKey *rsa.PrivateKey) {
+	t.Helper()
+	keyData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	require.NoError(t, os.WriteFile(path, keyData, 0600))
+}
+
+func TestEncryption_MiddleWare(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	body := []byte(`[{"id":"test","type":"counter","delta":1}]`)
+	var received []byte
+	handler := NewEncryption(oldKey, newKey).MiddleWare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+
+	tests := []struct {
+		name       string
+		key        *rsa.PrivateKey
+		withKeyID  bool
+		wantStatus int
+	}{
+		{name: "old key with key id", key: oldKey, withKeyID: true, wantStatus: http.StatusOK},
+		{name: "new key with key id", key: newKey, withKeyID: true, wantStatus: http.StatusOK},
+		{name: "new key without key id", key: newKey, withKeyID: false, wantStatus: http.StatusOK},
+		{name: "unknown key id", key: otherKey, withKeyID: true, wantStatus: http.StatusUnauthorized},
+		{name: "unknown key without key id", key: otherKey, withKeyID: false, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, encryptedRequest(t, &tt.key.PublicKey, "", body, tt.withKeyID))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, body, received)
+			}
+		})
+	}
+}
+
+func TestEncryption_BodyLimit(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	handler := NewEncryption(privateKey).MiddleWare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler must not be called")
+	}))
+	validator := validation.NewValidator(validation.Limits{MaxBodyBytes: 16}, nil)
+
+	req := encryptedRequest(t, &privateKey.PublicKey, "", []byte(`[{"id":"test","type":"counter","delta":1}]`), true)
+	req = req.WithContext(validation.WithValidator(req.Context(), validator))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestEncryption_Schemes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	body := []byte(`[{"id":"test","type":"gauge","value":1.5}]`)
+	var received []byte
+	handler := NewEncryption(rsaKey, x25519Key).MiddleWare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+
+	tests := []struct {
+		name   string
+		pubKey crypto.PublicKey
+		scheme string
+	}{
+		{name: "rsa pkcs1v15", pubKey: &rsaKey.PublicKey, scheme: security.SchemeRSAPKCS1v15},
+		{name: "rsa oaep", pubKey: &rsaKey.PublicKey, scheme: security.SchemeRSAOAEP},
+		{name: "x25519", pubKey: x25519Key.PublicKey(), scheme: security.SchemeX25519AESGCM},
+	}
+	for _, tt := range tests {
+		for _, withKeyID := range []bool{true, false} {
+			t.Run(tt.name, func(t *testing.T) {
+				received = nil
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, encryptedRequest(t, tt.pubKey, tt.scheme, body, withKeyID))
+
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, body, received)
+			})
+		}
+	}
+
+	t.Run("unknown scheme", func(t *testing.T) {
+		req := encryptedRequest(t, &rsaKey.PublicKey, security.SchemeRSAOAEP, body, true)
+		req.Header.Set("X-Encryption-Scheme", "rot13")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestEncryption_Reload(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "private.pem")
+	writePrivateKey(t, path, oldKey)
+	encryption, err := NewEncryptionFromFile(path)
+	require.NoError(t, err)
+	oldKeyID, err := security.KeyID(&oldKey.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{oldKeyID}, encryption.KeyIDs())
+
+	writePrivateKey(t, path, newKey)
+	require.NoError(t, encryption.Reload())
+	newKeyID, err := security.KeyID(&newKey.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{newKeyID}, encryption.KeyIDs())
+
+	// a broken file keeps the current keys
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0600))
+	assert.Error(t, encryption.Reload())
+	assert.Equal(t, []string{newKeyID}, encryption.KeyIDs())
+}
+
+func TestEncryption_SessionKeyCache(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encryption := NewEncryption(privateKey)
+	handler := encryption.MiddleWare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	encryptor, err := security.NewDefaultEncryptor(&privateKey.PublicKey, security.SchemeRSAOAEP)
+	require.NoError(t, err)
+	for _, body := range []string{"first", "second"} {
+		encryptedBody, encryptedKey, err := encryptor.Encrypt([]byte(body))
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(base64.StdEncoding.EncodeToString(encryptedBody)))
+		req.Header.Set("X-Encrypted-Key", encryptedKey.Key)
+		req.Header.Set("X-Encryption-Scheme", encryptedKey.Scheme)
+		req.Header.Set("X-Key-ID", encryptedKey.KeyID)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	// both requests share the session key
+	assert.Len(t, encryption.sessionKeys, 1)
+}
+
+func TestEncryption_EncryptedResponse(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	handler := NewEncryption(privateKey).MiddleWare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response"))
+	}))
+
+	encryptor, err := security.NewDefaultEncryptor(&privateKey.PublicKey, "")
+	require.NoError(t, err)
+	encryptedBody, encryptedKey, err := encryptor.Encrypt([]byte("request"))
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(base64.StdEncoding.EncodeToString(encryptedBody)))
+	req.Header.Set("X-Encrypted-Key", encryptedKey.Key)
+	req.Header.Set("X-Encrypt-Response", "true")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("X-Encrypted-Response"))
+	encryptedResponse, err := base64.StdEncoding.DecodeString(rec.Body.String())
+	require.NoError(t, err)
+	response, err := encryptor.Decrypt(encryptedResponse, encryptedKey)
+	require.NoError(t, err)
+	assert.Equal(t, "response", string(response))
+}
@@ -7,7 +7,10 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/security"
 	"github.com/shadyziedan/metrica/internal/server/logger"
+	"github.com/shadyziedan/metrica/internal/server/validation"
 )
 
 type hasher interface {
@@ -16,6 +19,7 @@ type hasher interface {
 
 // HashChecker is a middleware function that checks the HashSHA256 header of incoming HTTP requests.
 // If the header doesn't match the SHA256 hash of the request body, it returns a 400 Bad Request status.
+// When the request has the X-Timestamp and X-Nonce headers, they are covered by the hash as well.
 // If the hasher is nil, it returns the next handler without any modifications.
 //
 // The function takes a hasher interface as a parameter, which must implement the Hash method.
@@ -24,6 +28,7 @@ type hasher interface {
 // The function returns a new http.Handler that wraps the provided nextHandler.
 // It reads the request body, calculates the SHA256 hash, compares it with the HashSHA256 header,
 // and sets the HashSHA256 header in the response if the hasher is not nil.
+// The response is buffered, so that the whole body is signed at once.
 func HashChecker(hasher hasher) func(http.Handler) http.Handler {
 	if hasher == nil {
 		return func(next http.Handler) http.Handler {
@@ -32,50 +37,53 @@ func HashChecker(hasher hasher) func(http.Handler) http.Handler {
 	}
 	return func(nextHandler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			responseWriter := newHashResponseWriter(w, hasher)
 			hashString := r.Header.Get("HashSHA256")
 			if hashString == "" {
-				nextHandler.ServeHTTP(responseWriter, r)
+				serveSigned(w, r, nextHandler, hasher)
 				return
 			}
 
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				logger.Log.Error("Error reading body", zap.Error(err))
-				w.WriteHeader(http.StatusBadRequest)
+				apierror.Write(w, validation.BodyError(err))
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewBuffer(body))
+			timestamp, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+			if timestamp != "" || nonce != "" {
+				body = security.SignedPayload(timestamp, nonce, body)
+			}
 			signature, err := hasher.Hash(body)
 			if err != nil {
 				logger.Log.Error("Error hashing body", zap.Error(err))
-				w.WriteHeader(http.StatusInternalServerError)
+				apierror.Write(w, err)
 				return
 			}
 
 			if signature != hashString {
 				logger.Log.Info("Invalid signature", zap.String("signature", signature), zap.String("received hash", hashString))
-				w.WriteHeader(http.StatusBadRequest)
+				apierror.Write(w, apierror.New(http.StatusBadRequest, apierror.CodeInvalidSignature, "request signature mismatch"))
 				return
 			}
-			nextHandler.ServeHTTP(responseWriter, r)
+			serveSigned(w, r, nextHandler, hasher)
 		})
 	}
 }
 
-type hashResponseWriter struct {
-	http.ResponseWriter
-	hasher hasher
-}
-
-func newHashResponseWriter(w http.ResponseWriter, hasher hasher) *hashResponseWriter {
-	return &hashResponseWriter{ResponseWriter: w, hasher: hasher}
-}
-func (w *hashResponseWriter) Write(buf []byte) (int, error) {
-	hashString, err := w.hasher.Hash(buf)
+// serveSigned buffers the whole response of the next handler and signs it with a single HashSHA256 header.
+func serveSigned(w http.ResponseWriter, r *http.Request, next http.Handler, hasher hasher) {
+	responseWriter := newBufferedResponseWriter(w)
+	next.ServeHTTP(responseWriter, r)
+	body := responseWriter.body.Bytes()
+	signature, err := hasher.Hash(body)
 	if err != nil {
-		return 0, err
+		logger.Log.Error("Error hashing response", zap.Error(err))
+		apierror.Write(w, err)
+		return
+	}
+	w.Header().Set("HashSHA256", signature)
+	if err = responseWriter.send(body); err != nil {
+		logger.Log.Error("Error writing response", zap.Error(err))
 	}
-	w.ResponseWriter.Header().Add("HashSHA256", hashString)
-	return w.ResponseWriter.Write(buf)
 }
@@ -75,6 +75,31 @@ func TestHashChecker(t *testing.T) {
 		mockHasher.AssertExpectations(t)
 	})
 
+	t.Run("valid hash with timestamp and nonce", func(t *testing.T) {
+		// Arrange
+		requestBody := []byte("test-body")
+		expectedHash := "validhash"
+
+		// The timestamp and nonce are hashed along with the body
+		mockHasher.On("Hash", []byte("1700000000\nnonce\ntest-body")).Return(expectedHash, nil).Once()
+		mockHasher.On("Hash", responseBody).Return(expectedHash, nil).Once()
+
+		middleware := HashChecker(mockHasher)
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(requestBody))
+		req.Header.Set("HashSHA256", expectedHash)
+		req.Header.Set("X-Timestamp", "1700000000")
+		req.Header.Set("X-Nonce", "nonce")
+		rec := httptest.NewRecorder()
+
+		// Act
+		middleware(handler).ServeHTTP(rec, req)
+
+		// Assert
+		assert.Equal(t, http.StatusOK, rec.Code)
+		mockHasher.AssertExpectations(t)
+	})
+
 	t.Run("missing hash header", func(t *testing.T) {
 		// Arrange
 		requestBody := []byte("test-body")
@@ -92,3 +117,23 @@ func TestHashChecker(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 	})
 }
+
+func TestHashChecker_SignsWholeResponse(t *testing.T) {
+	mockHasher := new(MockHasher)
+	mockHasher.On("Hash", []byte("first second")).Return("wholehash", nil).Once()
+
+	handler := HashChecker(mockHasher)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("first "))
+		w.Write([]byte("second"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, []string{"wholehash"}, rec.Header().Values("HashSHA256"))
+	assert.Equal(t, "first second", rec.Body.String())
+	mockHasher.AssertExpectations(t)
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/shadyziedan/metrica/internal/server/auth"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+)
+
+// RateLimit is a middleware limiting the requests of every client and passing the client quota
+// to the handlers, which consume it for the updated metrics.
+// The client is identified by its token, its certificate or its IP address, in that order,
+// so the middleware must run after Authorization and ClientIdentity.
+// If the limiter is nil, it returns the next handler without any modifications.
+func RateLimit(limiter *quota.Limiter) func(http.Handler) http.Handler {
+	if limiter == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := clientKey(r)
+			if err := limiter.AllowRequest(key); err != nil {
+				quota.WriteExceeded(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(quota.WithClient(r.Context(), limiter, key)))
+		})
+	}
+}
+
+func clientKey(r *http.Request) string {
+	if token, ok := auth.TokenFromContext(r.Context()); ok {
+		return "token:" + token.Name
+	}
+	if agentID, ok := AgentID(r.Context()); ok {
+		return "agent:" + agentID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
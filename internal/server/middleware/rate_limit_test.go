@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shadyziedan/metrica/internal/server/auth"
+	"github.com/shadyziedan/metrica/internal/server/quota"
+)
+
+func TestRateLimit(t *testing.T) {
+	handler := RateLimit(quota.NewLimiter(quota.Limits{RequestsPerSecond: 1, RequestBurst: 1}))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	send := func(remoteAddr string, token *auth.Token) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.RemoteAddr = remoteAddr
+		if token != nil {
+			req = req.WithContext(auth.WithToken(req.Context(), token))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1234", nil).Code)
+	rec := send("10.0.0.1:5678", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	// the token identifies the client regardless of its address
+	token := &auth.Token{Name: "agent"}
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1234", token).Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.2:1234", token).Code)
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/server/auth"
+	"github.com/shadyziedan/metrica/internal/server/logger"
+)
+
+// ReplayProtection is a middleware rejecting replayed signed requests.
+// Such requests must carry the X-Timestamp (unix seconds) and X-Nonce headers; a request is rejected
+// when its timestamp is further than window from the server clock or its nonce has already been seen.
+// The headers are only trustworthy when covered by the signature, so the middleware must run after HashChecker,
+// and the unsigned requests to the write routes are rejected, so that a captured request can't be replayed
+// by stripping its signature. The encryption doesn't cover the headers, so an encrypted request must be signed too.
+// If the window is not positive, it returns the next handler without any modifications.
+func ReplayProtection(window time.Duration) func(http.Handler) http.Handler {
+	if window <= 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	nonces := newNonceCache(window)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signed := r.Header.Get("HashSHA256") != ""
+			if !signed && auth.RequiredScope(r.URL.Path) == auth.ScopeWrite {
+				apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeInvalidSignature, "request signature required"))
+				return
+			}
+			if !signed {
+				next.ServeHTTP(w, r)
+				return
+			}
+			timestamp, err := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+			nonce := r.Header.Get("X-Nonce")
+			if err != nil || nonce == "" {
+				apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeReplayedRequest, "missing request timestamp or nonce"))
+				return
+			}
+			if !nonces.add(nonce, time.Unix(timestamp, 0), time.Now()) {
+				logger.Log.Info("Replayed request rejected", zap.Int64("timestamp", timestamp), zap.String("nonce", nonce))
+				apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeReplayedRequest, "request expired or replayed"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// nonceCache remembers the nonces of the requests within the clock-skew window.
+// A nonce can be forgotten once its request timestamp is out of the window, as the request would be rejected anyway.
+type nonceCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	nonces    map[string]time.Time
+	nextPrune time.Time
+}
+
+func newNonceCache(window time.Duration) *nonceCache {
+	return &nonceCache{window: window, nonces: make(map[string]time.Time)}
+}
+
+// add records the nonce and reports whether the request is fresh:
+// its timestamp is within the window and the nonce hasn't been seen before.
+func (c *nonceCache) add(nonce string, timestamp time.Time, now time.Time) bool {
+	if timestamp.Before(now.Add(-c.window)) || timestamp.After(now.Add(c.window)) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextPrune) {
+		c.prune(now)
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = timestamp
+	return true
+}
+
+func (c *nonceCache) prune(now time.Time) {
+	for nonce, timestamp := range c.nonces {
+		if timestamp.Before(now.Add(-c.window)) {
+			delete(c.nonces, nonce)
+		}
+	}
+	c.nextPrune = now.Add(c.window / 2)
+}
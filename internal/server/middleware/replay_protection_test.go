@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayProtection(t *testing.T) {
+	handler := ReplayProtection(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(timestamp time.Time, nonce string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.Header.Set("HashSHA256", "hash")
+		req.Header.Set("X-Timestamp", strconv.FormatInt(timestamp.Unix(), 10))
+		req.Header.Set("X-Nonce", nonce)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("fresh request", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(time.Now(), "nonce-1"))
+	})
+
+	t.Run("replayed nonce", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(time.Now(), "nonce-2"))
+		assert.Equal(t, http.StatusUnauthorized, send(time.Now(), "nonce-2"))
+	})
+
+	t.Run("timestamp outside the window", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, send(time.Now().Add(-2*time.Minute), "nonce-3"))
+		assert.Equal(t, http.StatusUnauthorized, send(time.Now().Add(2*time.Minute), "nonce-4"))
+	})
+
+	t.Run("missing timestamp", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.Header.Set("HashSHA256", "hash")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("unsigned request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/value/gauge/test", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestReplayProtection_RequireSignature(t *testing.T) {
+	handler := ReplayProtection(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(method, path string, headers map[string]string) int {
+		req := httptest.NewRequest(method, path, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// a captured request stripped of its signature is not accepted
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/updates/", map[string]string{
+		"X-Timestamp": timestamp, "X-Nonce": "nonce-1",
+	}))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/updates/", nil))
+	// the encryption doesn't authenticate the timestamp and the nonce
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/updates/", map[string]string{
+		"X-Encrypted-Key": "key", "X-Timestamp": timestamp, "X-Nonce": "nonce-3",
+	}))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/updates/", map[string]string{
+		"HashSHA256": "hash", "X-Timestamp": timestamp, "X-Nonce": "nonce-2",
+	}))
+	// the read routes don't need a signature
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/value/gauge/test", nil))
+}
+
+func TestNonceCache_Prune(t *testing.T) {
+	cache := newNonceCache(time.Minute)
+	now := time.Now()
+	assert.True(t, cache.add("nonce", now, now))
+	assert.False(t, cache.add("nonce", now, now.Add(30*time.Second)))
+
+	later := now.Add(2 * time.Minute)
+	assert.True(t, cache.add("other", later, later))
+	assert.NotContains(t, cache.nonces, "nonce")
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// bufferedResponseWriter keeps the response status and body in memory,
+// so that a middleware can process the whole body before it is sent.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter(w http.ResponseWriter) *bufferedResponseWriter {
+	return &bufferedResponseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+}
+
+func (w *bufferedResponseWriter) Write(buf []byte) (int, error) {
+	return w.body.Write(buf)
+}
+
+// send writes the status and the given body to the underlying response writer.
+func (w *bufferedResponseWriter) send(body []byte) error {
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
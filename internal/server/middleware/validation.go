@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+// Validation is a middleware limiting the size of the request body and passing the validator to the handlers,
+// which check the metric names and the batch size with it. It must run before the middlewares reading the body.
+// Requests declaring a larger Content-Length are rejected at once with 413 Request Entity Too Large,
+// the others fail when the body is read past the limit.
+// The streamed updates have a limit of their own, as they are applied while they are read. The memory stays flat
+// only for the unsigned and unencrypted streams though: HashChecker and Encryption buffer the whole body.
+// If the validator is nil, it returns the next handler without any modifications.
+func Validation(validator *validation.Validator) func(http.Handler) http.Handler {
+	if validator == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := validator.MaxBodyBytes()
+			if validation.IsStream(r) {
+				limit = validator.MaxStreamBytes()
+			}
+			if limit > 0 {
+				if r.ContentLength > limit {
+					apierror.Write(w, validation.BodyError(&http.MaxBytesError{Limit: limit}))
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r.WithContext(validation.WithValidator(r.Context(), validator)))
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/validation"
+)
+
+func TestValidation(t *testing.T) {
+	handler := Validation(validation.NewValidator(validation.Limits{MaxBodyBytes: 8, MaxStreamBytes: 32}, nil))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.ReadAll(r.Body); err != nil {
+				apierror.Write(w, validation.BodyError(err))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	t.Run("small body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader("[]")))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("large content length", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"Alloc"}]`)))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		var apiErr apierror.Error
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+		assert.Equal(t, apierror.CodeBodyTooLarge, apiErr.Code)
+	})
+
+	t.Run("large body of unknown length", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"Alloc"}]`))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("stream has its own limit", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/stream", strings.NewReader(`{"id":"Alloc"}`+"\n"))
+		req.Header.Set("Content-Type", models.StreamContentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req = httptest.NewRequest(http.MethodPost, "/updates/stream", strings.NewReader(strings.Repeat(`{"id":"Alloc"}`+"\n", 3)))
+		req.Header.Set("Content-Type", models.StreamContentType)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+}
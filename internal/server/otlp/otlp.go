@@ -0,0 +1,415 @@
+// Package otlp converts the OpenTelemetry (OTLP) metrics to the metrica gauges and counters.
+//
+// The data point attributes, and the configured resource attributes, become labels encoded in the series name
+// as name;key=value;key2=value2 with the keys sorted. The OTLP types are mapped as follows:
+//   - a gauge is a gauge;
+//   - an integer sum is a counter: the delta of a delta sum is added as is, a monotonic cumulative sum adds
+//     the difference from its previous value, and a non-monotonic cumulative sum is a gauge of its value;
+//     the first point of a cumulative sum that started before the converter saw it, e.g. before the server
+//     restarted, only sets the baseline of the series, as its value has most likely been added already;
+//   - a floating point sum is a gauge of its total, the running total of a delta sum is kept by the converter;
+//   - a histogram or an exponential histogram is the <name>_count counter, the <name>_sum gauge of the total
+//     and the <name>_min and <name>_max gauges when they are set;
+//   - a summary is the <name>_count counter, the <name>_sum gauge and a gauge per quantile labeled with it.
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+// DefaultResourceLabels are the resource attributes kept as labels by default.
+var DefaultResourceLabels = []string{"service.name"}
+
+// Option configures the Converter.
+type Option = func(*Converter)
+
+// WithResourceLabels sets the resource attributes kept as labels of the series.
+func WithResourceLabels(keys ...string) Option {
+	return func(c *Converter) {
+		c.resourceLabels = keys
+	}
+}
+
+// WithSeriesTTL sets the time after which the state of a series that got no points is dropped.
+func WithSeriesTTL(ttl time.Duration) Option {
+	return func(c *Converter) {
+		c.ttl = ttl
+	}
+}
+
+// DefaultSeriesTTL is the time after which the state of a series that got no points is dropped by default.
+const DefaultSeriesTTL = time.Hour
+
+// cumulative is the last value of a cumulative series along with the start of the series.
+type cumulative struct {
+	start uint64
+	value float64
+}
+
+// state is the state of a series kept by the converter.
+type state struct {
+	cumulative
+	lastSeen time.Time
+}
+
+// Converter converts the OTLP export requests to metrics. It keeps the previous values of the cumulative sums
+// and the running totals of the delta sums, so it must be shared by the requests.
+// The state of a series is dropped once it got no points for the series TTL.
+type Converter struct {
+	resourceLabels []string
+	ttl            time.Duration
+	now            func() time.Time
+
+	mu     sync.Mutex
+	series map[string]state
+	// since is the time the converter has seen every series from: when it was created or last dropped a series.
+	// A cumulative series seen for the first time that started after it is counted in full.
+	since     time.Time
+	lastSweep time.Time
+}
+
+// NewConverter creates a new Converter.
+func NewConverter(options ...Option) *Converter {
+	c := &Converter{resourceLabels: DefaultResourceLabels, ttl: DefaultSeriesTTL, now: time.Now, series: make(map[string]state)}
+	for _, option := range options {
+		option(c)
+	}
+	c.since = c.now()
+	c.lastSweep = c.since
+	return c
+}
+
+// Batch is the result of converting an export request.
+type Batch struct {
+	// Metrics are the converted metrics
+	Metrics []models.Metrics
+	// Rejected is the number of data points that couldn't be converted, a metric of an unsupported type counts as one
+	Rejected int64
+	// Message describes why the first rejected data point was rejected
+	Message string
+
+	converter *Converter
+	// series are the values the batch left its series with
+	series map[string]cumulative
+	// before are the states of the series before the batch, a missing series has none
+	before map[string]*state
+}
+
+// Rollback restores the state of the series of a batch that failed to be stored, so that its points
+// can be converted again. The series updated by a later batch since are left as they are.
+func (b *Batch) Rollback() {
+	c := b.converter
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, value := range b.series {
+		if current, ok := c.series[key]; !ok || current.cumulative != value {
+			continue
+		}
+		if before := b.before[key]; before != nil {
+			c.series[key] = *before
+		} else {
+			delete(c.series, key)
+		}
+	}
+}
+
+// Convert converts the export request. The state of its series is advanced right away, so that the concurrent
+// requests carrying the same series don't count the same increase twice; the batch must be rolled back
+// if it fails to be stored.
+func (c *Converter) Convert(request *colmetricspb.ExportMetricsServiceRequest) *Batch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep()
+	b := &Batch{converter: c, series: make(map[string]cumulative), before: make(map[string]*state)}
+	for _, resourceMetrics := range request.GetResourceMetrics() {
+		resourceLabels := c.labels(resourceMetrics.GetResource().GetAttributes())
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				b.addMetric(metric, resourceLabels)
+			}
+		}
+	}
+	return b
+}
+
+// labels returns the configured resource attributes as labels.
+func (c *Converter) labels(attributes []*commonpb.KeyValue) map[string]string {
+	labels := make(map[string]string)
+	for _, attribute := range attributes {
+		for _, key := range c.resourceLabels {
+			if attribute.GetKey() == key {
+				labels[key] = attributeValue(attribute.GetValue())
+			}
+		}
+	}
+	return labels
+}
+
+func (b *Batch) addMetric(metric *metricspb.Metric, resourceLabels map[string]string) {
+	name := metric.GetName()
+	if name == "" {
+		b.reject("metric has no name")
+		return
+	}
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, point := range data.Gauge.GetDataPoints() {
+			value, ok := numberValue(point)
+			if !ok {
+				b.reject(fmt.Sprintf("data point of %s has no value", name))
+				continue
+			}
+			b.gauge(SeriesName(name, withLabels(resourceLabels, point.GetAttributes())), value)
+		}
+	case *metricspb.Metric_Sum:
+		delta := data.Sum.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, point := range data.Sum.GetDataPoints() {
+			value, ok := numberValue(point)
+			if !ok {
+				b.reject(fmt.Sprintf("data point of %s has no value", name))
+				continue
+			}
+			series := SeriesName(name, withLabels(resourceLabels, point.GetAttributes()))
+			_, isInt := point.GetValue().(*metricspb.NumberDataPoint_AsInt)
+			switch {
+			case isInt && delta:
+				b.counter(series, point.GetAsInt())
+			case isInt && data.Sum.GetIsMonotonic():
+				b.counter(series, int64(b.cumulativeDelta(series, point.GetStartTimeUnixNano(), value)))
+			case delta:
+				b.gauge(series, b.runningTotal(series, value))
+			default:
+				b.gauge(series, value)
+			}
+		}
+	case *metricspb.Metric_Histogram:
+		delta := data.Histogram.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, point := range data.Histogram.GetDataPoints() {
+			b.histogram(name, withLabels(resourceLabels, point.GetAttributes()), delta, point.GetStartTimeUnixNano(),
+				point.GetCount(), point.Sum, point.Min, point.Max)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		delta := data.ExponentialHistogram.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, point := range data.ExponentialHistogram.GetDataPoints() {
+			b.histogram(name, withLabels(resourceLabels, point.GetAttributes()), delta, point.GetStartTimeUnixNano(),
+				point.GetCount(), point.Sum, point.Min, point.Max)
+		}
+	case *metricspb.Metric_Summary:
+		for _, point := range data.Summary.GetDataPoints() {
+			labels := withLabels(resourceLabels, point.GetAttributes())
+			sum := point.GetSum()
+			b.histogram(name, labels, false, point.GetStartTimeUnixNano(), point.GetCount(), &sum, nil, nil)
+			for _, quantile := range point.GetQuantileValues() {
+				quantileLabels := withLabels(labels, nil)
+				quantileLabels["quantile"] = strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)
+				b.gauge(SeriesName(name, quantileLabels), quantile.GetValue())
+			}
+		}
+	default:
+		b.reject(fmt.Sprintf("metric %s has no supported data", name))
+	}
+}
+
+func (b *Batch) histogram(name string, labels map[string]string, delta bool, start uint64,
+	count uint64, sum, minimum, maximum *float64) {
+	countSeries := SeriesName(name+"_count", labels)
+	if delta {
+		b.counter(countSeries, int64(count))
+	} else {
+		b.counter(countSeries, int64(b.cumulativeDelta(countSeries, start, float64(count))))
+	}
+	if sum != nil {
+		sumSeries := SeriesName(name+"_sum", labels)
+		if delta {
+			b.gauge(sumSeries, b.runningTotal(sumSeries, *sum))
+		} else {
+			b.gauge(sumSeries, *sum)
+		}
+	}
+	if minimum != nil {
+		b.gauge(SeriesName(name+"_min", labels), *minimum)
+	}
+	if maximum != nil {
+		b.gauge(SeriesName(name+"_max", labels), *maximum)
+	}
+}
+
+func (b *Batch) gauge(series string, value float64) {
+	b.Metrics = append(b.Metrics, models.Metrics{ID: series, MType: "gauge", Value: &value})
+}
+
+func (b *Batch) counter(series string, delta int64) {
+	b.Metrics = append(b.Metrics, models.Metrics{ID: series, MType: "counter", Delta: &delta})
+}
+
+func (b *Batch) reject(message string) {
+	if b.Rejected == 0 {
+		b.Message = message
+	}
+	b.Rejected++
+}
+
+// previous returns the last value of the series. It is called with the converter locked.
+func (b *Batch) previous(key string) (cumulative, bool) {
+	previous, ok := b.converter.series[key]
+	return previous.cumulative, ok
+}
+
+// set records the value of the series, keeping its state before the batch. It is called with the converter locked.
+func (b *Batch) set(key string, value cumulative) {
+	c := b.converter
+	if _, ok := b.before[key]; !ok {
+		if previous, ok := c.series[key]; ok {
+			b.before[key] = &previous
+		} else {
+			b.before[key] = nil
+		}
+	}
+	b.series[key] = value
+	c.series[key] = state{cumulative: value, lastSeen: c.now()}
+}
+
+// cumulativeDelta returns the increase of a cumulative series since its previous value.
+// A restarted or reset series counts from zero. A series seen for the first time counts from zero
+// only if it started after the converter could have seen it, otherwise its value is the baseline.
+func (b *Batch) cumulativeDelta(series string, start uint64, value float64) float64 {
+	key := "cumulative " + series
+	previous, ok := b.previous(key)
+	b.set(key, cumulative{start: start, value: value})
+	switch {
+	case !ok && (start == 0 || start < uint64(b.converter.since.UnixNano())):
+		return 0
+	case !ok || previous.start != start || value < previous.value:
+		return value
+	default:
+		return value - previous.value
+	}
+}
+
+// runningTotal adds the delta to the total of the series.
+func (b *Batch) runningTotal(series string, delta float64) float64 {
+	key := "total " + series
+	previous, _ := b.previous(key)
+	total := previous.value + delta
+	b.set(key, cumulative{value: total})
+	return total
+}
+
+// sweep drops the state of the series that got no points for the TTL, at most once per TTL.
+// It is called with the converter locked.
+func (c *Converter) sweep() {
+	now := c.now()
+	if c.ttl <= 0 || now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, s := range c.series {
+		if now.Sub(s.lastSeen) >= c.ttl {
+			delete(c.series, key)
+			// the series dropped may come back with the points counted already
+			c.since = now
+		}
+	}
+}
+
+// Series returns the number of series the converter keeps the state of.
+func (c *Converter) Series() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.series)
+}
+
+func numberValue(point *metricspb.NumberDataPoint) (float64, bool) {
+	switch value := point.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return value.AsDouble, !math.IsNaN(value.AsDouble)
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(value.AsInt), true
+	default:
+		return 0, false
+	}
+}
+
+// withLabels returns a copy of the labels with the attributes added.
+func withLabels(labels map[string]string, attributes []*commonpb.KeyValue) map[string]string {
+	result := make(map[string]string, len(labels)+len(attributes))
+	for key, value := range labels {
+		result[key] = value
+	}
+	for _, attribute := range attributes {
+		result[attribute.GetKey()] = attributeValue(attribute.GetValue())
+	}
+	return result
+}
+
+func attributeValue(value *commonpb.AnyValue) string {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// SeriesName encodes the labels in the series name as name;key=value with the keys sorted.
+// The characters outside of the default metric name character set are replaced with underscores.
+func SeriesName(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(sanitize(name))
+	for _, key := range keys {
+		sb.WriteByte(';')
+		sb.WriteString(sanitize(key))
+		sb.WriteByte('=')
+		sb.WriteString(sanitize(labels[key]))
+	}
+	return sb.String()
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == ':', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// ParseSeriesName splits the series name encoded by SeriesName into the metric name and the labels.
+// A name without labels has none, a label without a value has the empty one.
+func ParseSeriesName(series string) (string, map[string]string) {
+	name, rest, ok := strings.Cut(series, ";")
+	if !ok {
+		return name, nil
+	}
+	labels := make(map[string]string)
+	for _, label := range strings.Split(rest, ";") {
+		key, value, _ := strings.Cut(label, "=")
+		labels[key] = value
+	}
+	return name, labels
+}
@@ -0,0 +1,203 @@
+package otlp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intPoint(value int64, attributes ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{StartTimeUnixNano: 1, Attributes: attributes, Value: &metricspb.NumberDataPoint_AsInt{AsInt: value}}
+}
+
+func doublePoint(value float64, attributes ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{StartTimeUnixNano: 1, Attributes: attributes, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: value}}
+}
+
+func exportRequest(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			stringAttribute("service.name", "checkout"),
+			stringAttribute("host.name", "edge-1"),
+		}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+	}}}
+}
+
+func cumulativeSum(name string, monotonic bool, points ...*metricspb.NumberDataPoint) *metricspb.Metric {
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		IsMonotonic:            monotonic,
+		DataPoints:             points,
+	}}}
+}
+
+func deltaSum(name string, points ...*metricspb.NumberDataPoint) *metricspb.Metric {
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+		IsMonotonic:            true,
+		DataPoints:             points,
+	}}}
+}
+
+// values returns the converted metrics keyed by the series name.
+func values(metrics []models.Metrics) map[string]any {
+	result := make(map[string]any, len(metrics))
+	for _, metric := range metrics {
+		if metric.MType == "counter" {
+			result[metric.ID] = *metric.Delta
+		} else {
+			result[metric.ID] = *metric.Value
+		}
+	}
+	return result
+}
+
+func TestSeriesName(t *testing.T) {
+	assert.Equal(t, "http.requests", SeriesName("http.requests", nil))
+	assert.Equal(t, "http.requests;method=GET;route=_api_items",
+		SeriesName("http.requests", map[string]string{"route": "/api/items", "method": "GET"}))
+}
+
+func TestParseSeriesName(t *testing.T) {
+	name, labels := ParseSeriesName("http.requests")
+	assert.Equal(t, "http.requests", name)
+	assert.Empty(t, labels)
+
+	name, labels = ParseSeriesName("http.requests;method=GET;route=")
+	assert.Equal(t, "http.requests", name)
+	assert.Equal(t, map[string]string{"method": "GET", "route": ""}, labels)
+}
+
+// newConverter creates a converter that has seen every series from the start of the epoch,
+// so the cumulative series of the tests, started at 1ns, are counted in full.
+func newConverter(options ...Option) *Converter {
+	c := NewConverter(options...)
+	c.since = time.Unix(0, 0)
+	return c
+}
+
+func TestConvert(t *testing.T) {
+	c := newConverter()
+	sum, minimum, maximum := 12.5, 0.5, 8.0
+	batch := c.Convert(exportRequest(
+		&metricspb.Metric{Name: "cpu.usage", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{doublePoint(0.75, stringAttribute("cpu", "0")), intPoint(1, stringAttribute("cpu", "1"))},
+		}}},
+		cumulativeSum("requests", true, intPoint(10)),
+		cumulativeSum("queue.size", false, intPoint(4)),
+		deltaSum("bytes", intPoint(100)),
+		deltaSum("seconds", doublePoint(1.5)),
+		&metricspb.Metric{Name: "latency", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints:             []*metricspb.HistogramDataPoint{{Count: 5, Sum: &sum, Min: &minimum, Max: &maximum}},
+		}}},
+		&metricspb.Metric{Name: "rpc", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+			DataPoints: []*metricspb.SummaryDataPoint{{StartTimeUnixNano: 1, Count: 3, Sum: 0.9,
+				QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{{Quantile: 0.99, Value: 0.5}}}},
+		}}},
+		&metricspb.Metric{Name: "empty"},
+	))
+
+	assert.Equal(t, map[string]any{
+		"cpu.usage;cpu=0;service.name=checkout":   0.75,
+		"cpu.usage;cpu=1;service.name=checkout":   1.0,
+		"requests;service.name=checkout":          int64(10),
+		"queue.size;service.name=checkout":        4.0,
+		"bytes;service.name=checkout":             int64(100),
+		"seconds;service.name=checkout":           1.5,
+		"latency_count;service.name=checkout":     int64(5),
+		"latency_sum;service.name=checkout":       12.5,
+		"latency_min;service.name=checkout":       0.5,
+		"latency_max;service.name=checkout":       8.0,
+		"rpc_count;service.name=checkout":         int64(3),
+		"rpc_sum;service.name=checkout":           0.9,
+		"rpc;quantile=0.99;service.name=checkout": 0.5,
+	}, values(batch.Metrics))
+	assert.Equal(t, int64(1), batch.Rejected)
+	assert.Contains(t, batch.Message, "empty")
+}
+
+func TestConvert_CumulativeState(t *testing.T) {
+	c := newConverter(WithResourceLabels())
+
+	c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(10)), deltaSum("seconds", doublePoint(1.5))))
+
+	// a batch that is rolled back, as if it failed to be stored, doesn't advance the state
+	batch := c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(25)), deltaSum("seconds", doublePoint(2))))
+	assert.Equal(t, map[string]any{"requests": int64(15), "seconds": 3.5}, values(batch.Metrics))
+	batch.Rollback()
+	batch = c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(25)), deltaSum("seconds", doublePoint(2))))
+	assert.Equal(t, map[string]any{"requests": int64(15), "seconds": 3.5}, values(batch.Metrics))
+
+	// the points of a series in the same batch follow each other
+	batch = c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(30), intPoint(31))))
+	require.Len(t, batch.Metrics, 2)
+	assert.Equal(t, int64(5), *batch.Metrics[0].Delta)
+	assert.Equal(t, int64(1), *batch.Metrics[1].Delta)
+
+	// a reset series counts from zero
+	batch = c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(3))))
+	assert.Equal(t, map[string]any{"requests": int64(3)}, values(batch.Metrics))
+}
+
+func TestConvert_ConcurrentBatches(t *testing.T) {
+	c := newConverter(WithResourceLabels())
+	c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(10))))
+
+	// the batches converted before either is stored don't count the same increase twice
+	first := c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(15))))
+	second := c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(15))))
+	assert.Equal(t, map[string]any{"requests": int64(5)}, values(first.Metrics))
+	assert.Equal(t, map[string]any{"requests": int64(0)}, values(second.Metrics))
+
+	// rolling back a batch doesn't undo the later one
+	first = c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(20))))
+	second = c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(22))))
+	first.Rollback()
+	batch := c.Convert(exportRequest(cumulativeSum("requests", true, intPoint(23))))
+	assert.Equal(t, int64(2), *second.Metrics[0].Delta)
+	assert.Equal(t, map[string]any{"requests": int64(1)}, values(batch.Metrics))
+}
+
+func TestConvert_Baseline(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	c := NewConverter(WithResourceLabels(), WithSeriesTTL(time.Minute), func(c *Converter) {
+		c.now = func() time.Time { return now }
+	})
+	point := func(start time.Time, value int64) *metricspb.NumberDataPoint {
+		return &metricspb.NumberDataPoint{StartTimeUnixNano: uint64(start.UnixNano()), Value: &metricspb.NumberDataPoint_AsInt{AsInt: value}}
+	}
+
+	// a series started before the converter, e.g. before a restart of the server, only sets the baseline
+	batch := c.Convert(exportRequest(cumulativeSum("requests", true, point(now.Add(-time.Hour), 100))))
+	assert.Equal(t, map[string]any{"requests": int64(0)}, values(batch.Metrics))
+	batch = c.Convert(exportRequest(cumulativeSum("requests", true, point(now.Add(-time.Hour), 103))))
+	assert.Equal(t, map[string]any{"requests": int64(3)}, values(batch.Metrics))
+
+	// a series started since is counted in full
+	batch = c.Convert(exportRequest(cumulativeSum("errors", true, point(now.Add(time.Second), 2))))
+	assert.Equal(t, map[string]any{"errors": int64(2)}, values(batch.Metrics))
+
+	// the state of the idle series is dropped, a series coming back after that only sets the baseline again
+	now = now.Add(30 * time.Second)
+	c.Convert(exportRequest(cumulativeSum("errors", true, point(now.Add(-29*time.Second), 4))))
+	now = now.Add(45 * time.Second)
+	batch = c.Convert(exportRequest(cumulativeSum("errors", true, point(now.Add(-74*time.Second), 5))))
+	assert.Equal(t, map[string]any{"errors": int64(1)}, values(batch.Metrics))
+	assert.Equal(t, 1, c.Series())
+	batch = c.Convert(exportRequest(cumulativeSum("requests", true, point(now.Add(-2*time.Hour), 110))))
+	assert.Equal(t, map[string]any{"requests": int64(0)}, values(batch.Metrics))
+}
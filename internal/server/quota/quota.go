@@ -0,0 +1,234 @@
+// Package quota provides per-client limits of the server traffic: token buckets for the requests
+// and the updated metrics, and a cap on the number of distinct metric names a client may write.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+)
+
+// Limits configures the per-client quota. A zero value disables the corresponding limit.
+type Limits struct {
+	// RequestsPerSecond is the sustained rate of requests
+	RequestsPerSecond float64
+	// RequestBurst is the number of requests allowed at once
+	RequestBurst int
+	// MetricsPerSecond is the sustained rate of updated metrics
+	MetricsPerSecond float64
+	// MetricsBurst is the number of metrics allowed at once, it also limits the size of a single batch
+	MetricsBurst int
+	// MaxMetricNames is the number of distinct metric names a client may write
+	MaxMetricNames int
+	// IdleTimeout is the time after which the state of a client that sent nothing is dropped,
+	// DefaultIdleTimeout if it is not positive
+	IdleTimeout time.Duration
+}
+
+// DefaultIdleTimeout is the idle timeout used when none is configured.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// metricNamesRetryAfter is suggested to the clients that reached the cap of metric names.
+// The cap doesn't reset by itself, so the client should not retry soon.
+const metricNamesRetryAfter = time.Hour
+
+// ExceededError is returned when a client exceeds its quota.
+type ExceededError struct {
+	// Reason describes the exceeded limit
+	Reason string
+	// RetryAfter is the time after which the request may succeed
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", e.Reason)
+}
+
+// Limiter keeps the quota state of every client.
+// The state lives in memory, so the metric names written before a restart aren't counted.
+// The state of the clients idle for longer than the idle timeout is dropped, so a client coming back
+// after that starts with full buckets and no metric names counted.
+type Limiter struct {
+	limits    Limits
+	now       func() time.Time
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	mu       sync.Mutex
+	requests *bucket
+	metrics  *bucket
+	names    map[string]struct{}
+	// lastSeen is guarded by the limiter mutex
+	lastSeen time.Time
+}
+
+// NewLimiter creates a new Limiter.
+func NewLimiter(limits Limits) *Limiter {
+	if limits.IdleTimeout <= 0 {
+		limits.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Limiter{limits: limits, now: time.Now, clients: make(map[string]*client)}
+}
+
+func (l *Limiter) client(key string) *client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{
+			requests: newBucket(l.limits.RequestsPerSecond, l.limits.RequestBurst),
+			metrics:  newBucket(l.limits.MetricsPerSecond, l.limits.MetricsBurst),
+			names:    make(map[string]struct{}),
+		}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// sweep drops the idle clients. It runs at most once per idle timeout, so the map is scanned rarely.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.limits.IdleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) >= l.limits.IdleTimeout {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Clients returns the number of clients the limiter keeps the state of.
+func (l *Limiter) Clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.clients)
+}
+
+// AllowRequest takes a request from the client request bucket.
+func (l *Limiter) AllowRequest(key string) error {
+	c := l.client(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if retryAfter, ok := c.requests.take(1, l.now()); !ok {
+		return &ExceededError{Reason: "too many requests", RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// AllowMetrics takes the metrics from the client metrics bucket and records their names.
+// Nothing is taken when the metrics are rejected.
+func (l *Limiter) AllowMetrics(key string, names []string) error {
+	c := l.client(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	newNames := make(map[string]struct{})
+	if l.limits.MaxMetricNames > 0 {
+		for _, name := range names {
+			if _, ok := c.names[name]; !ok {
+				newNames[name] = struct{}{}
+			}
+		}
+		if len(c.names)+len(newNames) > l.limits.MaxMetricNames {
+			return &ExceededError{
+				Reason:     fmt.Sprintf("more than %d distinct metric names", l.limits.MaxMetricNames),
+				RetryAfter: metricNamesRetryAfter,
+			}
+		}
+	}
+
+	if retryAfter, ok := c.metrics.take(float64(len(names)), l.now()); !ok {
+		return &ExceededError{Reason: "too many metrics", RetryAfter: retryAfter}
+	}
+	for name := range newNames {
+		c.names[name] = struct{}{}
+	}
+	return nil
+}
+
+// bucket is a token bucket refilled at rate tokens per second up to burst tokens.
+// A nil bucket allows everything.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// take takes n tokens if available, otherwise it returns the time until they are.
+func (b *bucket) take(n float64, now time.Time) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if n > b.burst {
+		// the request can never be satisfied, suggest waiting for a full bucket
+		return time.Duration((b.burst - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	if b.tokens < n {
+		return time.Duration((n - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	b.tokens -= n
+	return 0, true
+}
+
+type clientKey struct{}
+
+type clientQuota struct {
+	limiter *Limiter
+	key     string
+}
+
+// WithClient returns a copy of the context carrying the client quota, so that the handlers can consume it.
+func WithClient(ctx context.Context, limiter *Limiter, key string) context.Context {
+	return context.WithValue(ctx, clientKey{}, clientQuota{limiter: limiter, key: key})
+}
+
+// AllowMetrics consumes the quota of the client in the context for the metrics.
+// It allows everything when the context has no client quota.
+func AllowMetrics(ctx context.Context, names ...string) error {
+	q, ok := ctx.Value(clientKey{}).(clientQuota)
+	if !ok {
+		return nil
+	}
+	return q.limiter.AllowMetrics(q.key, names)
+}
+
+// WriteExceeded writes the 429 error response with the Retry-After header for a quota error.
+// It returns false if the error is not a quota error and nothing was written.
+func WriteExceeded(w http.ResponseWriter, err error) bool {
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) {
+		return false
+	}
+	apiErr := apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, exceeded.Error())
+	apiErr.RetryAfter = exceeded.RetryAfter
+	apierror.Write(w, apiErr)
+	return true
+}
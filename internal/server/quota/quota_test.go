@@ -0,0 +1,97 @@
+package quota
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_AllowRequest(t *testing.T) {
+	limiter := NewLimiter(Limits{RequestsPerSecond: 2, RequestBurst: 2})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	assert.NoError(t, limiter.AllowRequest("agent-1"))
+	assert.NoError(t, limiter.AllowRequest("agent-1"))
+
+	err := limiter.AllowRequest("agent-1")
+	var exceeded *ExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, 500*time.Millisecond, exceeded.RetryAfter)
+
+	// the clients have separate buckets
+	assert.NoError(t, limiter.AllowRequest("agent-2"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.NoError(t, limiter.AllowRequest("agent-1"))
+}
+
+func TestLimiter_AllowMetrics(t *testing.T) {
+	t.Run("metrics rate", func(t *testing.T) {
+		limiter := NewLimiter(Limits{MetricsPerSecond: 10, MetricsBurst: 3})
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+
+		assert.NoError(t, limiter.AllowMetrics("agent", []string{"a", "b"}))
+		assert.Error(t, limiter.AllowMetrics("agent", []string{"c", "d"}))
+		// a batch larger than the burst is never allowed
+		assert.Error(t, limiter.AllowMetrics("other", []string{"a", "b", "c", "d"}))
+
+		now = now.Add(100 * time.Millisecond)
+		assert.NoError(t, limiter.AllowMetrics("agent", []string{"c", "d"}))
+	})
+
+	t.Run("distinct metric names", func(t *testing.T) {
+		limiter := NewLimiter(Limits{MaxMetricNames: 2})
+
+		assert.NoError(t, limiter.AllowMetrics("agent", []string{"a", "b", "a"}))
+		assert.NoError(t, limiter.AllowMetrics("agent", []string{"b"}))
+
+		err := limiter.AllowMetrics("agent", []string{"a", "c"})
+		var exceeded *ExceededError
+		require.ErrorAs(t, err, &exceeded)
+		assert.Equal(t, metricNamesRetryAfter, exceeded.RetryAfter)
+
+		assert.NoError(t, limiter.AllowMetrics("other", []string{"c"}))
+	})
+}
+
+func TestAllowMetrics(t *testing.T) {
+	assert.NoError(t, AllowMetrics(context.Background(), "a", "b"))
+
+	ctx := WithClient(context.Background(), NewLimiter(Limits{MaxMetricNames: 1}), "agent")
+	assert.NoError(t, AllowMetrics(ctx, "a"))
+	err := AllowMetrics(ctx, "b")
+	assert.Error(t, err)
+
+	rec := httptest.NewRecorder()
+	assert.True(t, WriteExceeded(rec, err))
+	assert.Equal(t, 429, rec.Code)
+	assert.Equal(t, "3600", rec.Header().Get("Retry-After"))
+}
+
+func TestLimiter_DropsIdleClients(t *testing.T) {
+	limiter := NewLimiter(Limits{MaxMetricNames: 1, IdleTimeout: time.Minute})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	require.NoError(t, limiter.AllowMetrics("agent-1", []string{"a"}))
+	require.NoError(t, limiter.AllowMetrics("agent-2", []string{"a"}))
+	assert.Equal(t, 2, limiter.Clients())
+
+	// a client active within the idle timeout is kept
+	now = now.Add(45 * time.Second)
+	require.NoError(t, limiter.AllowRequest("agent-1"))
+	now = now.Add(30 * time.Second)
+	require.NoError(t, limiter.AllowRequest("agent-1"))
+	assert.Equal(t, 1, limiter.Clients())
+	assert.Error(t, limiter.AllowMetrics("agent-1", []string{"b"}))
+
+	// a client coming back after the idle timeout starts afresh
+	assert.NoError(t, limiter.AllowMetrics("agent-2", []string{"b"}))
+	assert.Equal(t, 2, limiter.Clients())
+}
@@ -4,6 +4,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net/http"
 	"time"
@@ -30,20 +31,41 @@ func (ws *WebServer) ListenAndServe(ctx context.Context) error {
 			panic(err)
 		}
 	}()
-	err := ws.Server.ListenAndServe()
+	var err error
+	if ws.Server.TLSConfig != nil {
+		// the certificates are provided by the TLS configuration
+		err = ws.Server.ListenAndServeTLS("", "")
+	} else {
+		err = ws.Server.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 	return nil
 }
 
+// Option configures optional WebServer features.
+type Option = func(ws *WebServer)
+
+// WithTLSConfig makes the web server accept only TLS connections using the given configuration.
+// The configuration must contain the server certificate; it may also require client certificates.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(ws *WebServer) {
+		ws.Server.TLSConfig = cfg
+	}
+}
+
 // NewWebServer creates a new instance of the WebServer struct.
 // It accepts a host string and a chi.Router as parameters, and returns a pointer to the new WebServer instance.
-func NewWebServer(host string, router chi.Router) *WebServer {
-	return &WebServer{
+func NewWebServer(host string, router chi.Router, options ...Option) *WebServer {
+	ws := &WebServer{
 		Server: http.Server{
 			Addr:    host,
 			Handler: router,
 		},
 	}
+	for _, option := range options {
+		option(ws)
+	}
+	return ws
 }
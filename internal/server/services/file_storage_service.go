@@ -15,15 +15,19 @@ import (
 
 type metricsRepository interface {
 	FindOrCreate(ctx context.Context, name string, mType string) (*models.Metric, error)
+	UpdateCounter(ctx context.Context, name string, delta int64) error
+	UpdateGauge(ctx context.Context, name string, value float64) error
 	FindAll(ctx context.Context) ([]*models.Metric, error)
 	Attach(observer storage.MetricsObserver)
 	Detach(observer storage.MetricsObserver)
 }
 
 type fileStorage interface {
-	ReadMetrics() ([]*models.Metrics, error)
+	ReadSnapshot() ([]*models.Metrics, error)
+	ReadWAL() ([]*models.Metrics, error)
 	SaveMetric(*models.Metrics) error
 	SaveMetrics([]*models.Metrics) error
+	Compact(collect func() ([]*models.Metrics, error)) error
 	io.Closer
 }
 
@@ -52,22 +56,48 @@ type FileStorageServiceConfig struct {
 	FileStoragePath string
 	StoreInterval   time.Duration
 	Restore         bool
+	// CompactInterval is how often the write-ahead log is compacted into a snapshot in sync mode.
+	// Zero disables periodic compaction.
+	CompactInterval time.Duration
 }
 
-// Run starts the FileStorageService and performs the necessary operations based on the configuration settings.
-// It accepts a context as a parameter, which can be used to cancel the service gracefully.
-func (s *FileStorageService) Run(ctx context.Context) {
+// Start restores the repository if configured and, in the sync mode, attaches the service to the repository.
+// It must be called before Run and before the repository gets any update, so that no update is missed.
+func (s *FileStorageService) Start(ctx context.Context) {
 	if s.conf.Restore {
 		if err := s.restoreRepository(ctx); err != nil {
 			logger.Log.Error("Failed to restore repository", zap.Error(err))
 		}
 	}
-
 	if s.conf.StoreInterval.Seconds() == 0 { //Sync mode
 		s.Observe()
-		<-ctx.Done()
-		s.StopObserving()
-		return
+	}
+}
+
+// Run starts the FileStorageService and performs the necessary operations based on the configuration settings.
+// It accepts a context as a parameter, which can be used to cancel the service gracefully.
+func (s *FileStorageService) Run(ctx context.Context) {
+	if s.conf.StoreInterval.Seconds() == 0 { //Sync mode
+		defer s.StopObserving()
+		if s.conf.CompactInterval <= 0 {
+			<-ctx.Done()
+			return
+		}
+		compactTicker := time.NewTicker(s.conf.CompactInterval)
+		defer compactTicker.Stop()
+		for {
+			select {
+			case <-compactTicker.C:
+				err := s.fileStorage.Compact(func() ([]*models.Metrics, error) {
+					return s.collectMetrics(ctx)
+				})
+				if err != nil {
+					logger.Log.Error("Failed to compact metrics storage", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
 	}
 
 	updateStorageTicker := time.NewTicker(s.conf.StoreInterval * time.Second)
@@ -103,10 +133,18 @@ func (s *FileStorageService) Notify(metric *models.Metric) error {
 }
 
 func (s *FileStorageService) updateStorage(ctx context.Context) error {
-	metrics, err := s.metricsRepository.FindAll(ctx)
+	jsonModels, err := s.collectMetrics(ctx)
 	if err != nil {
 		return err
 	}
+	return s.fileStorage.SaveMetrics(jsonModels)
+}
+
+func (s *FileStorageService) collectMetrics(ctx context.Context) ([]*models.Metrics, error) {
+	metrics, err := s.metricsRepository.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
 	jsonModels := make([]*models.Metrics, 0, len(metrics))
 	for _, metric := range metrics {
 		model := &models.Metrics{
@@ -117,22 +155,48 @@ func (s *FileStorageService) updateStorage(ctx context.Context) error {
 		}
 		jsonModels = append(jsonModels, model)
 	}
-	return s.fileStorage.SaveMetrics(jsonModels)
+	return jsonModels, nil
 }
 
+// restoreRepository loads the last snapshot and replays the write-ahead log on top of it.
+// Torn or corrupt records are skipped by the file storage.
 func (s *FileStorageService) restoreRepository(ctx context.Context) error {
-	metrics, err := s.fileStorage.ReadMetrics()
+	snapshot, err := s.fileStorage.ReadSnapshot()
 	if err != nil {
 		return err
 	}
+	if err = s.applyMetrics(ctx, snapshot); err != nil {
+		return err
+	}
+	wal, err := s.fileStorage.ReadWAL()
+	if err != nil {
+		return err
+	}
+	return s.applyMetrics(ctx, wal)
+}
+
+// applyMetrics stores the saved values through the repository, so that a repository keeping its own copy
+// of the metrics persists them. The saved counters hold the totals, so the counters are increased by
+// the difference from their stored values.
+func (s *FileStorageService) applyMetrics(ctx context.Context, metrics []*models.Metrics) error {
 	for _, metric := range metrics {
 		model, err := s.metricsRepository.FindOrCreate(ctx, metric.ID, metric.MType)
 		if err != nil {
 			return err
 		}
-		model.MType = metric.MType
-		model.Gauge = metric.Value
-		model.Counter = metric.Delta
+		switch {
+		case metric.MType == "counter" && metric.Delta != nil:
+			var stored int64
+			if model.Counter != nil {
+				stored = *model.Counter
+			}
+			err = s.metricsRepository.UpdateCounter(ctx, metric.ID, *metric.Delta-stored)
+		case metric.MType == "gauge" && metric.Value != nil:
+			err = s.metricsRepository.UpdateGauge(ctx, metric.ID, *metric.Value)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
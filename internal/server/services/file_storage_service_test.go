@@ -23,6 +23,27 @@ func (m *mockMetricsRepository) FindOrCreate(ctx context.Context, name string, m
 	return newMetric, nil
 }
 
+// UpdateCounter and UpdateGauge replace the stored metric, like a repository keeping its own copy of the metrics.
+func (m *mockMetricsRepository) UpdateCounter(ctx context.Context, name string, delta int64) error {
+	metric := *m.metrics[name]
+	value := delta
+	if metric.Counter != nil {
+		value += *metric.Counter
+	}
+	metric.MType = "counter"
+	metric.Counter = &value
+	m.metrics[name] = &metric
+	return nil
+}
+
+func (m *mockMetricsRepository) UpdateGauge(ctx context.Context, name string, value float64) error {
+	metric := *m.metrics[name]
+	metric.MType = "gauge"
+	metric.Gauge = &value
+	m.metrics[name] = &metric
+	return nil
+}
+
 func (m *mockMetricsRepository) FindAll(ctx context.Context) ([]*models.Metric, error) {
 	var result []*models.Metric
 	for _, metric := range m.metrics {
@@ -51,6 +72,7 @@ func TestFileStorageService(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	fileStorageService.Start(ctx)
 	go fileStorageService.Run(ctx)
 
 	// Test saving and restoring metrics
@@ -70,6 +92,7 @@ func TestFileStorageService(t *testing.T) {
 		Restore:         true,
 	})
 
+	newFileStorageService.Start(ctx)
 	go newFileStorageService.Run(ctx)
 
 	// Wait for the metrics to be restored from the file storage system
@@ -80,7 +103,46 @@ func TestFileStorageService(t *testing.T) {
 		t.Error("Failed to restore metric from file storage system")
 	}
 
-	if newMetric.Name != metric.Name || newMetric.MType != metric.MType || newMetric.Gauge != metric.Gauge {
+	if newMetric.Name != metric.Name || newMetric.MType != metric.MType || *newMetric.Gauge != *metric.Gauge {
 		t.Errorf("Restored metric does not match the original metric: %+v != %+v", newMetric, metric)
 	}
 }
+
+// savedMetrics is a file storage holding a snapshot and a write-ahead log.
+type savedMetrics struct {
+	fileStorage
+	snapshot []*models.Metrics
+	wal      []*models.Metrics
+}
+
+func (s *savedMetrics) ReadSnapshot() ([]*models.Metrics, error) { return s.snapshot, nil }
+func (s *savedMetrics) ReadWAL() ([]*models.Metrics, error)      { return s.wal, nil }
+
+func TestFileStorageService_RestoreThroughRepository(t *testing.T) {
+	counter := func(value int64) *models.Metrics {
+		return &models.Metrics{ID: "PollCount", MType: "counter", Delta: &value}
+	}
+	gauge := func(value float64) *models.Metrics {
+		return &models.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+	}
+	metricsRepository := &mockMetricsRepository{metrics: make(map[string]*models.Metric)}
+	service := &FileStorageService{
+		fileStorage: &savedMetrics{
+			snapshot: []*models.Metrics{counter(10), gauge(1.5)},
+			wal:      []*models.Metrics{counter(15), gauge(2.5)},
+		},
+		metricsRepository: metricsRepository,
+	}
+
+	if err := service.restoreRepository(context.Background()); err != nil {
+		t.Fatalf("Failed to restore repository: %v", err)
+	}
+
+	// the saved counters are totals, the last one wins
+	if got := *metricsRepository.metrics["PollCount"].Counter; got != 15 {
+		t.Errorf("Restored counter = %d, want 15", got)
+	}
+	if got := *metricsRepository.metrics["Alloc"].Gauge; got != 2.5 {
+		t.Errorf("Restored gauge = %v, want 2.5", got)
+	}
+}
@@ -0,0 +1,235 @@
+// Package boltdb provides a storage implementation backed by an embedded bbolt database file.
+// It needs no external service and every update is committed with an fsync, so the stored metrics survive crashes.
+package boltdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/shadyziedan/metrica/internal/models"
+	"github.com/shadyziedan/metrica/internal/server/storage"
+)
+
+var metricsBucket = []byte("metrics")
+
+// BoltStorage is a storage implementation that uses an embedded bbolt database to store and retrieve metrics.
+type BoltStorage struct {
+	db          *bolt.DB
+	observersMu sync.RWMutex
+	observers   []storage.MetricsObserver
+}
+
+// NewBoltStorage opens (or creates) the database file at the given path and prepares the metrics bucket.
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metricsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create metrics bucket: %w", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// Close closes the underlying database file.
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// Find retrieves a metric by its name.
+func (bs *BoltStorage) Find(ctx context.Context, name string) (*models.Metric, error) {
+	var metric *models.Metric
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		metric, err = getMetric(tx.Bucket(metricsBucket), name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metric, nil
+}
+
+// Create stores a new metric without a value.
+func (bs *BoltStorage) Create(ctx context.Context, name string, mType string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metricsBucket)
+		if bucket.Get([]byte(name)) != nil {
+			return storage.ErrMetricAlreadyExists
+		}
+		return putMetric(bucket, &models.Metric{Name: name, MType: mType})
+	})
+}
+
+// FindOrCreate retrieves a metric by its name, or creates a new one if it doesn't exist.
+func (bs *BoltStorage) FindOrCreate(ctx context.Context, name string, mType string) (*models.Metric, error) {
+	var metric *models.Metric
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metricsBucket)
+		var err error
+		metric, err = getMetric(bucket, name)
+		if !errors.Is(err, storage.ErrMetricNotFound) {
+			// a stored metric that can't be decoded is reported rather than overwritten
+			return err
+		}
+		metric = &models.Metric{Name: name, MType: mType}
+		return putMetric(bucket, metric)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metric, nil
+}
+
+// FindAll retrieves all stored metrics.
+func (bs *BoltStorage) FindAll(ctx context.Context) ([]*models.Metric, error) {
+	var metrics []*models.Metric
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metricsBucket).ForEach(func(_, v []byte) error {
+			metric := &models.Metric{}
+			if err := json.Unmarshal(v, metric); err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// Count returns the number of stored metrics without decoding them.
+func (bs *BoltStorage) Count(ctx context.Context) (int, error) {
+	var count int
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(metricsBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// FindAllByName retrieves the metrics with the given names, skipping names that don't exist.
+func (bs *BoltStorage) FindAllByName(ctx context.Context, names []string) ([]*models.Metric, error) {
+	metrics := make([]*models.Metric, 0, len(names))
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metricsBucket)
+		for _, name := range names {
+			metric, err := getMetric(bucket, name)
+			if errors.Is(err, storage.ErrMetricNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// UpdateCounter increments the counter of a metric by the given delta.
+func (bs *BoltStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
+	return bs.update(ctx, name, func(metric *models.Metric) {
+		metric.MType = "counter"
+		metric.UpdateCounter(delta)
+	})
+}
+
+// UpdateGauge replaces the gauge value of a metric.
+func (bs *BoltStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return bs.update(ctx, name, func(metric *models.Metric) {
+		metric.MType = "gauge"
+		metric.UpdateGauge(value)
+	})
+}
+
+// Attach adds an observer to the BoltStorage instance.
+func (bs *BoltStorage) Attach(observer storage.MetricsObserver) {
+	bs.observersMu.Lock()
+	defer bs.observersMu.Unlock()
+	bs.observers = append(bs.observers, observer)
+}
+
+// Detach removes an observer from the BoltStorage instance.
+func (bs *BoltStorage) Detach(observer storage.MetricsObserver) {
+	bs.observersMu.Lock()
+	defer bs.observersMu.Unlock()
+	bs.observers = slices.DeleteFunc(bs.observers, func(o storage.MetricsObserver) bool {
+		return o == observer
+	})
+}
+
+// update applies fn to the stored metric in a single transaction and notifies the observers once it is committed.
+func (bs *BoltStorage) update(ctx context.Context, name string, fn func(metric *models.Metric)) error {
+	var metric *models.Metric
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metricsBucket)
+		var err error
+		metric, err = getMetric(bucket, name)
+		if err != nil {
+			return err
+		}
+		fn(metric)
+		return putMetric(bucket, metric)
+	})
+	if err != nil {
+		return err
+	}
+	return bs.notify(ctx, metric)
+}
+
+// notify notifies all attached observers about a metric update.
+func (bs *BoltStorage) notify(ctx context.Context, model *models.Metric) error {
+	bs.observersMu.RLock()
+	observers := slices.Clone(bs.observers)
+	bs.observersMu.RUnlock()
+	for _, observer := range observers {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			if err := observer.Notify(model); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getMetric(bucket *bolt.Bucket, name string) (*models.Metric, error) {
+	data := bucket.Get([]byte(name))
+	if data == nil {
+		return nil, storage.ErrMetricNotFound
+	}
+	metric := &models.Metric{}
+	if err := json.Unmarshal(data, metric); err != nil {
+		return nil, fmt.Errorf("failed to decode metric %s: %w", name, err)
+	}
+	return metric, nil
+}
+
+func putMetric(bucket *bolt.Bucket, metric *models.Metric) error {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(metric.Name), data)
+}
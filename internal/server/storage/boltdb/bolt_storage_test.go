@@ -0,0 +1,116 @@
+package boltdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+type mockObserver struct {
+	metric *models.Metric
+}
+
+func (m *mockObserver) Notify(metric *models.Metric) error {
+	m.metric = metric
+	return nil
+}
+
+func newTestStorage(t *testing.T) (*BoltStorage, string) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	bs, err := NewBoltStorage(path)
+	require.NoError(t, err)
+	return bs, path
+}
+
+func TestBoltStorage_CreateAndFind(t *testing.T) {
+	bs, _ := newTestStorage(t)
+	defer bs.Close()
+	ctx := context.Background()
+
+	require.NoError(t, bs.Create(ctx, "metric1", "gauge"))
+	assert.EqualError(t, bs.Create(ctx, "metric1", "gauge"), "metric has been already created")
+
+	metric, err := bs.Find(ctx, "metric1")
+	require.NoError(t, err)
+	assert.Equal(t, "metric1", metric.Name)
+	assert.Equal(t, "gauge", metric.MType)
+
+	_, err = bs.Find(ctx, "metric2")
+	assert.EqualError(t, err, "metric not found")
+}
+
+func TestBoltStorage_FindOrCreateCorrupt(t *testing.T) {
+	bs, _ := newTestStorage(t)
+	defer bs.Close()
+	require.NoError(t, bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metricsBucket).Put([]byte("metric1"), []byte("{broken"))
+	}))
+
+	// the corrupt record is reported and kept as it is
+	_, err := bs.FindOrCreate(context.Background(), "metric1", "gauge")
+	assert.ErrorContains(t, err, "failed to decode metric metric1")
+	require.NoError(t, bs.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, "{broken", string(tx.Bucket(metricsBucket).Get([]byte("metric1"))))
+		return nil
+	}))
+}
+
+func TestBoltStorage_Updates(t *testing.T) {
+	bs, _ := newTestStorage(t)
+	defer bs.Close()
+	ctx := context.Background()
+	observer := &mockObserver{}
+	bs.Attach(observer)
+
+	_, err := bs.FindOrCreate(ctx, "PollCount", "counter")
+	require.NoError(t, err)
+	require.NoError(t, bs.UpdateCounter(ctx, "PollCount", 5))
+	require.NoError(t, bs.UpdateCounter(ctx, "PollCount", 7))
+	assert.Equal(t, int64(12), *observer.metric.Counter)
+
+	_, err = bs.FindOrCreate(ctx, "Alloc", "gauge")
+	require.NoError(t, err)
+	require.NoError(t, bs.UpdateGauge(ctx, "Alloc", 10.5))
+	assert.Equal(t, 10.5, *observer.metric.Gauge)
+
+	bs.Detach(observer)
+	require.NoError(t, bs.UpdateGauge(ctx, "Alloc", 11.5))
+	assert.Equal(t, 10.5, *observer.metric.Gauge)
+
+	assert.EqualError(t, bs.UpdateGauge(ctx, "unknown", 1), "metric not found")
+
+	metrics, err := bs.FindAllByName(ctx, []string{"Alloc", "unknown"})
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 11.5, *metrics[0].Gauge)
+}
+
+func TestBoltStorage_Reopen(t *testing.T) {
+	bs, path := newTestStorage(t)
+	ctx := context.Background()
+
+	_, err := bs.FindOrCreate(ctx, "PollCount", "counter")
+	require.NoError(t, err)
+	require.NoError(t, bs.UpdateCounter(ctx, "PollCount", 3))
+	require.NoError(t, bs.Close())
+
+	reopened, err := NewBoltStorage(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	metrics, err := reopened.FindAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "PollCount", metrics[0].Name)
+	assert.Equal(t, int64(3), *metrics[0].Counter)
+
+	count, err := reopened.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
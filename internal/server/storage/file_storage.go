@@ -2,11 +2,18 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"go.uber.org/zap"
@@ -17,191 +24,301 @@ import (
 )
 
 // FileStorage is a storage implementation that uses a file to store and retrieve metrics.
+//
+// The state is kept in two files: a compacted snapshot at fileName and an append-only write-ahead log
+// next to it. Every record is written on its own line prefixed with a CRC-32C checksum, so records torn by
+// a crash are detected and skipped on read. A torn record at the end of the log is cut off before the first append,
+// so that the next record starts on a line of its own. Snapshots are written to a temporary file and atomically renamed
+// over the previous one, after which the write-ahead log is truncated.
 type FileStorage struct {
-	producer *producer
-	consumer *consumer
 	fileName string
+	walName  string
 	mode     Mode
 
 	mutex sync.RWMutex
+	// walRepaired is set once the torn tail of the write-ahead log left by a crash is cut off
+	walRepaired bool
 }
 
 // NewFileStorage creates a new instance of FileStorage.
 func NewFileStorage(fileName string, mode Mode) *FileStorage {
-	return &FileStorage{fileName: fileName, mode: mode}
+	return &FileStorage{fileName: fileName, walName: fileName + ".wal", mode: mode}
 }
 
-type producer struct {
-	file    *os.File
-	encoder *json.Encoder
-}
+type Mode string
 
-type consumer struct {
-	file    *os.File
-	decoder *json.Decoder
-}
+const (
+	Sync   Mode = "sync"
+	Normal Mode = "normal"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
-func newConsumer(fileName string) (*consumer, error) {
-	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0666)
+// errCorruptRecord is returned when a record checksum doesn't match its payload.
+var errCorruptRecord = errors.New("corrupt record")
+
+// ReadMetrics returns the snapshot records followed by the write-ahead log records.
+func (fs *FileStorage) ReadMetrics() ([]*models.Metrics, error) {
+	snapshot, err := fs.ReadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	wal, err := fs.ReadWAL()
 	if err != nil {
 		return nil, err
 	}
-	return &consumer{file: file, decoder: json.NewDecoder(file)}, nil
+	return append(snapshot, wal...), nil
 }
 
-type Mode string
+// ReadSnapshot returns the records of the last compacted snapshot.
+func (fs *FileStorage) ReadSnapshot() ([]*models.Metrics, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return readRecords(fs.fileName)
+}
 
-const (
-	Sync   Mode = "sync"
-	Normal Mode = "normal"
-)
+// ReadWAL returns the records appended to the write-ahead log since the last snapshot, in write order.
+func (fs *FileStorage) ReadWAL() ([]*models.Metrics, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return readRecords(fs.walName)
+}
 
-func newProducer(fileName string, mode Mode) (*producer, error) {
-	var flag int
-	switch mode {
-	case Sync:
-		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND | os.O_SYNC
-	case Normal:
-		flag = os.O_WRONLY | os.O_CREATE | os.O_SYNC
+// SaveMetric appends the metric to the write-ahead log.
+func (fs *FileStorage) SaveMetric(metric *models.Metrics) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !fs.walRepaired {
+		// the log is read back to find the torn tail
+		flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	if fs.mode == Sync {
+		flag |= os.O_SYNC
 	}
 	var file *os.File
 	err := retry.WithBackoff(context.Background(), 3, func(err error) bool {
 		return err != nil
 	}, func() error {
 		var openErr error
-		file, openErr = os.OpenFile(fileName, flag, 0666)
+		file, openErr = os.OpenFile(fs.walName, flag, 0666)
 		return openErr
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &producer{file: file, encoder: json.NewEncoder(file)}, nil
-}
-
-func (fs *FileStorage) ReadMetrics() ([]*models.Metrics, error) {
-	fs.mutex.RLock()
-	defer fs.mutex.RUnlock()
-	if err := fs.OpenConsumer(); err != nil {
-		return nil, err
+	if !fs.walRepaired {
+		if err = truncateTornTail(file); err != nil {
+			file.Close()
+			return err
+		}
+		fs.walRepaired = true
 	}
 	defer func() {
-		if err := fs.CloseConsumer(); err != nil {
-			logger.Log.Info("close consumer error", zap.Error(err))
+		if err := file.Close(); err != nil {
+			logger.Log.Error("close write-ahead log failed", zap.Error(err))
 		}
 	}()
-	var res []*models.Metrics
-	for {
-		model := &models.Metrics{}
-		err := fs.consumer.decoder.Decode(&model)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, model)
-	}
-	return res, nil
-}
 
-func (fs *FileStorage) SaveMetric(metric *models.Metrics) error {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
-	err := fs.OpenProducer()
+	record, err := encodeRecord(metric)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := fs.CloseProducer(); err != nil {
-			logger.Log.Error("close producer failed", zap.Error(err))
-		}
-	}()
-	return fs.producer.encoder.Encode(metric)
+	_, err = file.Write(record)
+	return err
 }
 
+// SaveMetrics writes the metrics as a new snapshot and truncates the write-ahead log.
 func (fs *FileStorage) SaveMetrics(metrics []*models.Metrics) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
+	return fs.writeSnapshot(metrics)
+}
 
-	if err := fs.OpenProducer(); err != nil {
+// Compact collects the current state and writes it as a new snapshot, truncating the write-ahead log.
+// The storage is locked while collect runs, so no record is appended to the log between collecting the state
+// and truncating the log.
+func (fs *FileStorage) Compact(collect func() ([]*models.Metrics, error)) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	metrics, err := collect()
+	if err != nil {
 		return err
 	}
+	return fs.writeSnapshot(metrics)
+}
+
+// Close implements io.Closer. Files are opened per operation, so there is nothing left to release.
+func (fs *FileStorage) Close() error {
+	return nil
+}
+
+func (fs *FileStorage) writeSnapshot(metrics []*models.Metrics) error {
+	dir := filepath.Dir(fs.fileName)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fs.fileName)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
 	defer func() {
-		if err := fs.CloseProducer(); err != nil {
-			panic(err)
+		// the temporary file is already renamed on success
+		if err := os.Remove(tmp.Name()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Error("failed to remove temporary snapshot", zap.Error(err))
 		}
 	}()
+
+	w := bufio.NewWriter(tmp)
 	for _, metric := range metrics {
-		if err := fs.producer.encoder.Encode(metric); err != nil {
+		record, err := encodeRecord(metric)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err = w.Write(record); err != nil {
+			tmp.Close()
 			return err
 		}
 	}
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to flush snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), fs.fileName); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	if err = syncDir(dir); err != nil {
+		return err
+	}
+	if err = os.Truncate(fs.walName, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
 	return nil
 }
 
-func (c *consumer) Close() error {
-	return c.file.Close()
-}
-
-func (p *producer) Close() error {
-	return p.file.Close()
-}
-
-func (fs *FileStorage) CloseProducer() error {
-	if fs.producer == nil {
-		return nil
+// truncateTornTail cuts off the bytes following the last complete line of the file, i.e. a record torn by a crash.
+// Otherwise the next record would be appended to the torn one and be lost with it.
+func truncateTornTail(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
 	}
-
-	defer func() { fs.producer = nil }()
-
-	if err := fs.producer.file.Sync(); err != nil {
-		return fmt.Errorf("failed to flush producer file: %w", err)
+	size := info.Size()
+	end := int64(0)
+	buf := make([]byte, 4096)
+	for offset := size; offset > 0; {
+		n := int64(len(buf))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err = file.ReadAt(buf[:n], offset); err != nil {
+			return fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = offset + int64(i) + 1
+			break
+		}
 	}
-
-	if err := fs.producer.file.Close(); err != nil {
-		return fmt.Errorf("failed to close producer file: %w", err)
+	if end == size {
+		return nil
+	}
+	logger.Log.Warn("truncating torn record at the end of the write-ahead log",
+		zap.String("file", file.Name()),
+		zap.Int64("bytes", size-end),
+	)
+	if err = file.Truncate(end); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
 	}
 	return nil
 }
-func (fs *FileStorage) CloseConsumer() error {
-	if fs.consumer == nil {
-		return nil
-	}
 
-	defer func() { fs.consumer = nil }()
-
-	if err := fs.consumer.file.Sync(); err != nil {
-		return fmt.Errorf("failed to flush consumer file: %w", err)
+// syncDir flushes the directory entry so that a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-
-	if err := fs.consumer.file.Close(); err != nil {
-		return fmt.Errorf("failed to close consumer file: %w", err)
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to flush directory %s: %w", dir, err)
 	}
-
 	return nil
 }
 
-func (fs *FileStorage) Close() error {
-	if err := fs.CloseProducer(); err != nil {
-		return err
+// encodeRecord encodes the metric as a single line in the form "<crc32c hex> <json>\n".
+func encodeRecord(metric *models.Metrics) ([]byte, error) {
+	payload, err := json.Marshal(metric)
+	if err != nil {
+		return nil, err
 	}
-	return fs.CloseConsumer()
+	record := make([]byte, 0, len(payload)+10)
+	record = hex.AppendEncode(record, binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crcTable)))
+	record = append(record, ' ')
+	record = append(record, payload...)
+	return append(record, '\n'), nil
 }
 
-func (fs *FileStorage) OpenProducer() error {
-	p, err := newProducer(fs.fileName, fs.mode)
-	if err != nil {
-		return err
+// decodeRecord parses a single record line. Plain JSON lines written by older versions are accepted as is.
+func decodeRecord(line []byte) (*models.Metrics, error) {
+	payload := line
+	if len(line) > 0 && line[0] != '{' {
+		checksum, rest, found := bytes.Cut(line, []byte{' '})
+		if !found {
+			return nil, errCorruptRecord
+		}
+		want, err := hex.DecodeString(string(checksum))
+		if err != nil || !bytes.Equal(want, binary.BigEndian.AppendUint32(nil, crc32.Checksum(rest, crcTable))) {
+			return nil, errCorruptRecord
+		}
+		payload = rest
 	}
-	fs.producer = p
-	return nil
+	metric := &models.Metrics{}
+	if err := json.Unmarshal(payload, metric); err != nil {
+		return nil, fmt.Errorf("%w: %w", errCorruptRecord, err)
+	}
+	return metric, nil
 }
 
-func (fs *FileStorage) OpenConsumer() error {
-	c, err := newConsumer(fs.fileName)
+// readRecords reads every valid record of the file, skipping torn or corrupt ones.
+// A missing file is treated as empty.
+func readRecords(fileName string) ([]*models.Metrics, error) {
+	file, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer file.Close()
+
+	var res []*models.Metrics
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			metric, decodeErr := decodeRecord(bytes.TrimSpace(line))
+			if decodeErr != nil {
+				logger.Log.Warn("skipping corrupt record",
+					zap.String("file", fileName),
+					zap.Int("line", lineNumber),
+					zap.Error(decodeErr),
+				)
+			} else {
+				res = append(res, metric)
+			}
+		}
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	fs.consumer = c
-	return nil
 }
@@ -208,3 +208,93 @@ func BenchmarkFileStorageRead(b *testing.B) {
 		}
 	}
 }
+
+func TestFileStorage_SnapshotTruncatesWAL(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	fs := NewFileStorage(fileName, Sync)
+
+	delta := int64(10)
+	gauge := 20.5
+	require.NoError(t, fs.SaveMetric(&models.Metrics{ID: "metric1", MType: "counter", Delta: &delta}))
+	require.NoError(t, fs.SaveMetrics([]*models.Metrics{{ID: "metric2", MType: "gauge", Value: &gauge}}))
+
+	wal, err := fs.ReadWAL()
+	require.NoError(t, err)
+	require.Empty(t, wal)
+
+	snapshot, err := fs.ReadSnapshot()
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	require.Equal(t, "metric2", snapshot[0].ID)
+
+	newDelta := int64(15)
+	require.NoError(t, fs.Compact(func() ([]*models.Metrics, error) {
+		return []*models.Metrics{{ID: "metric1", MType: "counter", Delta: &newDelta}}, nil
+	}))
+	snapshot, err = fs.ReadSnapshot()
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	require.Equal(t, newDelta, *snapshot[0].Delta)
+
+	matches, err := filepath.Glob(fileName + ".tmp-*")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func TestFileStorage_SkipsTornRecords(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	fs := NewFileStorage(fileName, Sync)
+
+	delta := int64(10)
+	require.NoError(t, fs.SaveMetric(&models.Metrics{ID: "metric1", MType: "counter", Delta: &delta}))
+
+	// a record with a wrong checksum and a record torn in the middle of a write
+	f, err := os.OpenFile(fileName+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteString("00000000 {\"id\":\"metric2\",\"type\":\"counter\",\"delta\":1}\n")
+	require.NoError(t, err)
+	record, err := encodeRecord(&models.Metrics{ID: "metric3", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)/2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	metrics, err := fs.ReadWAL()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	require.Equal(t, "metric1", metrics[0].ID)
+}
+
+func TestFileStorage_AppendsAfterTornRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	delta := int64(10)
+	require.NoError(t, NewFileStorage(fileName, Sync).SaveMetric(&models.Metrics{ID: "metric1", MType: "counter", Delta: &delta}))
+
+	// the server crashed in the middle of a write
+	f, err := os.OpenFile(fileName+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	record, err := encodeRecord(&models.Metrics{ID: "metric2", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)/2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// after the restart the next record isn't glued to the torn one
+	fs := NewFileStorage(fileName, Sync)
+	require.NoError(t, fs.SaveMetric(&models.Metrics{ID: "metric3", MType: "counter", Delta: &delta}))
+	metrics, err := fs.ReadWAL()
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	require.Equal(t, "metric1", metrics[0].ID)
+	require.Equal(t, "metric3", metrics[1].ID)
+}
+
+func TestFileStorage_ReadsLegacyRecords(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(fileName, []byte("{\"id\":\"metric1\",\"type\":\"gauge\",\"value\":1.5}\n"), 0666))
+
+	metrics, err := NewFileStorage(fileName, Normal).ReadMetrics()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	require.Equal(t, 1.5, *metrics[0].Value)
+}
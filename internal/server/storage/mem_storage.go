@@ -14,6 +14,7 @@ import (
 type MemStorage struct {
 	storage          map[string]*models.Metric
 	m                sync.RWMutex
+	observersMu      sync.RWMutex
 	metricsObservers []MetricsObserver
 }
 
@@ -22,10 +23,14 @@ type MetricsObserver interface {
 }
 
 func (s *MemStorage) Attach(observer MetricsObserver) {
+	s.observersMu.Lock()
+	defer s.observersMu.Unlock()
 	s.metricsObservers = append(s.metricsObservers, observer)
 }
 
 func (s *MemStorage) Detach(observer MetricsObserver) {
+	s.observersMu.Lock()
+	defer s.observersMu.Unlock()
 	s.metricsObservers = slices.DeleteFunc(s.metricsObservers, func(o MetricsObserver) bool {
 		return o == observer
 	})
@@ -44,6 +49,13 @@ func (s *MemStorage) FindAll(ctx context.Context) ([]*models.Metric, error) {
 	return maps.Values(s.storage), nil
 }
 
+// Count returns the number of stored metrics.
+func (s *MemStorage) Count(ctx context.Context) (int, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return len(s.storage), nil
+}
+
 // FindOrCreate implements MetricsRepository.
 func (s *MemStorage) FindOrCreate(ctx context.Context, name string, mType string) (*models.Metric, error) {
 	if metric, err := s.Find(ctx, name); err == nil {
@@ -110,8 +122,12 @@ func (s *MemStorage) FindAllByName(ctx context.Context, names []string) ([]*mode
 	return res, nil
 }
 
+// notify notifies the observers attached when it is called, an observer may detach itself meanwhile.
 func (s *MemStorage) notify(ctx context.Context, model *models.Metric) error {
-	for _, metricsObserver := range s.metricsObservers {
+	s.observersMu.RLock()
+	observers := slices.Clone(s.metricsObservers)
+	s.observersMu.RUnlock()
+	for _, metricsObserver := range observers {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -55,6 +57,10 @@ func TestMemStorage_FindAll(t *testing.T) {
 	metrics, err := storage.FindAll(context.Background())
 	require.NoError(t, err)
 	assert.Len(t, metrics, 2)
+
+	count, err := storage.Count(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
 }
 
 func TestMemStorage_FindOrCreate(t *testing.T) {
@@ -134,6 +140,45 @@ func TestMemStorage_AttachDetach(t *testing.T) {
 	assert.Len(t, storage.metricsObservers, 0)
 }
 
+// countingObserver counts the notifications, it may be notified concurrently.
+type countingObserver struct {
+	count atomic.Int64
+}
+
+func (o *countingObserver) Notify(*models.Metric) error {
+	o.count.Add(1)
+	return nil
+}
+
+func TestMemStorage_ConcurrentObservers(t *testing.T) {
+	storage := NewMemStorage()
+	ctx := context.Background()
+	require.NoError(t, storage.Create(ctx, "metric", "gauge"))
+	attached := &countingObserver{}
+	storage.Attach(attached)
+
+	// the observers are attached and detached while the metric is updated, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				observer := &countingObserver{}
+				storage.Attach(observer)
+				storage.Detach(observer)
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		require.NoError(t, storage.UpdateGauge(ctx, "metric", float64(j)))
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(100), attached.count.Load())
+	assert.Len(t, storage.metricsObservers, 1)
+}
+
 func TestMemStorage_Notify(t *testing.T) {
 	storage := NewMemStorage()
 	observer := &mockObserver{}
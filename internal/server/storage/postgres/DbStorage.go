@@ -4,6 +4,7 @@ package postgres
 import (
 	"context"
 	"slices"
+	"sync"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -13,9 +14,25 @@ import (
 )
 
 // DBStorage is a storage implementation that uses a PostgreSQL database to store and retrieve metrics.
+// Updates are recorded as samples in the time-partitioned metric_samples table, which is the source of truth;
+// the metrics table holds the current values derived from the samples.
 type DBStorage struct {
-	conn      pgConn
-	observers []storage.MetricsObserver
+	conn         pgConn
+	replicaConns []replicaConn
+	replicas     *ReplicaSet
+	observersMu  sync.RWMutex
+	observers    []storage.MetricsObserver
+}
+
+// Option configures optional DBStorage features.
+type Option = func(db *DBStorage)
+
+// WithReplicas routes the read queries (Find, FindAll and FindAllByName) to the given read replicas.
+// Writes and the reads following them always go to the primary.
+func WithReplicas(replicas ...replicaConn) Option {
+	return func(db *DBStorage) {
+		db.replicaConns = append(db.replicaConns, replicas...)
+	}
 }
 
 // pgConn is an interface that wraps the pgx.Conn type for easier testing.
@@ -27,35 +44,34 @@ type pgConn interface {
 }
 
 // NewDBStorage creates a new instance of DBStorage.
-func NewDBStorage(conn pgConn) (*DBStorage, error) {
-	postgresConn := &pgConnWrapper{conn: conn}
-	_, err := postgresConn.Exec(context.Background(), `
-create table if not exists metrics
-(
-    id      serial,
-    name    varchar not null,
-    m_type  varchar not null,
-    counter bigint,
-    gauge   decimal
-);
-create unique index if not exists metrics_name_uindex on metrics (name);
-`)
+// It applies the pending schema migrations before returning.
+func NewDBStorage(conn pgConn, options ...Option) (*DBStorage, error) {
+	postgresConn := newPgConnWrapper(conn)
+	migrator, err := NewMigrator(postgresConn)
 	if err != nil {
 		return nil, err
 	}
-	return &DBStorage{conn: postgresConn}, nil
+	if err = migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	db := &DBStorage{conn: postgresConn}
+	for _, option := range options {
+		option(db)
+	}
+	db.replicas = NewReplicaSet(postgresConn, db.replicaConns...)
+	return db, nil
+}
+
+// RunHealthChecks checks the read replicas health periodically until the context is canceled.
+func (db *DBStorage) RunHealthChecks(ctx context.Context) {
+	db.replicas.Run(ctx)
 }
 
 // Constants for SQL queries.
 const findMetric = `SELECT name, m_type, gauge, counter FROM metrics WHERE name = $1;`
 const createMetric = `INSERT INTO metrics (name, m_type) values ($1, $2)`
-const updateCounter = `
-        INSERT INTO metrics (name, m_type, counter)
-        VALUES ($1, 'counter', $2)
-        ON CONFLICT (name) DO UPDATE
-        SET counter = coalesce(metrics.counter, 0) + $2
-    `
-const updateGauge = `UPDATE metrics SET gauge = $1 WHERE name = $2;`
+const insertCounterSample = `INSERT INTO metric_samples (name, m_type, counter) VALUES ($1, 'counter', $2)`
+const insertGaugeSample = `INSERT INTO metric_samples (name, m_type, gauge) VALUES ($1, 'gauge', $2)`
 const findOrCreateMetric = `
 WITH inserted AS (
     INSERT INTO metrics (name, m_type) values ($1, $2)
@@ -66,17 +82,22 @@ SELECT * FROM inserted
 UNION
 SELECT name, m_type, gauge, counter FROM metrics WHERE name = $1;`
 const findAllMetrics = `SELECT name, m_type, gauge, counter FROM metrics`
-const findMetricsByName = `SELECT name, m_type, gauge, counter FROM metrics where name IN ($1)`
+const findMetricsByName = `SELECT name, m_type, gauge, counter FROM metrics where name = ANY($1)`
+const countMetrics = `SELECT count(*) FROM metrics`
+
+// metricSamplesTable and metricSamplesColumns describe the samples table for bulk inserts.
+var (
+	metricSamplesTable   = pgx.Identifier{"metric_samples"}
+	metricSamplesColumns = []string{"name", "m_type", "counter", "gauge"}
+)
 
 // Find retrieves a metric from the database by its name.
-func (db *DBStorage) Find(ctx context.Context, name string) (*models.Metric, error) {
-	row := db.conn.QueryRow(ctx, findMetric, name)
-	var metric models.Metric
-	err := row.Scan(&metric.Name, &metric.MType, &metric.Gauge, &metric.Counter)
-	if err != nil {
-		return nil, err
-	}
-	return &metric, err
+func (db *DBStorage) Find(ctx context.Context, name string) (metric *models.Metric, err error) {
+	err = db.read(ctx, func(conn pgConn) error {
+		metric, err = find(ctx, conn, name)
+		return err
+	})
+	return
 }
 
 // Create inserts a new metric into the database.
@@ -85,40 +106,73 @@ func (db *DBStorage) Create(ctx context.Context, name string, mType string) erro
 	return err
 }
 
-// UpdateCounter updates the counter of a metric in the database by a specified delta.
+// UpdateCounter records a counter sample with the given delta.
+// The current value in the metrics table is derived from the sample by the database.
 func (db *DBStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
-	tx, err := db.conn.Begin(ctx)
+	_, err := db.conn.Exec(ctx, insertCounterSample, name, delta)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback(ctx)
-	_, err = tx.Exec(ctx, updateCounter, name, delta)
-	if err != nil {
-		return err
-	}
-	if err = tx.Commit(ctx); err != nil {
-		return err
-	}
-	updatedMetric, err := db.Find(ctx, name)
+	updatedMetric, err := find(ctx, db.conn, name)
 	if err != nil {
 		return err
 	}
 	return db.notify(ctx, updatedMetric)
 }
 
-// UpdateGauge updates the gauge value of a metric in the database.
+// UpdateGauge records a gauge sample with the given value.
+// The current value in the metrics table is derived from the sample by the database.
 func (db *DBStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
-	_, err := db.conn.Exec(ctx, updateGauge, value, name)
+	_, err := db.conn.Exec(ctx, insertGaugeSample, name, value)
 	if err != nil {
 		return err
 	}
-	updatedModel, err := db.Find(ctx, name)
+	updatedModel, err := find(ctx, db.conn, name)
 	if err != nil {
 		return err
 	}
 	return db.notify(ctx, updatedModel)
 }
 
+// UpdateBatch records the samples of all the given metrics with a single bulk insert
+// and returns the updated metrics, once each, with their values after the whole batch.
+// The metrics are expected to be validated by the caller.
+func (db *DBStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) ([]*models.Metric, error) {
+	rows := make([][]any, 0, len(metrics))
+	names := make([]string, 0, len(metrics))
+	seen := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		rows = append(rows, []any{metric.ID, metric.MType, metric.Delta, metric.Value})
+		if _, ok := seen[metric.ID]; !ok {
+			seen[metric.ID] = struct{}{}
+			names = append(names, metric.ID)
+		}
+	}
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err = tx.CopyFrom(ctx, metricSamplesTable, metricSamplesColumns, pgx.CopyFromRows(rows)); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	updatedMetrics, err := findAllByName(ctx, db.conn, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range updatedMetrics {
+		if err = db.notify(ctx, metric); err != nil {
+			return nil, err
+		}
+	}
+	return updatedMetrics, nil
+}
+
 // FindOrCreate retrieves a metric from the database by its name, or creates a new one if it doesn't exist.
 func (db *DBStorage) FindOrCreate(ctx context.Context, name string, mType string) (*models.Metric, error) {
 	row := db.conn.QueryRow(ctx, findOrCreateMetric, name, mType)
@@ -131,33 +185,64 @@ func (db *DBStorage) FindOrCreate(ctx context.Context, name string, mType string
 }
 
 // FindAll retrieves all metrics from the database.
-func (db *DBStorage) FindAll(ctx context.Context) ([]*models.Metric, error) {
-	rows, err := db.conn.Query(ctx, findAllMetrics)
+func (db *DBStorage) FindAll(ctx context.Context) (metrics []*models.Metric, err error) {
+	err = db.read(ctx, func(conn pgConn) error {
+		metrics, err = scanMetrics(conn.Query(ctx, findAllMetrics))
+		return err
+	})
+	return
+}
+
+// Count returns the number of metrics in the database.
+func (db *DBStorage) Count(ctx context.Context) (count int, err error) {
+	err = db.read(ctx, func(conn pgConn) error {
+		return conn.QueryRow(ctx, countMetrics).Scan(&count)
+	})
+	return
+}
+
+// FindAllByName retrieves metrics from the database by their names.
+func (db *DBStorage) FindAllByName(ctx context.Context, names []string) (metrics []*models.Metric, err error) {
+	err = db.read(ctx, func(conn pgConn) error {
+		metrics, err = findAllByName(ctx, conn, names)
+		return err
+	})
+	return
+}
+
+// read runs the query on a read replica. If the replica turns out to be unavailable, i.e. the query fails
+// with a connection error, it is marked unhealthy and the query is retried on the primary.
+// Any other error is caused by the query itself and is returned as is.
+func (db *DBStorage) read(ctx context.Context, query func(conn pgConn) error) error {
+	conn, markUnhealthy := db.replicas.reader()
+	err := query(conn)
+	if err != nil && markUnhealthy != nil && isConnectionError(err) {
+		markUnhealthy()
+		return query(db.conn)
+	}
+	return err
+}
+
+func find(ctx context.Context, conn pgConn, name string) (*models.Metric, error) {
+	row := conn.QueryRow(ctx, findMetric, name)
+	var metric models.Metric
+	err := row.Scan(&metric.Name, &metric.MType, &metric.Gauge, &metric.Counter)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var metrics []*models.Metric
+	return &metric, err
+}
 
-	for rows.Next() {
-		metric := &models.Metric{}
-		if err = rows.Scan(&metric.Name, &metric.MType, &metric.Gauge, &metric.Counter); err != nil {
-			return nil, err
-		}
-		metrics = append(metrics, metric)
-	}
-	return metrics, err
+func findAllByName(ctx context.Context, conn pgConn, names []string) ([]*models.Metric, error) {
+	return scanMetrics(conn.Query(ctx, findMetricsByName, names))
 }
 
-// FindAllByName retrieves metrics from the database by their names.
-func (db *DBStorage) FindAllByName(ctx context.Context, names []string) ([]*models.Metric, error) {
-	rows, err := db.conn.Query(ctx, findMetricsByName, names)
+func scanMetrics(rows pgx.Rows, err error) ([]*models.Metric, error) {
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	metrics := make([]*models.Metric, 0, len(names))
+	var metrics []*models.Metric
 	for rows.Next() {
 		metric := &models.Metric{}
 		if err = rows.Scan(&metric.Name, &metric.MType, &metric.Gauge, &metric.Counter); err != nil {
@@ -165,16 +250,20 @@ func (db *DBStorage) FindAllByName(ctx context.Context, names []string) ([]*mode
 		}
 		metrics = append(metrics, metric)
 	}
-	return metrics, err
+	return metrics, rows.Err()
 }
 
 // Attach adds an observer to the DBStorage instance.
 func (db *DBStorage) Attach(observer storage.MetricsObserver) {
+	db.observersMu.Lock()
+	defer db.observersMu.Unlock()
 	db.observers = append(db.observers, observer)
 }
 
 // Detach removes an observer from the DBStorage instance.
 func (db *DBStorage) Detach(observer storage.MetricsObserver) {
+	db.observersMu.Lock()
+	defer db.observersMu.Unlock()
 	db.observers = slices.DeleteFunc(db.observers, func(o2 storage.MetricsObserver) bool {
 		return o2 == observer
 	})
@@ -182,7 +271,10 @@ func (db *DBStorage) Detach(observer storage.MetricsObserver) {
 
 // notify notifies all attached observers about a metric update.
 func (db *DBStorage) notify(ctx context.Context, model *models.Metric) error {
-	for _, observer := range db.observers {
+	db.observersMu.RLock()
+	observers := slices.Clone(db.observers)
+	db.observersMu.RUnlock()
+	for _, observer := range observers {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
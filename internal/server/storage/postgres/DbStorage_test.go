@@ -4,9 +4,12 @@ import (
 	"context"
 	"testing"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/pashagolub/pgxmock/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/models"
 )
 
 func TestFind(t *testing.T) {
@@ -14,9 +17,7 @@ func TestFind(t *testing.T) {
 	require.NoError(t, err)
 	defer mock.Close()
 
-	// Set expectation for table creation in NewDBStorage
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -48,9 +49,7 @@ func TestCreate(t *testing.T) {
 	require.NoError(t, err)
 	defer mock.Close()
 
-	// Set expectation for table creation in NewDBStorage
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -72,9 +71,7 @@ func TestUpdateCounter(t *testing.T) {
 	require.NoError(t, err)
 	defer mock.Close()
 
-	// Set expectation for table creation in NewDBStorage
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -82,11 +79,9 @@ func TestUpdateCounter(t *testing.T) {
 	metricName := "test_metric"
 	delta := int64(5)
 
-	mock.ExpectBegin()
-	mock.ExpectExec(`INSERT INTO metrics \(name, m_type, counter\)`).
+	mock.ExpectExec(`INSERT INTO metric_samples \(name, m_type, counter\)`).
 		WithArgs(metricName, delta).
 		WillReturnResult(pgxmock.NewResult("INSERT", 1))
-	mock.ExpectCommit()
 
 	mock.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics WHERE name = \$1`).
 		WithArgs(metricName).
@@ -104,9 +99,7 @@ func TestUpdateGauge(t *testing.T) {
 	require.NoError(t, err)
 	defer mock.Close()
 
-	// Set expectation for table creation in NewDBStorage
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -114,9 +107,9 @@ func TestUpdateGauge(t *testing.T) {
 	metricName := "test_metric"
 	value := 0.7
 
-	mock.ExpectExec(`UPDATE metrics SET gauge = \$1 WHERE name = \$2`).
-		WithArgs(value, metricName).
-		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec(`INSERT INTO metric_samples \(name, m_type, gauge\)`).
+		WithArgs(metricName, value).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
 
 	mock.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics WHERE name = \$1`).
 		WithArgs(metricName).
@@ -134,8 +127,7 @@ func TestFindOrCreate(t *testing.T) {
 	require.NoError(t, err)
 	defer mock.Close()
 
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -166,8 +158,7 @@ func TestFindAll(t *testing.T) {
 	require.NoError(t, err)
 	defer mock.Close()
 
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -198,14 +189,31 @@ func TestFindAll(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestDBStorage_Count(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	expectMigrations(mock)
+
+	storage, err := NewDBStorage(mock)
+	require.NoError(t, err)
+
+	mock.ExpectQuery(`SELECT count\(\*\) FROM metrics`).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(42))
+
+	count, err := storage.Count(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 42, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestDBStorage_FindAllByName(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	require.NoError(t, err)
 	defer mock.Close()
 
-	// Expect the table creation
-	mock.ExpectExec(`create table if not exists metrics`).
-		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	expectMigrations(mock)
 
 	storage, err := NewDBStorage(mock)
 	require.NoError(t, err)
@@ -213,8 +221,8 @@ func TestDBStorage_FindAllByName(t *testing.T) {
 	gauge1 := float64(1.0)
 	counter2 := int64(20)
 
-	// Here, we expect the SQL to use IN ($1)
-	mock.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics where name IN \(\$1\)`).
+	// Here, we expect the SQL to use = ANY($1)
+	mock.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics where name = ANY\(\$1\)`).
 		WithArgs(pgxmock.AnyArg()). // Allow for an array of values here
 		WillReturnRows(pgxmock.NewRows([]string{"name", "m_type", "gauge", "counter"}).
 			AddRow("metric1", "gauge", &gauge1, nil).
@@ -236,3 +244,41 @@ func TestDBStorage_FindAllByName(t *testing.T) {
 	// Verify all expectations were met
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestDBStorage_UpdateBatch(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	expectMigrations(mock)
+
+	storage, err := NewDBStorage(mock)
+	require.NoError(t, err)
+
+	delta := int64(5)
+	value := 1.5
+	batch := []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectCopyFrom(pgx.Identifier{"metric_samples"}, []string{"name", "m_type", "counter", "gauge"}).
+		WillReturnResult(3)
+	mock.ExpectCommit()
+	total := int64(10)
+	mock.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics where name = ANY\(\$1\)`).
+		WithArgs([]string{"PollCount", "Alloc"}).
+		WillReturnRows(pgxmock.NewRows([]string{"name", "m_type", "gauge", "counter"}).
+			AddRow("PollCount", "counter", nil, &total).
+			AddRow("Alloc", "gauge", &value, nil))
+
+	metrics, err := storage.UpdateBatch(context.Background(), batch)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, total, *metrics[0].Counter)
+	assert.Equal(t, value, *metrics[1].Gauge)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,7 +3,10 @@ package postgres
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -11,25 +14,70 @@ import (
 	"github.com/shadyziedan/metrica/internal/retry"
 )
 
+// pgConnWrapper retries the queries failed on connection errors. Its circuit breaker stops querying
+// a database that keeps failing, so that the callers fail fast until it recovers.
 type pgConnWrapper struct {
-	conn pgConn
+	conn   pgConn
+	policy retry.Policy
 }
 
+// breakerThreshold and breakerCooldown configure the circuit breaker of every connection.
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 10 * time.Second
+)
+
+func newPgConnWrapper(conn pgConn) *pgConnWrapper {
+	policy := retry.DefaultPolicy()
+	policy.InitialInterval = 500 * time.Millisecond
+	policy.MaxInterval = 5 * time.Second
+	policy.MaxElapsedTime = 15 * time.Second
+	policy.IsRetryable = isConnectionError
+	policy.Breaker = retry.NewBreaker(breakerThreshold, breakerCooldown)
+	return &pgConnWrapper{conn: conn, policy: policy}
+}
+
+// Exec retries the statement only if it surely hasn't reached the database: a statement whose connection
+// was lost in the middle may have been applied, and repeating it would apply it twice.
 func (p *pgConnWrapper) Exec(ctx context.Context, sql string, arguments ...interface{}) (res pgconn.CommandTag, err error) {
-	err = retry.WithBackoff(ctx, 3, isConnectionError, func() error {
+	policy := p.policy
+	policy.IsRetryable = isSafeToRetry
+	err = policy.Do(ctx, func() error {
 		res, err = p.conn.Exec(ctx, sql, arguments...)
 		return err
 	})
 	return
 }
 
+// isConnectionError reports whether the query failed because the database couldn't be reached or the connection
+// was lost: a failed connection attempt, a network error, a connection closed in the middle of the query
+// or a connection exception reported by the server (SQLSTATE class 08). Such failures are worth retrying for the reads.
 func isConnectionError(err error) bool {
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	// the context errors implement net.Error, but they mean the caller gave up
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
 	var pgErr *pgconn.PgError
-	return errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "08")
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || pgconn.SafeToRetry(err)
+}
+
+// isSafeToRetry reports whether the statement failed before it was sent to the database,
+// so that it can be repeated even if it isn't idempotent.
+func isSafeToRetry(err error) bool {
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || pgconn.SafeToRetry(err)
 }
 
 func (p *pgConnWrapper) Query(ctx context.Context, sql string, args ...interface{}) (res pgx.Rows, err error) {
-	err = retry.WithBackoff(ctx, 3, isConnectionError, func() error {
+	err = p.policy.Do(ctx, func() error {
 		res, err = p.conn.Query(ctx, sql, args...)
 		return err
 	})
@@ -41,7 +89,7 @@ func (p *pgConnWrapper) QueryRow(ctx context.Context, sql string, args ...interf
 }
 
 func (p *pgConnWrapper) Begin(ctx context.Context) (tx pgx.Tx, err error) {
-	err = retry.WithBackoff(ctx, 3, isConnectionError, func() error {
+	err = p.policy.Do(ctx, func() error {
 		tx, err = p.conn.Begin(ctx)
 		return err
 	})
@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/retry"
+)
+
+// connectError returns the error of connecting to a port nobody listens on.
+func connectError(t *testing.T) error {
+	_, err := pgconn.Connect(context.Background(), "postgres://metrica@127.0.0.1:1/metrica?connect_timeout=1")
+	require.Error(t, err)
+	var connectErr *pgconn.ConnectError
+	require.ErrorAs(t, err, &connectErr)
+	return err
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connect error", err: connectError(t), want: true},
+		{name: "dial error", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: true},
+		{name: "connection closed", err: fmt.Errorf("query failed: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "connection exception", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "no rows", err: pgx.ErrNoRows, want: false},
+		{name: "scan error", err: errors.New("can't scan into dest[0]"), want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isConnectionError(tt.err))
+		})
+	}
+}
+
+func TestIsSafeToRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connect error", err: connectError(t), want: true},
+		{name: "connection closed", err: fmt.Errorf("query failed: %w", io.ErrUnexpectedEOF), want: false},
+		{name: "read error", err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, want: false},
+		{name: "connection exception", err: &pgconn.PgError{Code: "08006"}, want: false},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isSafeToRetry(tt.err))
+		})
+	}
+}
+
+func TestPgConnWrapper_DoesNotRepeatWrites(t *testing.T) {
+	mock := newMockPool(t)
+	wrapper := newPgConnWrapper(mock)
+	wrapper.policy.InitialInterval = time.Millisecond
+
+	// the connection was lost after the statement was sent, it may have been applied
+	mock.ExpectExec("INSERT INTO metric_samples").WillReturnError(io.ErrUnexpectedEOF)
+	_, err := wrapper.Exec(context.Background(), "INSERT INTO metric_samples")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// a read is repeated
+	mock.ExpectQuery("SELECT").WillReturnError(io.ErrUnexpectedEOF)
+	mock.ExpectQuery("SELECT").WillReturnRows(mock.NewRows([]string{"id"}))
+	rows, err := wrapper.Query(context.Background(), "SELECT")
+	require.NoError(t, err)
+	rows.Close()
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPgConnWrapper_RetriesConnectErrors(t *testing.T) {
+	mock := newMockPool(t)
+	wrapper := newPgConnWrapper(mock)
+	wrapper.policy.InitialInterval = time.Millisecond
+	wrapper.policy.Breaker = retry.NewBreaker(3, time.Minute)
+	err := connectError(t)
+
+	// the query is retried until the database is back
+	mock.ExpectExec("UPDATE metrics").WillReturnError(err)
+	mock.ExpectExec("UPDATE metrics").WillReturnResult(pgconn.NewCommandTag("UPDATE 1"))
+	_, execErr := wrapper.Exec(context.Background(), "UPDATE metrics")
+	require.NoError(t, execErr)
+
+	// a database that keeps failing opens the breaker
+	for i := 0; i < 3; i++ {
+		mock.ExpectExec("UPDATE metrics").WillReturnError(err)
+	}
+	_, execErr = wrapper.Exec(context.Background(), "UPDATE metrics")
+	assert.ErrorIs(t, execErr, retry.ErrCircuitOpen)
+	assert.True(t, wrapper.policy.Breaker.Open())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
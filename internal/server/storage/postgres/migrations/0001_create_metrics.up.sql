@@ -0,0 +1,9 @@
+create table if not exists metrics
+(
+    id      serial,
+    name    varchar not null,
+    m_type  varchar not null,
+    counter bigint,
+    gauge   decimal
+);
+create unique index if not exists metrics_name_uindex on metrics (name);
@@ -0,0 +1,2 @@
+drop table if exists metric_samples;
+drop function if exists metric_samples_apply();
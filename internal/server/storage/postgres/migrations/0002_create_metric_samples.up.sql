@@ -0,0 +1,39 @@
+create table if not exists metric_samples
+(
+    name    varchar     not null,
+    m_type  varchar     not null,
+    counter bigint,
+    gauge   double precision,
+    ts      timestamptz not null default now()
+) partition by range (ts);
+create index if not exists metric_samples_name_ts_idx on metric_samples (name, ts desc);
+-- the default partition keeps the samples inserted while the partition of their day is missing,
+-- the partition manager moves them to the daily partition when it creates it.
+create table if not exists metric_samples_default partition of metric_samples default;
+
+-- metrics keeps the current value of every metric, derived from the samples as they are inserted:
+-- counter samples hold deltas that are summed up, gauge samples replace the value.
+create or replace function metric_samples_apply() returns trigger as
+$$
+begin
+    if new.m_type = 'counter' then
+        insert into metrics (name, m_type, counter)
+        values (new.name, new.m_type, new.counter)
+        on conflict (name) do update set m_type  = excluded.m_type,
+                                         counter = coalesce(metrics.counter, 0) + excluded.counter;
+    else
+        insert into metrics (name, m_type, gauge)
+        values (new.name, new.m_type, new.gauge)
+        on conflict (name) do update set m_type = excluded.m_type,
+                                         gauge  = excluded.gauge;
+    end if;
+    return null;
+end;
+$$ language plpgsql;
+
+drop trigger if exists metric_samples_apply on metric_samples;
+create trigger metric_samples_apply
+    after insert
+    on metric_samples
+    for each row
+execute function metric_samples_apply();
@@ -0,0 +1,7 @@
+create table if not exists api_tokens
+(
+    name       varchar(255) primary key,
+    token_hash char(64)     not null unique,
+    scopes     text[]       not null,
+    created_at timestamptz  not null default now()
+);
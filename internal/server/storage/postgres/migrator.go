@@ -0,0 +1,200 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockKey is the advisory lock key taken while migrations are applied,
+// so that several server replicas starting at once don't race each other.
+const migrationsLockKey int64 = 7_262_534_812
+
+const (
+	lockMigrations         = `SELECT pg_advisory_xact_lock($1)`
+	createMigrationsTable  = `create table if not exists schema_migrations (version bigint primary key, name varchar not null, applied_at timestamptz not null default now())`
+	findAppliedMigrations  = `SELECT version FROM schema_migrations ORDER BY version`
+	insertAppliedMigration = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+	deleteAppliedMigration = `DELETE FROM schema_migrations WHERE version = $1`
+)
+
+const migrationFileNameFormat = "<version>_<name>.<up|down>.sql"
+
+// Migration is a single versioned schema change with its up and down SQL scripts.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies the embedded SQL migrations and records them in the schema_migrations table.
+type Migrator struct {
+	conn       pgConn
+	migrations []Migration
+}
+
+// NewMigrator creates a new Migrator for the embedded migrations.
+func NewMigrator(conn pgConn) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{conn: conn, migrations: migrations}, nil
+}
+
+// Migrations returns the known migrations ordered by version.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Up applies all pending migrations in a single transaction.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.inLockedTx(ctx, func(tx pgx.Tx, applied []int64) error {
+		for _, migration := range m.migrations {
+			if slices.Contains(applied, migration.Version) {
+				continue
+			}
+			if _, err := tx.Exec(ctx, migration.Up); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if _, err := tx.Exec(ctx, insertAppliedMigration, migration.Version, migration.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the given number of the most recently applied migrations in a single transaction.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.inLockedTx(ctx, func(tx pgx.Tx, applied []int64) error {
+		for i := len(applied) - 1; i >= 0 && steps > 0; i-- {
+			idx := slices.IndexFunc(m.migrations, func(migration Migration) bool {
+				return migration.Version == applied[i]
+			})
+			if idx < 0 {
+				return fmt.Errorf("applied migration %d is unknown", applied[i])
+			}
+			migration := m.migrations[idx]
+			if _, err := tx.Exec(ctx, migration.Down); err != nil {
+				return fmt.Errorf("failed to roll back migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if _, err := tx.Exec(ctx, deleteAppliedMigration, migration.Version); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Applied returns the versions of the applied migrations.
+func (m *Migrator) Applied(ctx context.Context) ([]int64, error) {
+	var versions []int64
+	err := m.inLockedTx(ctx, func(_ pgx.Tx, applied []int64) error {
+		versions = applied
+		return nil
+	})
+	return versions, err
+}
+
+// inLockedTx runs fn in a transaction holding the migrations advisory lock.
+// The lock is released automatically when the transaction ends.
+func (m *Migrator) inLockedTx(ctx context.Context, fn func(tx pgx.Tx, applied []int64) error) error {
+	tx, err := m.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, lockMigrations, migrationsLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migrations lock: %w", err)
+	}
+	if _, err = tx.Exec(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+	applied, err := appliedVersions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx, applied); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func appliedVersions(ctx context.Context, tx pgx.Tx) ([]int64, error) {
+	rows, err := tx.Query(ctx, findAppliedMigrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []int64
+	for rows.Next() {
+		var version int64
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// loadMigrations reads the migration scripts from the directory, pairing up and down scripts by version.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		versionStr, name, found := strings.Cut(base, "_")
+		if !ok || !found {
+			return nil, fmt.Errorf("invalid migration file name %s, expected %s", entry.Name(), migrationFileNameFormat)
+		}
+		version, err := strconv.ParseInt(versionStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		switch direction {
+		case "up":
+			migration.Up = string(content)
+		case "down":
+			migration.Down = string(content)
+		default:
+			return nil, fmt.Errorf("invalid migration file name %s, expected %s", entry.Name(), migrationFileNameFormat)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down scripts", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return int(a.Version - b.Version)
+	})
+	return migrations, nil
+}
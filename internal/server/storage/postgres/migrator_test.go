@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectMigrations sets the expectations for applying every embedded migration on an empty database.
+func expectMigrations(mock pgxmock.PgxPoolIface, applied ...int64) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).
+		WithArgs(migrationsLockKey).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectExec(`create table if not exists schema_migrations`).
+		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	rows := pgxmock.NewRows([]string{"version"})
+	for _, version := range applied {
+		rows.AddRow(version)
+	}
+	mock.ExpectQuery(`SELECT version FROM schema_migrations`).WillReturnRows(rows)
+	for _, migration := range migrations {
+		if slices.Contains(applied, migration.Version) {
+			continue
+		}
+		mock.ExpectExec(regexp.QuoteMeta(migration.Up)).
+			WillReturnResult(pgxmock.NewResult("CREATE", 0))
+		mock.ExpectExec(`INSERT INTO schema_migrations`).
+			WithArgs(migration.Version, migration.Name).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	}
+	mock.ExpectCommit()
+}
+
+func TestMigrator_Up(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	migrator, err := NewMigrator(mock)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrator.Migrations())
+	assert.Equal(t, int64(1), migrator.Migrations()[0].Version)
+	assert.Equal(t, "create_metrics", migrator.Migrations()[0].Name)
+
+	expectMigrations(mock)
+	require.NoError(t, migrator.Up(context.Background()))
+
+	// already applied migrations are skipped
+	var applied []int64
+	for _, migration := range migrator.Migrations() {
+		applied = append(applied, migration.Version)
+	}
+	expectMigrations(mock, applied...)
+	require.NoError(t, migrator.Up(context.Background()))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Down(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	migrator, err := NewMigrator(mock)
+	require.NoError(t, err)
+	last := migrator.Migrations()[len(migrator.Migrations())-1]
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).
+		WithArgs(migrationsLockKey).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectExec(`create table if not exists schema_migrations`).
+		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	rows := pgxmock.NewRows([]string{"version"})
+	for _, migration := range migrator.Migrations() {
+		rows.AddRow(migration.Version)
+	}
+	mock.ExpectQuery(`SELECT version FROM schema_migrations`).WillReturnRows(rows)
+	mock.ExpectExec(regexp.QuoteMeta(last.Down)).
+		WillReturnResult(pgxmock.NewResult("DROP", 0))
+	mock.ExpectExec(`DELETE FROM schema_migrations WHERE version = \$1`).
+		WithArgs(last.Version).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, migrator.Down(context.Background(), 1))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,162 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/server/logger"
+)
+
+const (
+	partitionPrefix     = "metric_samples_"
+	defaultPartition    = "metric_samples_default"
+	partitionNameLayout = "20060102"
+	partitionDay        = 24 * time.Hour
+)
+
+const findSamplePartitions = `
+SELECT c.relname FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+JOIN pg_class p ON p.oid = i.inhparent
+WHERE p.relname = 'metric_samples'`
+
+// PartitionManager maintains the daily partitions of the metric_samples table:
+// it creates the partitions for the upcoming days and drops the ones older than the retention period.
+// The samples inserted while the partition of their day is missing land in the default partition,
+// they are moved to the partition of the day once it is created.
+type PartitionManager struct {
+	conn      pgConn
+	retention time.Duration
+	ahead     int
+	interval  time.Duration
+	now       func() time.Time
+}
+
+// NewPartitionManager creates a new PartitionManager keeping the samples for the given retention period.
+// A zero retention keeps the samples forever.
+func NewPartitionManager(conn pgConn, retention time.Duration) *PartitionManager {
+	return &PartitionManager{
+		conn:      newPgConnWrapper(conn),
+		retention: retention,
+		ahead:     3,
+		interval:  time.Hour,
+		now:       time.Now,
+	}
+}
+
+// Run keeps the partitions up to date until the context is canceled.
+func (pm *PartitionManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(pm.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pm.EnsurePartitions(ctx); err != nil {
+				logger.Log.Error("failed to maintain metric samples partitions", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// EnsurePartitions creates the partitions from today up to the configured number of days ahead
+// and drops the expired ones.
+func (pm *PartitionManager) EnsurePartitions(ctx context.Context) error {
+	partitions, err := pm.partitions(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(partitions))
+	for _, name := range partitions {
+		existing[name] = true
+	}
+	today := pm.now().UTC().Truncate(partitionDay)
+	for i := 0; i <= pm.ahead; i++ {
+		day := today.Add(time.Duration(i) * partitionDay)
+		if existing[partitionName(day)] {
+			continue
+		}
+		if err = pm.createPartition(ctx, day); err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", partitionName(day), err)
+		}
+	}
+	if pm.retention <= 0 {
+		return nil
+	}
+	return pm.dropExpired(ctx, partitions, today.Add(-pm.retention))
+}
+
+// partitions returns the names of the partitions of the metric_samples table.
+func (pm *PartitionManager) partitions(ctx context.Context) ([]string, error) {
+	rows, err := pm.conn.Query(ctx, findSamplePartitions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// createPartition creates the partition of the day, moving the samples of the day out of the default partition:
+// a partition can't be attached while the default one holds rows of its range. The default partition is locked
+// until the partition is attached, so that no sample of the day lands there meanwhile. The samples are copied
+// before the partition is attached, so they don't go through the trigger updating the metrics again.
+func (pm *PartitionManager) createPartition(ctx context.Context, day time.Time) error {
+	name := partitionName(day)
+	from, to := day.Format(time.RFC3339), day.Add(partitionDay).Format(time.RFC3339)
+	tx, err := pm.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	statements := []string{
+		fmt.Sprintf(`LOCK TABLE %s IN ACCESS EXCLUSIVE MODE`, defaultPartition),
+		fmt.Sprintf(`CREATE TABLE %s (LIKE metric_samples INCLUDING DEFAULTS)`, name),
+		fmt.Sprintf(`INSERT INTO %s SELECT * FROM %s WHERE ts >= '%s' AND ts < '%s'`, name, defaultPartition, from, to),
+		fmt.Sprintf(`DELETE FROM %s WHERE ts >= '%s' AND ts < '%s'`, defaultPartition, from, to),
+		fmt.Sprintf(`ALTER TABLE metric_samples ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`, name, from, to),
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// dropExpired drops the daily partitions whose whole range is before the given time.
+func (pm *PartitionManager) dropExpired(ctx context.Context, partitions []string, before time.Time) error {
+	for _, name := range partitions {
+		day, err := time.Parse(partitionNameLayout, strings.TrimPrefix(name, partitionPrefix))
+		if err != nil {
+			// the default partition and partitions not managed here are left alone
+			continue
+		}
+		if day.Add(partitionDay).After(before) {
+			continue
+		}
+		if _, err = pm.conn.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)); err != nil {
+			return fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+		logger.Log.Info("dropped expired metric samples partition", zap.String("partition", name))
+	}
+	return nil
+}
+
+func partitionName(day time.Time) string {
+	return partitionPrefix + day.Format(partitionNameLayout)
+}
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionManager_EnsurePartitions(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+
+	pm := NewPartitionManager(mock, 2*24*time.Hour)
+	pm.ahead = 1
+	pm.now = func() time.Time {
+		return time.Date(2024, 10, 10, 15, 30, 0, 0, time.UTC)
+	}
+
+	mock.ExpectQuery(`SELECT c.relname FROM pg_inherits`).
+		WillReturnRows(pgxmock.NewRows([]string{"relname"}).
+			AddRow("metric_samples_default").
+			AddRow("metric_samples_20241007").
+			AddRow("metric_samples_20241008").
+			AddRow("metric_samples_20241009").
+			AddRow("metric_samples_20241010"))
+	// only the missing partition is created, taking over the samples of its day from the default partition
+	mock.ExpectBegin()
+	mock.ExpectExec(`LOCK TABLE metric_samples_default IN ACCESS EXCLUSIVE MODE`).
+		WillReturnResult(pgxmock.NewResult("LOCK", 0))
+	mock.ExpectExec(`CREATE TABLE metric_samples_20241011 \(LIKE metric_samples INCLUDING DEFAULTS\)`).
+		WillReturnResult(pgxmock.NewResult("CREATE", 0))
+	mock.ExpectExec(`INSERT INTO metric_samples_20241011 SELECT \* FROM metric_samples_default WHERE ts >= '2024-10-11T00:00:00Z' AND ts < '2024-10-12T00:00:00Z'`).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	mock.ExpectExec(`DELETE FROM metric_samples_default WHERE ts >= '2024-10-11T00:00:00Z' AND ts < '2024-10-12T00:00:00Z'`).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+	mock.ExpectExec(`ALTER TABLE metric_samples ATTACH PARTITION metric_samples_20241011 FOR VALUES FROM \('2024-10-11T00:00:00Z'\) TO \('2024-10-12T00:00:00Z'\)`).
+		WillReturnResult(pgxmock.NewResult("ALTER", 0))
+	mock.ExpectCommit()
+	mock.ExpectExec(`DROP TABLE IF EXISTS metric_samples_20241007`).
+		WillReturnResult(pgxmock.NewResult("DROP", 0))
+
+	require.NoError(t, pm.EnsurePartitions(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
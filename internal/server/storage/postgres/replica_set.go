@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shadyziedan/metrica/internal/server/logger"
+)
+
+// replicaConn is a read replica connection that can be health-checked.
+type replicaConn interface {
+	pgConn
+	Ping(ctx context.Context) error
+}
+
+// replica is queried without retries: a replica losing the connection is marked unhealthy
+// and the query falls back to the primary at once.
+type replica struct {
+	conn    replicaConn
+	healthy atomic.Bool
+}
+
+// ReplicaSet routes read queries to healthy read replicas in round-robin order
+// and falls back to the primary when none of the replicas is healthy.
+type ReplicaSet struct {
+	primary       pgConn
+	replicas      []*replica
+	next          atomic.Uint64
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+}
+
+// NewReplicaSet creates a new ReplicaSet. The replicas are considered healthy until the first failed check.
+func NewReplicaSet(primary pgConn, replicas ...replicaConn) *ReplicaSet {
+	rs := &ReplicaSet{
+		primary:       primary,
+		checkInterval: 5 * time.Second,
+		checkTimeout:  time.Second,
+	}
+	for _, conn := range replicas {
+		r := &replica{conn: conn}
+		r.healthy.Store(true)
+		rs.replicas = append(rs.replicas, r)
+	}
+	return rs
+}
+
+// reader returns the connection the next read query should use and a function
+// to report a connection failure on it.
+func (rs *ReplicaSet) reader() (pgConn, func()) {
+	n := uint64(len(rs.replicas))
+	start := rs.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		r := rs.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.conn, func() { rs.markUnhealthy(r) }
+		}
+	}
+	return rs.primary, nil
+}
+
+func (rs *ReplicaSet) markUnhealthy(r *replica) {
+	if r.healthy.CompareAndSwap(true, false) {
+		logger.Log.Warn("read replica marked unhealthy, falling back")
+	}
+}
+
+// CheckHealth pings every replica and updates its health state.
+func (rs *ReplicaSet) CheckHealth(ctx context.Context) {
+	for i, r := range rs.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, rs.checkTimeout)
+		err := r.conn.Ping(pingCtx)
+		cancel()
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				logger.Log.Info("read replica is healthy again", zap.Int("replica", i))
+			} else {
+				logger.Log.Warn("read replica is unhealthy", zap.Int("replica", i), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Run checks the replicas health periodically until the context is canceled.
+func (rs *ReplicaSet) Run(ctx context.Context) {
+	if len(rs.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(rs.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rs.CheckHealth(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
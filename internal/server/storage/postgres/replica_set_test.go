@@ -0,0 +1,110 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockPool(t *testing.T) pgxmock.PgxPoolIface {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	t.Cleanup(mock.Close)
+	return mock
+}
+
+func expectFind(mock pgxmock.PgxPoolIface, name string, value float64) {
+	mock.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics WHERE name = \$1`).
+		WithArgs(name).
+		WillReturnRows(pgxmock.NewRows([]string{"name", "m_type", "gauge", "counter"}).
+			AddRow(name, "gauge", &value, nil))
+}
+
+func TestDBStorage_ReadsFromReplicas(t *testing.T) {
+	primary := newMockPool(t)
+	replica1 := newMockPool(t)
+	replica2 := newMockPool(t)
+
+	expectMigrations(primary)
+	storage, err := NewDBStorage(primary, WithReplicas(replica1, replica2))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// reads are spread over the replicas
+	expectFind(replica2, "metric", 1)
+	expectFind(replica1, "metric", 2)
+	metric, err := storage.Find(ctx, "metric")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *metric.Gauge)
+	metric, err = storage.Find(ctx, "metric")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *metric.Gauge)
+
+	// an unhealthy replica is skipped
+	replica1.ExpectPing().WillReturnError(errors.New("connection refused"))
+	replica2.ExpectPing()
+	storage.replicas.CheckHealth(ctx)
+	expectFind(replica2, "metric", 3)
+	expectFind(replica2, "metric", 4)
+	for _, want := range []float64{3, 4} {
+		metric, err = storage.Find(ctx, "metric")
+		require.NoError(t, err)
+		assert.Equal(t, want, *metric.Gauge)
+	}
+
+	// an error caused by the query itself doesn't make the replica unhealthy
+	replica2.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics WHERE name = \$1`).
+		WithArgs("metric").
+		WillReturnError(errors.New("can't scan into dest[2]"))
+	_, err = storage.Find(ctx, "metric")
+	require.Error(t, err)
+	expectFind(replica2, "metric", 4.5)
+	metric, err = storage.Find(ctx, "metric")
+	require.NoError(t, err)
+	assert.Equal(t, 4.5, *metric.Gauge)
+
+	// a replica losing the connection is marked unhealthy and the query falls back to the primary
+	replica2.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics WHERE name = \$1`).
+		WithArgs("metric").
+		WillReturnError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")})
+	expectFind(primary, "metric", 5)
+	metric, err = storage.Find(ctx, "metric")
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, *metric.Gauge)
+
+	// with no healthy replica left every read goes to the primary
+	expectFind(primary, "metric", 6)
+	metric, err = storage.Find(ctx, "metric")
+	require.NoError(t, err)
+	assert.Equal(t, 6.0, *metric.Gauge)
+
+	assert.NoError(t, primary.ExpectationsWereMet())
+	assert.NoError(t, replica1.ExpectationsWereMet())
+	assert.NoError(t, replica2.ExpectationsWereMet())
+}
+
+func TestDBStorage_FallsBackWithoutRetries(t *testing.T) {
+	primary := newMockPool(t)
+	replica := newMockPool(t)
+
+	expectMigrations(primary)
+	storage, err := NewDBStorage(primary, WithReplicas(replica))
+	require.NoError(t, err)
+
+	// the replica is queried once, the primary answers right away
+	replica.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics`).
+		WillReturnError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")})
+	primary.ExpectQuery(`SELECT name, m_type, gauge, counter FROM metrics`).
+		WillReturnRows(pgxmock.NewRows([]string{"name", "m_type", "gauge", "counter"}).AddRow("metric", "counter", nil, new(int64)))
+	metrics, err := storage.FindAll(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+
+	assert.NoError(t, primary.ExpectationsWereMet())
+	assert.NoError(t, replica.ExpectationsWereMet())
+}
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/shadyziedan/metrica/internal/server/auth"
+)
+
+const createToken = `INSERT INTO api_tokens (name, token_hash, scopes) VALUES ($1, $2, $3)`
+const deleteToken = `DELETE FROM api_tokens WHERE name = $1`
+const findAllTokens = `SELECT name, token_hash, scopes FROM api_tokens ORDER BY name`
+const findTokenByHash = `SELECT name, token_hash, scopes FROM api_tokens WHERE token_hash = $1`
+
+// TokenStorage keeps the API tokens in the database. Only the token hashes are stored.
+type TokenStorage struct {
+	conn pgConn
+}
+
+// NewTokenStorage creates a new instance of TokenStorage.
+func NewTokenStorage(conn pgConn) *TokenStorage {
+	return &TokenStorage{conn: newPgConnWrapper(conn)}
+}
+
+// Create stores a new token. The token name must be unique.
+func (s *TokenStorage) Create(ctx context.Context, token auth.Token) error {
+	_, err := s.conn.Exec(ctx, createToken, token.Name, token.Hash, scopeStrings(token.Scopes))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return fmt.Errorf("token %s already exists", token.Name)
+	}
+	return err
+}
+
+// Delete revokes the token with the given name.
+func (s *TokenStorage) Delete(ctx context.Context, name string) error {
+	tag, err := s.conn.Exec(ctx, deleteToken, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return auth.ErrTokenNotFound
+	}
+	return nil
+}
+
+// FindAll returns all the tokens ordered by name.
+func (s *TokenStorage) FindAll(ctx context.Context) ([]auth.Token, error) {
+	rows, err := s.conn.Query(ctx, findAllTokens)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []auth.Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// FindByHash returns the token with the given hash or auth.ErrTokenNotFound.
+func (s *TokenStorage) FindByHash(ctx context.Context, hash string) (*auth.Token, error) {
+	token, err := scanToken(s.conn.QueryRow(ctx, findTokenByHash, hash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, auth.ErrTokenNotFound
+	}
+	return token, err
+}
+
+func scanToken(row pgx.Row) (*auth.Token, error) {
+	var token auth.Token
+	var scopes []string
+	if err := row.Scan(&token.Name, &token.Hash, &scopes); err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		token.Scopes = append(token.Scopes, auth.Scope(scope))
+	}
+	return &token, nil
+}
+
+func scopeStrings(scopes []auth.Scope) []string {
+	values := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		values = append(values, string(scope))
+	}
+	return values
+}
@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/server/auth"
+)
+
+func TestTokenStorage(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	require.NoError(t, err)
+	defer mock.Close()
+	ctx := context.Background()
+	tokens := NewTokenStorage(mock)
+	token := auth.Token{Name: "dashboard", Hash: auth.HashToken("secret"), Scopes: []auth.Scope{auth.ScopeRead}}
+
+	t.Run("create", func(t *testing.T) {
+		mock.ExpectExec(`INSERT INTO api_tokens`).
+			WithArgs("dashboard", token.Hash, []string{"read"}).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		assert.NoError(t, tokens.Create(ctx, token))
+	})
+
+	t.Run("create duplicate", func(t *testing.T) {
+		mock.ExpectExec(`INSERT INTO api_tokens`).
+			WithArgs("dashboard", token.Hash, []string{"read"}).
+			WillReturnError(&pgconn.PgError{Code: "23505"})
+		assert.EqualError(t, tokens.Create(ctx, token), "token dashboard already exists")
+	})
+
+	t.Run("find by hash", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT name, token_hash, scopes FROM api_tokens WHERE token_hash = \$1`).
+			WithArgs(token.Hash).
+			WillReturnRows(pgxmock.NewRows([]string{"name", "token_hash", "scopes"}).AddRow("dashboard", token.Hash, []string{"read"}))
+		found, err := tokens.FindByHash(ctx, token.Hash)
+		require.NoError(t, err)
+		assert.Equal(t, &token, found)
+	})
+
+	t.Run("unknown hash", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT name, token_hash, scopes FROM api_tokens WHERE token_hash = \$1`).
+			WithArgs("unknown").
+			WillReturnError(pgx.ErrNoRows)
+		_, err := tokens.FindByHash(ctx, "unknown")
+		assert.ErrorIs(t, err, auth.ErrTokenNotFound)
+	})
+
+	t.Run("delete unknown", func(t *testing.T) {
+		mock.ExpectExec(`DELETE FROM api_tokens`).
+			WithArgs("unknown").
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		assert.ErrorIs(t, tokens.Delete(ctx, "unknown"), auth.ErrTokenNotFound)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
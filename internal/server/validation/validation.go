@@ -0,0 +1,199 @@
+// Package validation provides the input limits of the server: the metric name length and character set,
+// the batch size, the request body size and the total number of stored series.
+package validation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/models"
+)
+
+// DefaultNamePattern is the recommended character set of the metric names, the server checks none by default.
+// A name may carry labels as name;key=value;key2=value2, like the series converted from OpenTelemetry.
+const DefaultNamePattern = `^[A-Za-z0-9_.:\-]+(;[A-Za-z0-9_.:\-]+=[A-Za-z0-9_.:\-]*)*$`
+
+// Limits configures the input validation. A zero value disables the corresponding limit.
+type Limits struct {
+	// MaxNameLength is the maximum length of a metric name in bytes
+	MaxNameLength int
+	// NamePattern is the pattern every metric name must match
+	NamePattern *regexp.Regexp
+	// MaxBatchSize is the maximum number of metrics in a single batch
+	MaxBatchSize int
+	// MaxBodyBytes is the maximum size of a request body, both as received and decompressed
+	MaxBodyBytes int64
+	// MaxStreamBytes is the maximum size of a streamed request body, both as received and decompressed
+	MaxStreamBytes int64
+	// MaxSeries is the maximum number of distinct metrics stored by the server
+	MaxSeries int
+}
+
+type seriesRepository interface {
+	Count(ctx context.Context) (int, error)
+	FindAllByName(ctx context.Context, names []string) ([]*models.Metric, error)
+}
+
+// Validator checks the incoming metrics against the limits.
+type Validator struct {
+	limits     Limits
+	repository seriesRepository
+}
+
+// NewValidator creates a new Validator. The repository is used to count the stored series.
+func NewValidator(limits Limits, repository seriesRepository) *Validator {
+	return &Validator{limits: limits, repository: repository}
+}
+
+// MaxBodyBytes returns the maximum size of a request body, zero means unlimited.
+func (v *Validator) MaxBodyBytes() int64 {
+	return v.limits.MaxBodyBytes
+}
+
+// MaxStreamBytes returns the maximum size of a streamed request body, zero means unlimited.
+func (v *Validator) MaxStreamBytes() int64 {
+	return v.limits.MaxStreamBytes
+}
+
+// CheckName checks the metric name length and character set.
+func (v *Validator) CheckName(name string) error {
+	if v.limits.MaxNameLength > 0 && len(name) > v.limits.MaxNameLength {
+		return apierror.New(http.StatusBadRequest, apierror.CodeMetricNameTooLong,
+			fmt.Sprintf("metric name is longer than %d bytes", v.limits.MaxNameLength)).WithMetric(name)
+	}
+	if v.limits.NamePattern != nil && !v.limits.NamePattern.MatchString(name) {
+		return apierror.New(http.StatusBadRequest, apierror.CodeInvalidMetricName,
+			fmt.Sprintf("metric name doesn't match %s", v.limits.NamePattern)).WithMetric(name)
+	}
+	return nil
+}
+
+// CheckBatch checks the number of metrics in a batch.
+func (v *Validator) CheckBatch(size int) error {
+	if v.limits.MaxBatchSize > 0 && size > v.limits.MaxBatchSize {
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeBatchTooLarge,
+			fmt.Sprintf("batch has %d metrics, at most %d are allowed", size, v.limits.MaxBatchSize))
+	}
+	return nil
+}
+
+// CheckNames checks every name and makes sure the new names fit into the series limit.
+// The stored series are counted only when new names appear, so concurrent requests
+// may exceed the limit by the size of their batches.
+func (v *Validator) CheckNames(ctx context.Context, names []string) error {
+	for _, name := range names {
+		if err := v.CheckName(name); err != nil {
+			return err
+		}
+	}
+	if v.limits.MaxSeries <= 0 {
+		return nil
+	}
+	existing, err := v.repository.FindAllByName(ctx, names)
+	if err != nil {
+		return fmt.Errorf("error counting metric series: %w", err)
+	}
+	newNames := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		newNames[name] = struct{}{}
+	}
+	for _, metric := range existing {
+		delete(newNames, metric.Name)
+	}
+	if len(newNames) == 0 {
+		return nil
+	}
+	count, err := v.repository.Count(ctx)
+	if err != nil {
+		return fmt.Errorf("error counting metric series: %w", err)
+	}
+	if count+len(newNames) > v.limits.MaxSeries {
+		return apierror.New(http.StatusUnprocessableEntity, apierror.CodeTooManySeries,
+			fmt.Sprintf("the server stores at most %d metric series", v.limits.MaxSeries))
+	}
+	return nil
+}
+
+type validatorKey struct{}
+
+// WithValidator returns a copy of the context carrying the validator, so that the handlers can use it.
+func WithValidator(ctx context.Context, v *Validator) context.Context {
+	return context.WithValue(ctx, validatorKey{}, v)
+}
+
+func fromContext(ctx context.Context) (*Validator, bool) {
+	v, ok := ctx.Value(validatorKey{}).(*Validator)
+	return v, ok
+}
+
+// CheckName checks the name length and character set with the validator in the context.
+// It allows everything when the context has no validator.
+func CheckName(ctx context.Context, name string) error {
+	v, ok := fromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return v.CheckName(name)
+}
+
+// CheckNames checks the names with the validator in the context.
+// It allows everything when the context has no validator.
+func CheckNames(ctx context.Context, names ...string) error {
+	v, ok := fromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return v.CheckNames(ctx, names)
+}
+
+// CheckBatch checks the batch size with the validator in the context.
+// It allows everything when the context has no validator.
+func CheckBatch(ctx context.Context, size int) error {
+	v, ok := fromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return v.CheckBatch(size)
+}
+
+// LimitBody returns the request body limited to the maximum body size of the validator in the context.
+// Reading past the limit fails with an error that BodyError turns into the error response.
+func LimitBody(w http.ResponseWriter, r *http.Request) io.ReadCloser {
+	v, ok := fromContext(r.Context())
+	if !ok || v.limits.MaxBodyBytes <= 0 {
+		return r.Body
+	}
+	return http.MaxBytesReader(w, r.Body, v.limits.MaxBodyBytes)
+}
+
+// LimitStream returns the streamed request body limited to the maximum stream size of the validator in the context.
+func LimitStream(w http.ResponseWriter, r *http.Request) io.ReadCloser {
+	v, ok := fromContext(r.Context())
+	if !ok || v.limits.MaxStreamBytes <= 0 {
+		return r.Body
+	}
+	return http.MaxBytesReader(w, r.Body, v.limits.MaxStreamBytes)
+}
+
+// IsStream reports whether the request body is a stream of updates.
+func IsStream(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == models.StreamContentType
+}
+
+// BodyError returns the error response for a request body that couldn't be read or decoded:
+// 413 Request Entity Too Large when the body exceeds the size limit and 400 Bad Request otherwise.
+func BodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return apierror.New(http.StatusBadRequest, apierror.CodeInvalidBody, err.Error())
+	}
+	return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeBodyTooLarge,
+		fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit))
+}
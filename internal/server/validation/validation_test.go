@@ -0,0 +1,78 @@
+package validation
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shadyziedan/metrica/internal/apierror"
+	"github.com/shadyziedan/metrica/internal/server/storage"
+)
+
+func TestValidator_CheckNames(t *testing.T) {
+	repo := storage.NewMemStorage()
+	require.NoError(t, repo.Create(context.Background(), "Alloc", "gauge"))
+	require.NoError(t, repo.Create(context.Background(), "PollCount", "counter"))
+	v := NewValidator(Limits{
+		MaxNameLength: 10,
+		NamePattern:   regexp.MustCompile(DefaultNamePattern),
+		MaxSeries:     3,
+	}, repo)
+
+	var apiErr *apierror.Error
+	err := v.CheckNames(context.Background(), []string{"VeryLongMetricName"})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, apierror.CodeMetricNameTooLong, apiErr.Code)
+	assert.Equal(t, "VeryLongMetricName", apiErr.MetricID)
+
+	err = v.CheckNames(context.Background(), []string{"bad name"})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, apierror.CodeInvalidMetricName, apiErr.Code)
+
+	err = v.CheckNames(context.Background(), []string{""})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, apierror.CodeInvalidMetricName, apiErr.Code)
+
+	assert.NoError(t, v.CheckNames(context.Background(), []string{"Alloc", "PollCount", "Random"}))
+	err = v.CheckNames(context.Background(), []string{"Alloc", "Random", "Other"})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, apierror.CodeTooManySeries, apiErr.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, apiErr.Status)
+}
+
+func TestValidator_CheckBatch(t *testing.T) {
+	v := NewValidator(Limits{MaxBatchSize: 2}, nil)
+	assert.NoError(t, v.CheckBatch(2))
+
+	var apiErr *apierror.Error
+	require.ErrorAs(t, v.CheckBatch(3), &apiErr)
+	assert.Equal(t, apierror.CodeBatchTooLarge, apiErr.Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.Status)
+}
+
+func TestContext(t *testing.T) {
+	assert.NoError(t, CheckNames(context.Background(), "bad name"))
+	assert.NoError(t, CheckBatch(context.Background(), 1_000_000))
+
+	v := NewValidator(Limits{NamePattern: regexp.MustCompile(DefaultNamePattern), MaxBodyBytes: 4}, nil)
+	req := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader("too large"))
+	req = req.WithContext(WithValidator(req.Context(), v))
+	assert.Error(t, CheckNames(req.Context(), "bad name"))
+
+	_, err := io.ReadAll(LimitBody(httptest.NewRecorder(), req))
+	var apiErr *apierror.Error
+	require.ErrorAs(t, BodyError(err), &apiErr)
+	assert.Equal(t, apierror.CodeBodyTooLarge, apiErr.Code)
+
+	require.ErrorAs(t, BodyError(errors.New("unexpected EOF")), &apiErr)
+	assert.Equal(t, apierror.CodeInvalidBody, apiErr.Code)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}